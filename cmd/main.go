@@ -1,19 +1,188 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"reflect"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/khoakmp/judgo/pkg/artifact"
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/logic"
+	"github.com/khoakmp/judgo/pkg/sandbox"
+	"github.com/khoakmp/judgo/pkg/server"
+	"github.com/khoakmp/judgo/pkg/storage"
+	"github.com/khoakmp/judgo/pkg/testcase"
+	"github.com/redis/go-redis/v9"
 )
 
-type Person struct {
-	name string
+func main() {
+	// the judge is re-executed to set up each sandbox
+	sandbox.Init()
+
+	addr := flag.String("addr", ":8080", "http listen address")
+	brokerKind := flag.String("broker", "memory", "broker implementation: memory | redis | redis-stream (FIFO within each queue, no sharding)")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "redis address, used with -broker=redis and -broker=redis-stream")
+	testcaseDir := flag.String("testcase-dir", "./testcases", "directory containing the testcases")
+	slots := flag.Int("slots", 4, "number of submissions judged concurrently")
+	policy := broker.DefaultSchedulePolicy
+	flag.IntVar(&policy.ContestWeight, "contest-weight", policy.ContestWeight, "relative share of picks from the contest queue")
+	flag.IntVar(&policy.PracticeWeight, "practice-weight", policy.PracticeWeight, "relative share of picks from the practice queue")
+	flag.Float64Var(&policy.MinPracticeShare, "min-practice-share", policy.MinPracticeShare, "minimum fraction of picks from the practice queue")
+	flag.DurationVar(&policy.PracticeAging, "practice-aging", policy.PracticeAging, "practice submissions pending longer than this are picked first, 0 disables")
+	retention := flag.Duration("retention", broker.DefaultRetention, "how long the broker keeps the task and results of a persisted submission")
+	drainGrace := flag.Duration("drain-grace", time.Second*20, "on SIGINT or SIGTERM, how long in-flight submissions may finish before they are handed back to the broker")
+	shardSize := flag.Int("shard-size", 0, "submissions with more unjudged subtests than this are split into shards judged by any worker, 0 disables it (not supported with -broker=redis-stream)")
+	languages := flag.String("languages", strings.Join(logic.AvailableLanguages(), ","), "comma separated languages this worker judges, defaults to those whose compiler is installed")
+	resourceClasses := flag.String("resource-classes", base.DefaultResourceClass, "comma separated resource classes of the problems this worker judges")
+	cgroupRoot := flag.String("cgroup-root", "/sys/fs/cgroup/judgo", "cgroup v2 directory each subtest gets a leaf cgroup in, empty or a host without cgroup v2 runs without cgroups so memory is only judged afterwards")
+	sandboxKind := flag.String("sandbox", "namespaces", "how submissions run: namespaces | none, none is only meant for development")
+	seccomp := flag.Bool("seccomp", true, "filter the syscalls of submissions with the seccomp profile of their language, only supported on linux/amd64 with -sandbox=namespaces")
+	flag.Parse()
+
+	workerLanguages := splitList(*languages)
+	workerClasses := splitList(*resourceClasses)
+	if len(workerLanguages) == 0 || len(workerClasses) == 0 {
+		fmt.Println("a worker needs at least one language and one resource class")
+		os.Exit(1)
+	}
+	routes := base.Routes(workerLanguages, workerClasses)
+
+	// the stream broker keeps one stream per queue, it cannot lease a sharded parent again
+	if *brokerKind == "redis-stream" && *shardSize > 0 {
+		fmt.Println("-broker=redis-stream does not support sharding, -shard-size must be 0")
+		os.Exit(1)
+	}
+
+	var runner sandbox.Runner
+	switch *sandboxKind {
+	case "namespaces":
+		ns := sandbox.NewNamespaces()
+		if *cgroupRoot != "" {
+			// e.g. a host still on cgroup v1
+			parent := filepath.Dir(*cgroupRoot)
+			if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+				fmt.Println("no cgroup v2 hierarchy at", parent+", running without cgroups so memory is only judged afterwards")
+				*cgroupRoot = ""
+			}
+		}
+		if *cgroupRoot != "" {
+			cgroups, err := sandbox.NewCgroups(*cgroupRoot)
+			if err != nil {
+				fmt.Println("failed to set up cgroups, cause by:", err)
+				os.Exit(1)
+			}
+			ns.SetCgroups(cgroups)
+		}
+		if *seccomp && !sandbox.SeccompSupported() {
+			fmt.Println("seccomp is not supported on", runtime.GOOS+"/"+runtime.GOARCH, "to judge without it run with -seccomp=false")
+			os.Exit(1)
+		}
+		runner = ns
+	case "none":
+		if flagSet("seccomp") && *seccomp {
+			fmt.Println("-seccomp needs -sandbox=namespaces")
+			os.Exit(1)
+		}
+		fmt.Println("sandbox disabled, submissions run unconfined and without seccomp")
+		*seccomp = false
+		runner = sandbox.Unconfined{}
+	default:
+		fmt.Println("unknown sandbox:", *sandboxKind)
+		os.Exit(1)
+	}
+
+	var b broker.Broker
+	var artifacts artifact.Store
+	switch *brokerKind {
+	case "memory":
+		mb := broker.NewMemory()
+		mb.SetSchedulePolicy(policy)
+		mb.SetRetention(*retention)
+		mb.SetRoutes(routes)
+		b = mb
+		artifacts = artifact.NewMemory()
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: *redisAddr})
+		rb := broker.NewRDB(client)
+		rb.SetSchedulePolicy(policy)
+		rb.SetRetention(*retention)
+		rb.SetRoutes(routes)
+		b = rb
+		artifacts = artifact.NewRDB(client)
+	case "redis-stream":
+		sb, err := broker.NewStreamRDB(context.Background(), redis.NewClient(&redis.Options{Addr: *redisAddr}))
+		if err != nil {
+			fmt.Println("failed to create stream broker, cause by:", err)
+			os.Exit(1)
+		}
+		sb.SetSchedulePolicy(policy)
+		sb.SetRetention(*retention)
+		sb.SetRoutes(routes)
+		b = sb
+	default:
+		fmt.Println("unknown broker:", *brokerKind)
+		os.Exit(1)
+	}
+
+	store := storage.NewMemoryStore()
+	tm := testcase.NewTestcaseStore(*testcaseDir)
+
+	recoverer := logic.NewRecoverer(b, store, time.Second*5)
+	go recoverer.Start()
+
+	sweeper := logic.NewSweeper(b, store, time.Minute)
+	go sweeper.Start()
+
+	processor := logic.NewProcessor(b, store, tm, *slots)
+	processor.SetSharding(artifacts, *shardSize)
+	processor.SetCapabilities(workerLanguages, workerClasses)
+	processor.SetSandbox(runner)
+	processor.SetSeccomp(*seccomp)
+	go processor.Start()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- http.ListenAndServe(*addr, server.NewServer(b, tm, store))
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		fmt.Println("http server stopped, cause by:", err)
+		os.Exit(1)
+	case sig := <-sigCh:
+		fmt.Println("received", sig, "draining")
+		processor.Drain(*drainGrace)
+	}
 }
-type Student struct {
-	class string
-	Person
+
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
-func main() {
-	var st *Student
-	fmt.Println(reflect.TypeOf(st).Size())
+// flagSet reports whether the flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
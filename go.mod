@@ -3,8 +3,11 @@ module github.com/khoakmp/judgo
 go 1.21
 
 require (
+	github.com/alicebob/miniredis/v2 v2.37.0
 	github.com/gammazero/workerpool v1.1.3
 	github.com/redis/go-redis/v9 v9.6.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	github.com/yuin/gopher-lua v1.1.1
 )
 
 require (
@@ -13,4 +16,5 @@ require (
 	github.com/gammazero/deque v0.2.0 // indirect
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/mux v1.8.1
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 )
@@ -0,0 +1,36 @@
+package artifact
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Store keeps compiled binaries by the sha256 of their content, so the shards of a submission
+// judged on other nodes run the binary compiled once by the node which sharded it.
+// Nodes sharing a store are expected to run the same platform.
+type Store interface {
+	// Put stores data and returns its digest, storing the same content again only refreshes it
+	Put(ctx context.Context, data []byte) (string, error)
+	Get(ctx context.Context, digest string) ([]byte, error)
+}
+
+// how long an artifact is kept after its last Put, longer than any submission takes to judge
+const DefaultTTL = time.Hour
+
+var ErrNotFound = errors.New("artifact not found")
+var ErrDigestMismatch = errors.New("artifact content does not match its digest")
+
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func verify(digest string, data []byte) ([]byte, error) {
+	if Digest(data) != digest {
+		return nil, ErrDigestMismatch
+	}
+	return data, nil
+}
@@ -0,0 +1,58 @@
+package artifact
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is a Store for a single process, artifacts are dropped ttl after their last Put
+type Memory struct {
+	mu        sync.Mutex
+	artifacts map[string][]byte
+	expireAt  map[string]time.Time
+	ttl       time.Duration
+}
+
+var _ Store = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{
+		artifacts: make(map[string][]byte),
+		expireAt:  make(map[string]time.Time),
+		ttl:       DefaultTTL,
+	}
+}
+
+func (m *Memory) Put(ctx context.Context, data []byte) (string, error) {
+	digest := Digest(data)
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purge(now)
+	if _, ok := m.artifacts[digest]; !ok {
+		m.artifacts[digest] = append([]byte(nil), data...)
+	}
+	m.expireAt[digest] = now.Add(m.ttl)
+	return digest, nil
+}
+
+func (m *Memory) Get(ctx context.Context, digest string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.artifacts[digest]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+// purge drops the expired artifacts, the caller must hold m.mu
+func (m *Memory) purge(now time.Time) {
+	for digest, expireAt := range m.expireAt {
+		if expireAt.Before(now) {
+			delete(m.artifacts, digest)
+			delete(m.expireAt, digest)
+		}
+	}
+}
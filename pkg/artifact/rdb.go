@@ -0,0 +1,48 @@
+package artifact
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const artifactKeyPrefix = "judgo:artifact:" // with digest, value is the content
+
+// RDB is a Store on redis, shared by every node using the same redis as broker
+type RDB struct {
+	client *redis.Client
+}
+
+var _ Store = (*RDB)(nil)
+
+func NewRDB(client *redis.Client) *RDB {
+	return &RDB{
+		client: client,
+	}
+}
+
+func (r *RDB) Put(ctx context.Context, data []byte) (string, error) {
+	digest := Digest(data)
+	// the content of a digest never changes, an existing key only gets its ttl refreshed
+	ok, err := r.client.SetNX(ctx, artifactKeyPrefix+digest, data, DefaultTTL).Result()
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		if err := r.client.Expire(ctx, artifactKeyPrefix+digest, DefaultTTL).Err(); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+func (r *RDB) Get(ctx context.Context, digest string) ([]byte, error) {
+	data, err := r.client.Get(ctx, artifactKeyPrefix+digest).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return verify(digest, data)
+}
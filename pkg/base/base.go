@@ -2,6 +2,7 @@ package base
 
 import (
 	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -15,6 +16,12 @@ const (
 	VerdictMemoryLimitExceed = 5
 	VerdictRunTimeError      = 6
 	VerdictPartial           = 7
+	VerdictInternalError     = 8
+	VerdictCancelled         = 9
+	// killed at a syscall its seccomp profile does not allow, see SubtestResult.Syscall
+	VerdictSecurityViolation = 10
+	// printed more than the output limit of the problem to stdout or stderr
+	VerdictOutputLimitExceed = 11
 )
 
 const (
@@ -25,20 +32,27 @@ const (
 const DefaultLeaseDuration = time.Second * 30
 
 type Lease struct {
-	doneCh   chan struct{}
-	expireAt time.Time
-	mu       sync.Mutex
-	once     sync.Once
+	doneCh    chan struct{}
+	expireAt  time.Time
+	token     int64 // fencing token of the grant, the broker rejects writes with an older one
+	cancelled bool
+	mu        sync.Mutex
+	once      sync.Once
 }
 
-func NewLease(expiration time.Time) *Lease {
+func NewLease(expiration time.Time, token int64) *Lease {
 	return &Lease{
 		doneCh:   make(chan struct{}),
 		expireAt: expiration,
+		token:    token,
 		mu:       sync.Mutex{},
 		once:     sync.Once{},
 	}
 }
+
+func (l *Lease) Token() int64 {
+	return l.token
+}
 func (l *Lease) IsValid() bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -68,6 +82,29 @@ func (l *Lease) NotifyExpried() {
 	})
 }
 
+// Release ends the lease before its deadline when the judger hands the task back to the broker,
+// Done is closed and IsValid reports false from then on
+func (l *Lease) Release() {
+	l.mu.Lock()
+	l.expireAt = time.Time{}
+	l.mu.Unlock()
+	l.NotifyExpried()
+}
+
+// Cancel closes Done like NotifyExpried, but the lease stays valid so the cancellation can be recorded
+func (l *Lease) Cancel() {
+	l.mu.Lock()
+	l.cancelled = true
+	l.mu.Unlock()
+	l.NotifyExpried()
+}
+
+func (l *Lease) IsCancelled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cancelled
+}
+
 // should adding here dung/
 type SubmissionDescription struct {
 	Id         string `json:"id"`
@@ -78,15 +115,56 @@ type SubmissionDescription struct {
 	ContestId  string `json:"contest_id"`
 	InContest  bool   `json:"in_contest"`
 	Type       int    `json:"type"`
+	RejudgeId  string `json:"rejudge_id,omitempty"` // set on the copy enqueued by a rejudge
+	ParentId   string `json:"parent_id,omitempty"`  // set on a shard, id of the sharded submission
+	Artifact   string `json:"artifact,omitempty"`   // set on a shard, digest of the compiled binary
+	// resource class of the problem, only workers of that class judge it. Empty is DefaultResourceClass
+	ResourceClass string `json:"resource_class,omitempty"`
 	//CompilerID int    `json:"compiler_id"`
 }
 
-func (s *SubmissionDescription) Encode() []byte {
-	buf, _ := json.Marshal(s)
-	return buf
+// Languages a submission may be written in, a worker only judges those it has a compiler for
+var Languages = []string{"c", "cpp", "py"}
+
+const DefaultResourceClass = "standard"
+
+// DefaultRoute is the route of the pending queues used before routing existed
+const DefaultRoute = "cpp/" + DefaultResourceClass
+
+// Route is what a worker must support to judge s, its language and resource class
+func (s *SubmissionDescription) Route() string {
+	return RouteOf(s.Language, s.ResourceClass)
 }
-func (s *SubmissionDescription) Decode(buf []byte) {
-	json.Unmarshal(buf, s)
+
+func RouteOf(language, resourceClass string) string {
+	if resourceClass == "" {
+		resourceClass = DefaultResourceClass
+	}
+	return language + "/" + resourceClass
+}
+
+// Routes returns the routes of a worker supporting every given language in every given resource class
+func Routes(languages, resourceClasses []string) []string {
+	routes := make([]string, 0, len(languages)*len(resourceClasses))
+	for _, language := range languages {
+		for _, resourceClass := range resourceClasses {
+			routes = append(routes, RouteOf(language, resourceClass))
+		}
+	}
+	return routes
+}
+
+// ShardId is the id of the k-th shard of a submission
+func ShardId(parentId string, k int) string {
+	return fmt.Sprintf("%s:shard:%d", parentId, k)
+}
+
+// EventId is the submission whose subscribers receive the events of s, a shard reports to its parent
+func (s *SubmissionDescription) EventId() string {
+	if s.ParentId != "" {
+		return s.ParentId
+	}
+	return s.Id
 }
 
 type JudgeSubmissionTask struct {
@@ -99,8 +177,12 @@ type JudgeSubmissionTask struct {
 
 func (t *JudgeSubmissionTask) CalculateFinalResult(points []int) {
 	if t.Type == TypeProblemACM {
-		for _, subtestResult := range t.Results {
-			if subtestResult.VerdictCode != VerdictAccepted {
+		// the verdict of the first subtest which is not accepted
+		t.FinalVerdict = VerdictAccepted
+		first := -1
+		for id, subtestResult := range t.Results {
+			if subtestResult.VerdictCode != VerdictAccepted && (first < 0 || id < first) {
+				first = id
 				t.FinalVerdict = subtestResult.VerdictCode
 			}
 		}
@@ -134,6 +216,27 @@ func (t *JudgeSubmissionTask) CalculateFinalResult(points []int) {
 	}
 }
 
+// SubtestError is the error of the first unjudged subtest which failed with one, "" without any
+func (t *JudgeSubmissionTask) SubtestError() string {
+	first, msg := -1, ""
+	for id, result := range t.Results {
+		if result.VerdictCode == VerdictUnjudge && result.ErrMsg != "" && (first < 0 || id < first) {
+			first, msg = id, result.ErrMsg
+		}
+	}
+	return msg
+}
+
+// LeaseExpiredError is the error of a submission dead-lettered after its lease expired
+// retried times, it keeps the last error of its subtests
+func LeaseExpiredError(retried int, subtestError string) string {
+	msg := fmt.Sprintf("lease expired %d times", retried)
+	if subtestError != "" {
+		msg += ": " + subtestError
+	}
+	return msg
+}
+
 type JudgeTaskDescription struct {
 	Retried      int    `json:"retried"`
 	MaxRetry     int    `json:"max_retry"`
@@ -143,17 +246,46 @@ type JudgeTaskDescription struct {
 	Memory       int    `json:"memory"`
 	Verdicted    int    `json:"verdicted"`
 	Error        string `json:"error"`
-	TimeLimit    int    `json:"time_limit"`
-	MemoryLimit  int    `json:"mem_limit"`
+	TimeLimit    int    `json:"time_limit"` // cpu time, ms
+	MemoryLimit  int    `json:"mem_limit"`  // MB, see MemoryLimitBytes
+	// ms, 0 is DefaultWallTimeFactor times TimeLimit
+	WallTimeLimit int `json:"wall_time_limit,omitempty"`
+	// KB of stdout and of stderr each, 0 is DefaultOutputLimit
+	OutputLimit int `json:"output_limit,omitempty"`
+	// added to and removed from the seccomp profile of the language
+	SyscallAllow []string `json:"syscall_allow,omitempty"`
+	SyscallDeny  []string `json:"syscall_deny,omitempty"`
 }
 
-func (t *JudgeTaskDescription) Decode(buf []byte) {
-	json.Unmarshal(buf, t)
+// a program may take this many times its cpu time limit in wall time before it is killed as
+// sleeping or blocked
+const DefaultWallTimeFactor = 3
+
+// WallLimit is the wall time limit in ms
+func (t *JudgeTaskDescription) WallLimit() int {
+	if t.WallTimeLimit > 0 {
+		return t.WallTimeLimit
+	}
+	return t.TimeLimit * DefaultWallTimeFactor
 }
-func (t *JudgeTaskDescription) Encode() []byte {
-	buf, _ := json.Marshal(t)
-	return buf
+
+// MemoryLimitBytes is the memory limit in bytes, the limits of the sandbox and the verdict
+// both come from it
+func (t *JudgeTaskDescription) MemoryLimitBytes() int64 {
+	return int64(t.MemoryLimit) << 20
 }
+
+// output limit in KB of problems which set none
+const DefaultOutputLimit = 64 << 10
+
+// MaxOutput is the output limit in KB
+func (t *JudgeTaskDescription) MaxOutput() int {
+	if t.OutputLimit > 0 {
+		return t.OutputLimit
+	}
+	return DefaultOutputLimit
+}
+
 func (t *JudgeSubmissionTask) Encode() []byte {
 	buf, _ := json.Marshal(t)
 	return buf
@@ -170,12 +302,78 @@ func (t *JudgeSubmissionTask) UpdateSubtestResult(subtestID int, result *Subtest
 
 type SubtestResult struct {
 	VerdictCode int    `json:"verdict_code"`
-	ExecTime    int    `json:"exec_time"`
+	ExecTime    int    `json:"exec_time"` // cpu time, ms
 	MemoryUsage int    `json:"memory"`
 	ErrMsg      string `json:"err_msg"`
+	// how the run ended, one of the sandbox Termination constants
+	Termination string `json:"termination,omitempty"`
+	// set whenever the program was run
+	Usage *ResourceUsage `json:"usage,omitempty"`
+	// number of the syscall a VerdictSecurityViolation was stopped at
+	Syscall *int `json:"syscall,omitempty"`
+}
+
+// ResourceUsage is what the sandbox measured for one run of a subtest
+type ResourceUsage struct {
+	CPUTimeMs  int64 `json:"cpu_time_ms"` // user and system time
+	UserTimeMs int64 `json:"user_time_ms"`
+	SysTimeMs  int64 `json:"sys_time_ms"`
+	WallTimeMs int64 `json:"wall_time_ms"`
+	MaxRSSKb   int64 `json:"max_rss_kb"`
+	// memory.peak of the cgroup of the run, 0 without cgroups
+	MemoryPeakKb int64 `json:"memory_peak_kb,omitempty"`
+	OOMKilled    bool  `json:"oom_killed,omitempty"`
+	ExitCode     int   `json:"exit_code"` // -1 when killed by a signal
+	Signal       int   `json:"signal,omitempty"`
+}
+
+const (
+	EventCompiled = "compiled"
+	EventSubtest  = "subtest"
+	EventFinal    = "final"
+)
+
+// ResultEvent is published by the broker for every progress of a submission
+type ResultEvent struct {
+	Type         string                `json:"type"`
+	SubmissionId string                `json:"submission_id"`
+	SubtestId    int                   `json:"subtest_id,omitempty"`
+	Subtest      *SubtestResult        `json:"subtest,omitempty"` // EventSubtest
+	Task         *JudgeTaskDescription `json:"task,omitempty"`    // EventFinal
+	Error        string                `json:"error,omitempty"`   // EventCompiled with a compile error
 }
 
-func (r *SubtestResult) Encode() []byte {
-	buf, _ := json.Marshal(r)
+func (e *ResultEvent) Encode() []byte {
+	buf, _ := json.Marshal(e)
 	return buf
 }
+func (e *ResultEvent) Decode(buf []byte) {
+	json.Unmarshal(buf, e)
+}
+
+// Version of the judge node, set at build time with -ldflags "-X github.com/khoakmp/judgo/pkg/base.Version=..."
+var Version = "dev"
+
+// a worker missing heartbeats for WorkerTTL is no longer listed
+const WorkerTTL = DefaultLeaseDuration
+
+// WorkerInfo is what a judge node reports to the broker on every heartbeat
+type WorkerInfo struct {
+	Id              string    `json:"id"`
+	Hostname        string    `json:"hostname"`
+	Slots           int       `json:"slots"`
+	Languages       []string  `json:"languages"`
+	ResourceClasses []string  `json:"resource_classes"`
+	Version         string    `json:"version"`
+	StartedAt       time.Time `json:"started_at"`
+	LastHeartbeat   time.Time `json:"last_heartbeat"`
+	Submissions     []string  `json:"submissions"` // ids of the submissions it holds a lease on
+}
+
+func (w *WorkerInfo) Encode() []byte {
+	buf, _ := json.Marshal(w)
+	return buf
+}
+func (w *WorkerInfo) Decode(buf []byte) {
+	json.Unmarshal(buf, w)
+}
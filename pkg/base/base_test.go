@@ -0,0 +1,37 @@
+package base
+
+import "testing"
+
+func TestCalculateFinalResult(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		typ      int
+		verdicts []int
+		verdict  int
+		point    int
+	}{
+		{"acm accepted", TypeProblemACM, []int{VerdictAccepted, VerdictAccepted}, VerdictAccepted, 0},
+		{"acm first failure", TypeProblemACM, []int{VerdictAccepted, VerdictTimeLimitExceed, VerdictWrongAnwser}, VerdictTimeLimitExceed, 0},
+		{"oi accepted", TypeProblemOI, []int{VerdictAccepted, VerdictAccepted}, VerdictAccepted, 30},
+		{"oi partial", TypeProblemOI, []int{VerdictWrongAnwser, VerdictAccepted}, VerdictPartial, 20},
+		{"oi none", TypeProblemOI, []int{VerdictWrongAnwser, VerdictWrongAnwser}, VerdictWrongAnwser, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			task := &JudgeSubmissionTask{
+				SubmissionDescription: &SubmissionDescription{Type: tc.typ},
+				JudgeTaskDescription:  &JudgeTaskDescription{},
+				Results:               make(map[int]*SubtestResult),
+			}
+			for id, verdict := range tc.verdicts {
+				task.Results[id] = &SubtestResult{VerdictCode: verdict, ExecTime: 10 * (id + 1), MemoryUsage: 100}
+			}
+			task.CalculateFinalResult([]int{10, 20, 30})
+			if task.FinalVerdict != tc.verdict || task.TotalPoint != tc.point {
+				t.Fatalf("verdict %d point %d, want %d %d", task.FinalVerdict, task.TotalPoint, tc.verdict, tc.point)
+			}
+			if tc.verdict == VerdictAccepted && tc.typ == TypeProblemACM && (task.ExecTime != 20 || task.Memory != 100) {
+				t.Fatalf("exec time %d memory %d", task.ExecTime, task.Memory)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package base
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Payloads stored in the broker are a schema version byte followed by msgpack with the json
+// field names, so the lua scripts can read them with cmsgpack. Payloads starting with '{' are
+// the JSON written before the codec existed, they are still decoded.
+const CodecVersion byte = 1
+
+var ErrUnknownCodecVersion = errors.New("unknown codec version")
+var ErrEmptyPayload = errors.New("empty payload")
+
+// source codes longer than this are stored deflated
+const compressSourceThreshold = 1024
+
+func encodePayload(v interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(CodecVersion)
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	// only fails on unsupported types, the payloads are plain structs
+	enc.Encode(v)
+	return buf.Bytes()
+}
+
+func decodePayload(buf []byte, v interface{}) error {
+	if len(buf) == 0 {
+		return ErrEmptyPayload
+	}
+	if buf[0] == '{' {
+		return json.Unmarshal(buf, v)
+	}
+	if buf[0] != CodecVersion {
+		return fmt.Errorf("%w: %d", ErrUnknownCodecVersion, buf[0])
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(buf[1:]))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// submissionPayload is the stored form of SubmissionDescription, SourceCode is moved
+// to CompressedSource when it is long
+type submissionPayload struct {
+	SubmissionDescription
+	CompressedSource []byte `json:"src_z,omitempty"`
+}
+
+func (s *SubmissionDescription) Encode() []byte {
+	p := &submissionPayload{SubmissionDescription: *s}
+	if len(s.SourceCode) > compressSourceThreshold {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		io.WriteString(w, s.SourceCode)
+		w.Close()
+		p.SourceCode = ""
+		p.CompressedSource = buf.Bytes()
+	}
+	return encodePayload(p)
+}
+
+func (s *SubmissionDescription) Decode(buf []byte) error {
+	p := new(submissionPayload)
+	if err := decodePayload(buf, p); err != nil {
+		return err
+	}
+	if p.CompressedSource != nil {
+		src, err := io.ReadAll(flate.NewReader(bytes.NewReader(p.CompressedSource)))
+		if err != nil {
+			return fmt.Errorf("decompress source code: %w", err)
+		}
+		p.SourceCode = string(src)
+	}
+	*s = p.SubmissionDescription
+	return nil
+}
+
+func (t *JudgeTaskDescription) Encode() []byte {
+	return encodePayload(t)
+}
+
+func (t *JudgeTaskDescription) Decode(buf []byte) error {
+	return decodePayload(buf, t)
+}
+
+func (r *SubtestResult) Encode() []byte {
+	return encodePayload(r)
+}
+
+func (r *SubtestResult) Decode(buf []byte) error {
+	return decodePayload(buf, r)
+}
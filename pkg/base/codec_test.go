@@ -0,0 +1,147 @@
+package base
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func testSubmission(src string) *SubmissionDescription {
+	return &SubmissionDescription{
+		Id:         "s1",
+		SourceCode: src,
+		Username:   "alice",
+		Language:   "cpp",
+		ProblemId:  "p1",
+		ContestId:  "c1",
+		InContest:  true,
+		Type:       TypeProblemOI,
+		RejudgeId:  "r1",
+	}
+}
+
+// payloadFields decodes the msgpack of an encoded payload into a map keyed by the json names
+func payloadFields(t *testing.T, buf []byte) map[string]interface{} {
+	t.Helper()
+	if buf[0] != CodecVersion {
+		t.Fatalf("payload starts with %d", buf[0])
+	}
+	fields := make(map[string]interface{})
+	if err := msgpack.Unmarshal(buf[1:], &fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestSubmissionRoundTrip(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"int main() {}",
+		strings.Repeat("x", compressSourceThreshold),
+		strings.Repeat("int a;\n", compressSourceThreshold),
+	} {
+		s := testSubmission(src)
+		buf := s.Encode()
+		fields := payloadFields(t, buf)
+		_, compressed := fields["src_z"]
+		if compressed != (len(src) > compressSourceThreshold) {
+			t.Fatalf("source of %d bytes, compressed: %v", len(src), compressed)
+		}
+		if compressed && fields["src"] != "" {
+			t.Fatal("compressed source also stored plain")
+		}
+		if compressed && len(buf) >= len(src) {
+			t.Fatalf("payload of %d bytes for a source of %d", len(buf), len(src))
+		}
+
+		got := new(SubmissionDescription)
+		if err := got.Decode(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, s) {
+			t.Fatalf("got %+v, want %+v", got, s)
+		}
+	}
+}
+
+func TestSubmissionFieldNames(t *testing.T) {
+	fields := payloadFields(t, testSubmission("int main() {}").Encode())
+	// read by the lua scripts
+	for _, name := range []string{"id", "username", "language", "contest_id", "in_contest", "rejudge_id"} {
+		if _, ok := fields[name]; !ok {
+			t.Fatal("no field", name)
+		}
+	}
+}
+
+func TestTaskRoundTrip(t *testing.T) {
+	task := &JudgeTaskDescription{
+		Retried:      1,
+		MaxRetry:     3,
+		FinalVerdict: VerdictAccepted,
+		TotalPoint:   100,
+		ExecTime:     12,
+		Memory:       2048,
+		Verdicted:    2,
+		Error:        "lease expired 1 times",
+		TimeLimit:    1000,
+		MemoryLimit:  256,
+	}
+	got := new(JudgeTaskDescription)
+	if err := got.Decode(task.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, task) {
+		t.Fatalf("got %+v, want %+v", got, task)
+	}
+
+	syscall := 59
+	result := &SubtestResult{
+		VerdictCode: VerdictSecurityViolation,
+		ExecTime:    3,
+		MemoryUsage: 100,
+		ErrMsg:      "execve",
+		Syscall:     &syscall,
+	}
+	gotResult := new(SubtestResult)
+	if err := gotResult.Decode(result.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotResult, result) {
+		t.Fatalf("got %+v, want %+v", gotResult, result)
+	}
+}
+
+func TestDecodeLegacyJSON(t *testing.T) {
+	s := testSubmission("int main() {}")
+	buf, _ := json.Marshal(s)
+	got := new(SubmissionDescription)
+	if err := got.Decode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Fatalf("got %+v, want %+v", got, s)
+	}
+
+	task := new(JudgeTaskDescription)
+	if err := task.Decode([]byte(`{"retried":1,"max_retry":2,"time_limit":1000}`)); err != nil {
+		t.Fatal(err)
+	}
+	if task.Retried != 1 || task.MaxRetry != 2 || task.TimeLimit != 1000 {
+		t.Fatalf("task %+v", task)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	s := new(SubmissionDescription)
+	if err := s.Decode(nil); err != ErrEmptyPayload {
+		t.Fatal("empty payload:", err)
+	}
+	if err := s.Decode([]byte{CodecVersion + 1, 0x80}); !errors.Is(err, ErrUnknownCodecVersion) {
+		t.Fatal("unknown version:", err)
+	}
+}
@@ -2,6 +2,7 @@ package broker
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/khoakmp/judgo/pkg/base"
@@ -9,8 +10,133 @@ import (
 
 type Broker interface {
 	PickOneSubmission() (*base.JudgeSubmissionTask, *time.Time, error)
+	BlockingPickOneSubmission(ctx context.Context, timeout time.Duration) (*base.JudgeSubmissionTask, *time.Time, error)
+	PickSubmissions(ctx context.Context, n int) ([]*base.JudgeSubmissionTask, error)
 	CompleteJudgeSubmissionTask(ctx context.Context, t *base.JudgeSubmissionTask) error
 	UpdatePartialResult(t *base.JudgeSubmissionTask, subtestID int) error
-	ExtendLease(ids []string, deadline time.Time) error
-	Enqueue(t *base.JudgeSubmissionTask) error
+	// ExtendLease extends the leases given as submission id -> fencing token, it returns the ids
+	// whose submission was cancelled and the ids whose lease was granted again to another judger
+	ExtendLease(leases map[string]int64, deadline time.Time) (cancelled []string, lost []string, err error)
+	// Enqueue adds t to its pending queue, it returns ErrAlreadyQueued when the submission is
+	// still pending, leased or dead-lettered so a rejudge never judges it twice at the same time
+	Enqueue(ctx context.Context, t *base.JudgeSubmissionTask) error
+	RecoverExpiredLeases(ctx context.Context, now time.Time) (*RecoverResult, error)
+	// Release gives up the lease of t before its deadline, e.g. when the judger drains. The submission
+	// goes back to the front of its pending queue with its subtest results kept and Retried unchanged.
+	// A cancellation flagged meanwhile is reported to the next judger by ExtendLease.
+	Release(ctx context.Context, t *base.JudgeSubmissionTask) error
+	// Shard replaces the lease of the compiled parent by shards enqueued as submissions of their own,
+	// each one with a part of the unjudged subtests. The parent is neither pending nor leased until
+	// its last shard is merged.
+	Shard(ctx context.Context, parent *base.JudgeSubmissionTask, shards []*base.JudgeSubmissionTask) error
+	// MergeShard drops a finished shard and copies its results into its parent. The caller of the
+	// last merge gets the parent back with every result and a new lease, to compute the final result.
+	// A shard taken from the dead-letter queue has a nil Lease, it is merged without fencing.
+	MergeShard(ctx context.Context, shard *base.JudgeSubmissionTask) (*base.JudgeSubmissionTask, error)
+	ListDeadLetters(ctx context.Context, offset, limit int) ([]string, error)
+	GetDeadLetter(ctx context.Context, id string) (*base.JudgeSubmissionTask, error)
+	RedriveDeadLetter(ctx context.Context, id string) error
+	// Cancel removes a pending or dead-lettered submission, or flags a leased one so its judger aborts it.
+	// A sharded submission is removed with the shards not merged yet, whose judgers see their lease lost.
+	// Shards are not cancelled on their own, ErrTaskNotFound is returned for them.
+	// leased reports which case happened, ErrTaskNotFound is returned when the submission is already complete.
+	Cancel(ctx context.Context, id string) (leased bool, err error)
+	// UpdatePartialResult and CompleteJudgeSubmissionTask publish their own events,
+	// PublishEvent is for the other ones
+	PublishEvent(ctx context.Context, e *base.ResultEvent) error
+	// Subscribe returns the events of one submission until ctx is done
+	Subscribe(ctx context.Context, id string) (<-chan *base.ResultEvent, error)
+	// GetSubmission returns the task and subtest results of a submission from its enqueue until they
+	// expire after being persisted, ErrTaskNotFound otherwise. The submission itself is only
+	// set while it is pending, leased or dead-lettered.
+	GetSubmission(ctx context.Context, id string) (*base.JudgeSubmissionTask, error)
+	// Heartbeat registers the worker or refreshes it, the broker sets LastHeartbeat
+	Heartbeat(ctx context.Context, w *base.WorkerInfo) error
+	DeregisterWorker(ctx context.Context, id string) error
+	// ListWorkers returns the workers whose last heartbeat is within base.WorkerTTL
+	ListWorkers(ctx context.Context) ([]*base.WorkerInfo, error)
+	// ClaimIdempotencyKey binds key to the submission id for window, if key is already bound
+	// it returns the id it was bound to, otherwise id itself
+	ClaimIdempotencyKey(ctx context.Context, key, id string, window time.Duration) (string, error)
+	// ReleaseIdempotencyKey unbinds key if it is still bound to id, for a submission which failed to enqueue
+	ReleaseIdempotencyKey(ctx context.Context, key, id string) error
+	Stats(ctx context.Context) (*Stats, error)
+	// MarkPersisted is called once the final result is saved in storage.Store, the task and result
+	// keys of the submission then expire after the retention of the broker
+	MarkPersisted(ctx context.Context, id string) error
+	// ListUnpersisted returns up to limit finished tasks completed before the given time and never
+	// marked persisted, e.g. because the judger crashed in between
+	ListUnpersisted(ctx context.Context, before time.Time, limit int) ([]*base.JudgeSubmissionTask, error)
 }
+
+// how long the task and results of a submission are kept by the broker once persisted
+const DefaultRetention = time.Hour
+
+type RecoverResult struct {
+	Requeued     []string
+	DeadLettered []string
+	// submissions cancelled while leased whose judger did not record the cancellation before the lease expired
+	Cancelled []string
+}
+
+// Stats is a snapshot of the broker queues for dashboards and autoscaling,
+// Counters are totals since the broker state was created so rates come from two snapshots
+type Stats struct {
+	Queues        map[string]*QueueStats `json:"queues"` // by queue name: contest, practice, rejudge
+	InFlight      int64                  `json:"in_flight"`
+	ExpiredLeases int64                  `json:"expired_leases"` // past their deadline, not recovered yet
+	DeadLetters   int64                  `json:"dead_letters"`
+	Counters      map[string]int64       `json:"counters"`
+}
+
+type QueueStats struct {
+	Depth       int64 `json:"depth"`
+	OldestAgeMs int64 `json:"oldest_age_ms"` // 0 when the queue is empty
+}
+
+const (
+	queueNameContest  = "contest"
+	queueNamePractice = "practice"
+	queueNameRejudge  = "rejudge"
+)
+
+// throughput counters of Stats
+const (
+	counterEnqueued     = "enqueued"
+	counterPicked       = "picked"
+	counterCompleted    = "completed"
+	counterRequeued     = "requeued"
+	counterDeadLettered = "dead_lettered"
+	counterRedriven     = "redriven"
+	counterCancelled    = "cancelled"
+	counterReleased     = "released"
+)
+
+func newStats() *Stats {
+	return &Stats{
+		Queues: map[string]*QueueStats{
+			queueNameContest:  {},
+			queueNamePractice: {},
+			queueNameRejudge:  {},
+		},
+		Counters: map[string]int64{
+			counterEnqueued:     0,
+			counterPicked:       0,
+			counterCompleted:    0,
+			counterRequeued:     0,
+			counterDeadLettered: 0,
+			counterRedriven:     0,
+			counterCancelled:    0,
+			counterReleased:     0,
+		},
+	}
+}
+
+var ErrTaskNotFound = errors.New("task not found")
+
+var ErrAlreadyQueued = errors.New("submission already queued")
+
+var ErrShardingUnsupported = errors.New("sharding is not supported by this broker")
+
+// ErrLeaseLost is returned by writes made with a fencing token which is no longer the current one
+var ErrLeaseLost = errors.New("lease lost")
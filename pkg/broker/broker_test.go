@@ -0,0 +1,715 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/khoakmp/judgo/pkg/base"
+)
+
+// testBroker is a broker under the conformance suite, advance moves the clock the broker
+// measures lease expiry with, a no-op for the brokers taking now from RecoverExpiredLeases
+type testBroker struct {
+	Broker
+	advance func(d time.Duration)
+}
+
+// afterLease is a time at which every lease granted now is expired
+func afterLease() time.Time {
+	return time.Now().Add(base.DefaultLeaseDuration + time.Second)
+}
+
+// expireLeases recovers every lease granted so far as if it had expired
+func (b *testBroker) expireLeases(t *testing.T) *RecoverResult {
+	t.Helper()
+	b.advance(base.DefaultLeaseDuration + time.Second)
+	result, err := b.RecoverExpiredLeases(context.Background(), afterLease())
+	if err != nil {
+		t.Fatal("recover expired leases:", err)
+	}
+	return result
+}
+
+func newTestTask(id, contestId, username string, subtests int) *base.JudgeSubmissionTask {
+	results := make(map[int]*base.SubtestResult, subtests)
+	for i := 0; i < subtests; i++ {
+		results[i] = &base.SubtestResult{}
+	}
+	return &base.JudgeSubmissionTask{
+		SubmissionDescription: &base.SubmissionDescription{
+			Id:         id,
+			SourceCode: "int main() {}",
+			Username:   username,
+			Language:   "cpp",
+			ProblemId:  "p1",
+			ContestId:  contestId,
+			InContest:  contestId != "",
+		},
+		JudgeTaskDescription: &base.JudgeTaskDescription{
+			MaxRetry:    1,
+			TimeLimit:   1000,
+			MemoryLimit: 256,
+		},
+		Results: results,
+	}
+}
+
+func enqueue(t *testing.T, b Broker, tasks ...*base.JudgeSubmissionTask) {
+	t.Helper()
+	for _, task := range tasks {
+		if err := b.Enqueue(context.Background(), task); err != nil {
+			t.Fatal("enqueue", task.Id, ":", err)
+		}
+	}
+}
+
+func pick(t *testing.T, b Broker) *base.JudgeSubmissionTask {
+	t.Helper()
+	task, _, err := b.PickOneSubmission()
+	if err != nil {
+		t.Fatal("pick:", err)
+	}
+	return task
+}
+
+func pickIds(t *testing.T, b Broker, n int) []string {
+	t.Helper()
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ids = append(ids, pick(t, b).Id)
+	}
+	return ids
+}
+
+func assertQueueEmpty(t *testing.T, b Broker) {
+	t.Helper()
+	if task, _, err := b.PickOneSubmission(); err != ErrQueueEmpty {
+		t.Fatalf("pick from an empty queue: got %v, %v", task, err)
+	}
+}
+
+func assertIds(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan *base.ResultEvent) *base.ResultEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second * 2):
+		t.Fatal("no event")
+		return nil
+	}
+}
+
+func judge(t *testing.T, b Broker, task *base.JudgeSubmissionTask, subtestId, verdict int) {
+	t.Helper()
+	task.UpdateSubtestResult(subtestId, &base.SubtestResult{VerdictCode: verdict, ExecTime: 10, MemoryUsage: 100})
+	if err := b.UpdatePartialResult(task, subtestId); err != nil {
+		t.Fatal("update partial result:", err)
+	}
+}
+
+// runBrokerSuite checks the behaviour every Broker implementation shares, newBroker returns an empty one
+func runBrokerSuite(t *testing.T, newBroker func(t *testing.T) *testBroker) {
+	ctx := context.Background()
+
+	t.Run("PickEnqueued", func(t *testing.T) {
+		b := newBroker(t)
+		assertQueueEmpty(t, b)
+		task := newTestTask("s1", "", "alice", 2)
+		task.Results[1].VerdictCode = base.VerdictAccepted
+		enqueue(t, b, task)
+
+		picked := pick(t, b)
+		if picked.Id != "s1" || picked.SourceCode != task.SourceCode || picked.Username != "alice" {
+			t.Fatalf("picked %+v", picked.SubmissionDescription)
+		}
+		if picked.TimeLimit != 1000 || picked.MemoryLimit != 256 || picked.MaxRetry != 1 {
+			t.Fatalf("picked %+v", picked.JudgeTaskDescription)
+		}
+		if len(picked.Results) != 2 || picked.Results[1].VerdictCode != base.VerdictAccepted {
+			t.Fatalf("picked results %v", picked.Results)
+		}
+		if picked.Lease == nil || !picked.Lease.IsValid() || picked.Mutex == nil {
+			t.Fatal("picked without a valid lease")
+		}
+		assertQueueEmpty(t, b)
+	})
+
+	t.Run("FIFOPerUser", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1), newTestTask("s2", "", "alice", 1), newTestTask("s3", "", "alice", 1))
+		assertIds(t, pickIds(t, b, 3), "s1", "s2", "s3")
+	})
+
+	t.Run("SchedulePolicy", func(t *testing.T) {
+		b := newBroker(t)
+		b.Broker.(interface{ SetSchedulePolicy(SchedulePolicy) }).SetSchedulePolicy(SchedulePolicy{
+			ContestWeight:  3,
+			PracticeWeight: 1,
+		})
+		for i := 0; i < 6; i++ {
+			enqueue(t, b, newTestTask(fmt.Sprintf("c%d", i), "c1", "alice", 1), newTestTask(fmt.Sprintf("p%d", i), "", "bob", 1))
+		}
+		var order strings.Builder
+		for _, id := range pickIds(t, b, 8) {
+			order.WriteByte(strings.ToUpper(id)[0])
+		}
+		if order.String() != "CCCPCCCP" {
+			t.Fatalf("picked %s, want CCCPCCCP", order.String())
+		}
+	})
+
+	t.Run("PickSubmissions", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1), newTestTask("s2", "", "alice", 1))
+		tasks, err := b.PickSubmissions(ctx, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tasks) != 2 {
+			t.Fatalf("picked %d submissions, want 2", len(tasks))
+		}
+		for _, task := range tasks {
+			if task.Lease == nil || !task.Lease.IsValid() {
+				t.Fatal("picked without a valid lease")
+			}
+		}
+	})
+
+	t.Run("BlockingPick", func(t *testing.T) {
+		b := newBroker(t)
+		if _, _, err := b.BlockingPickOneSubmission(ctx, time.Millisecond*100); err != ErrQueueEmpty {
+			t.Fatal("blocking pick from an empty queue:", err)
+		}
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			b.Enqueue(ctx, newTestTask("s1", "", "alice", 1))
+		}()
+		task, _, err := b.BlockingPickOneSubmission(ctx, time.Second*5)
+		if err != nil {
+			t.Fatal("blocking pick:", err)
+		}
+		if task.Id != "s1" {
+			t.Fatal("picked", task.Id)
+		}
+	})
+
+	t.Run("CompletePublishesFinal", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1))
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		events, err := b.Subscribe(subCtx, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		task := pick(t, b)
+		judge(t, b, task, 0, base.VerdictAccepted)
+		if e := nextEvent(t, events); e.Type != base.EventSubtest || e.SubtestId != 0 || e.Subtest.VerdictCode != base.VerdictAccepted {
+			t.Fatalf("got event %+v", e)
+		}
+		task.FinalVerdict = base.VerdictAccepted
+		if err := b.CompleteJudgeSubmissionTask(ctx, task); err != nil {
+			t.Fatal("complete:", err)
+		}
+		if e := nextEvent(t, events); e.Type != base.EventFinal || e.Task.FinalVerdict != base.VerdictAccepted {
+			t.Fatalf("got event %+v", e)
+		}
+		if err := b.CompleteJudgeSubmissionTask(ctx, task); err != ErrLeaseLost {
+			t.Fatal("complete twice:", err)
+		}
+		if _, err := b.Cancel(ctx, "s1"); err != ErrTaskNotFound {
+			t.Fatal("cancel a completed submission:", err)
+		}
+	})
+
+	t.Run("GetSubmission", func(t *testing.T) {
+		b := newBroker(t)
+		if _, err := b.GetSubmission(ctx, "s1"); err != ErrTaskNotFound {
+			t.Fatal("get a missing submission:", err)
+		}
+		enqueue(t, b, newTestTask("s1", "", "alice", 2))
+		got, err := b.GetSubmission(ctx, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != "s1" || got.FinalVerdict != base.VerdictUnjudge || len(got.Results) != 2 {
+			t.Fatalf("got %+v", got.JudgeTaskDescription)
+		}
+
+		task := pick(t, b)
+		judge(t, b, task, 1, base.VerdictWrongAnwser)
+		got, _ = b.GetSubmission(ctx, "s1")
+		if got.Results[1].VerdictCode != base.VerdictWrongAnwser {
+			t.Fatal("partial results", got.Results)
+		}
+
+		task.FinalVerdict = base.VerdictWrongAnwser
+		if err := b.CompleteJudgeSubmissionTask(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+		got, err = b.GetSubmission(ctx, "s1")
+		if err != nil {
+			t.Fatal("get a finished submission:", err)
+		}
+		if got.Id != "s1" || got.FinalVerdict != base.VerdictWrongAnwser {
+			t.Fatalf("got %+v", got.JudgeTaskDescription)
+		}
+	})
+
+	t.Run("StaleTokenIsFenced", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1))
+		first := pick(t, b)
+		b.expireLeases(t)
+		second := pick(t, b)
+		if second.Lease.Token() == first.Lease.Token() {
+			t.Fatal("the lease was granted again with the same token")
+		}
+
+		first.UpdateSubtestResult(0, &base.SubtestResult{VerdictCode: base.VerdictAccepted})
+		if err := b.UpdatePartialResult(first, 0); err != ErrLeaseLost {
+			t.Fatal("update with a stale token:", err)
+		}
+		if err := b.CompleteJudgeSubmissionTask(ctx, first); err != ErrLeaseLost {
+			t.Fatal("complete with a stale token:", err)
+		}
+		if err := b.Release(ctx, first); err != ErrLeaseLost {
+			t.Fatal("release with a stale token:", err)
+		}
+		_, lost, err := b.ExtendLease(map[string]int64{"s1": first.Lease.Token()}, afterLease())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, lost, "s1")
+		if err := b.CompleteJudgeSubmissionTask(ctx, second); err != nil {
+			t.Fatal("complete with the current token:", err)
+		}
+	})
+
+	t.Run("ExpiredLeaseIsRequeued", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 2))
+		task := pick(t, b)
+		judge(t, b, task, 0, base.VerdictAccepted)
+
+		result := b.expireLeases(t)
+		assertIds(t, result.DeadLettered)
+		again := pick(t, b)
+		if again.Id != "s1" || again.Retried != 1 {
+			t.Fatalf("picked %s retried %d", again.Id, again.Retried)
+		}
+		if again.Results[0].VerdictCode != base.VerdictAccepted || again.Results[1].VerdictCode != base.VerdictUnjudge {
+			t.Fatal("subtest results not kept:", again.Results)
+		}
+	})
+
+	t.Run("ExtendedLeaseIsKept", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1))
+		task := pick(t, b)
+		b.advance(base.DefaultLeaseDuration / 2)
+		cancelled, lost, err := b.ExtendLease(map[string]int64{"s1": task.Lease.Token()}, time.Now().Add(base.DefaultLeaseDuration*2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, cancelled)
+		assertIds(t, lost)
+		b.advance(base.DefaultLeaseDuration/2 + time.Second)
+		result, err := b.RecoverExpiredLeases(ctx, time.Now().Add(base.DefaultLeaseDuration+time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Requeued)+len(result.DeadLettered)+len(result.Cancelled) != 0 {
+			t.Fatalf("recovered an extended lease: %+v", result)
+		}
+		assertQueueEmpty(t, b)
+	})
+
+	t.Run("DeadLetterAndRedrive", func(t *testing.T) {
+		b := newBroker(t)
+		task := newTestTask("s1", "", "alice", 2)
+		task.MaxRetry = 0
+		enqueue(t, b, task)
+		picked := pick(t, b)
+		picked.UpdateSubtestResult(1, &base.SubtestResult{ErrMsg: "testcase missing"})
+		if err := b.UpdatePartialResult(picked, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		result := b.expireLeases(t)
+		assertIds(t, result.DeadLettered, "s1")
+		assertQueueEmpty(t, b)
+		ids, err := b.ListDeadLetters(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, ids, "s1")
+		for _, window := range [][2]int{{1, 10}, {-1, 10}, {0, 0}} {
+			ids, err := b.ListDeadLetters(ctx, window[0], window[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertIds(t, ids)
+		}
+		dead, err := b.GetDeadLetter(ctx, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dead.Error != "lease expired 1 times: testcase missing" {
+			t.Fatalf("dead-letter error %q", dead.Error)
+		}
+		// the internal error verdict is left to the recoverer or the sweeper to persist
+		unpersisted, err := b.ListUnpersisted(ctx, afterLease().Add(time.Second), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(unpersisted) != 1 || unpersisted[0].Id != "s1" || unpersisted[0].FinalVerdict != base.VerdictInternalError {
+			t.Fatal("dead letter not listed as unpersisted:", unpersisted)
+		}
+		if _, err := b.GetDeadLetter(ctx, "s2"); err != ErrTaskNotFound {
+			t.Fatal("get a missing dead letter:", err)
+		}
+
+		if err := b.RedriveDeadLetter(ctx, "s1"); err != nil {
+			t.Fatal("redrive:", err)
+		}
+		again := pick(t, b)
+		if again.Id != "s1" || again.Retried != 0 || again.Error != "" || again.FinalVerdict != base.VerdictUnjudge {
+			t.Fatalf("redriven %s retried %d error %q verdict %d", again.Id, again.Retried, again.Error, again.FinalVerdict)
+		}
+		if unpersisted, err := b.ListUnpersisted(ctx, afterLease().Add(time.Second), 10); err != nil || len(unpersisted) != 0 {
+			t.Fatal("redriven submission listed as unpersisted:", unpersisted, err)
+		}
+		if err := b.RedriveDeadLetter(ctx, "s1"); err != ErrTaskNotFound {
+			t.Fatal("redrive twice:", err)
+		}
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 2), newTestTask("s2", "", "alice", 1))
+		task := pick(t, b)
+		judge(t, b, task, 1, base.VerdictWrongAnwser)
+		if err := b.Release(ctx, task); err != nil {
+			t.Fatal("release:", err)
+		}
+		again := pick(t, b)
+		if again.Id != "s1" || again.Retried != 0 {
+			t.Fatalf("picked %s retried %d after release", again.Id, again.Retried)
+		}
+		if again.Results[1].VerdictCode != base.VerdictWrongAnwser {
+			t.Fatal("subtest results not kept:", again.Results)
+		}
+	})
+
+	t.Run("CancelPending", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1))
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		events, err := b.Subscribe(subCtx, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		leased, err := b.Cancel(ctx, "s1")
+		if err != nil || leased {
+			t.Fatal("cancel pending:", leased, err)
+		}
+		// encoded like every other event, the task keeps its fields
+		if e := nextEvent(t, events); e.Type != base.EventFinal || e.Task.FinalVerdict != base.VerdictCancelled || e.Task.TimeLimit != 1000 {
+			t.Fatalf("got event %+v", e)
+		}
+		assertQueueEmpty(t, b)
+		if _, err := b.Cancel(ctx, "s1"); err != ErrTaskNotFound {
+			t.Fatal("cancel twice:", err)
+		}
+		if _, err := b.Cancel(ctx, "missing"); err != ErrTaskNotFound {
+			t.Fatal("cancel a missing submission:", err)
+		}
+	})
+
+	t.Run("CancelLeased", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1))
+		task := pick(t, b)
+		leased, err := b.Cancel(ctx, "s1")
+		if err != nil || !leased {
+			t.Fatal("cancel leased:", leased, err)
+		}
+		cancelled, _, err := b.ExtendLease(map[string]int64{"s1": task.Lease.Token()}, afterLease())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, cancelled, "s1")
+
+		// the judger died before recording the cancellation
+		result := b.expireLeases(t)
+		assertIds(t, result.Cancelled, "s1")
+		assertQueueEmpty(t, b)
+	})
+
+	t.Run("CancelDeadLettered", func(t *testing.T) {
+		b := newBroker(t)
+		task := newTestTask("s1", "", "alice", 1)
+		task.MaxRetry = 0
+		enqueue(t, b, task)
+		pick(t, b)
+		b.expireLeases(t)
+		if leased, err := b.Cancel(ctx, "s1"); err != nil || leased {
+			t.Fatal("cancel dead-lettered:", leased, err)
+		}
+		ids, err := b.ListDeadLetters(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, ids)
+	})
+
+	t.Run("Persistence", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1), newTestTask("s2", "", "alice", 1))
+		for _, id := range []string{"s1", "s2"} {
+			task := pick(t, b)
+			if task.Id != id {
+				t.Fatal("picked", task.Id)
+			}
+			task.FinalVerdict = base.VerdictAccepted
+			if err := b.CompleteJudgeSubmissionTask(ctx, task); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.MarkPersisted(ctx, "s1"); err != nil {
+			t.Fatal(err)
+		}
+		tasks, err := b.ListUnpersisted(ctx, time.Now().Add(time.Second), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tasks) != 1 || tasks[0].Id != "s2" || tasks[0].FinalVerdict != base.VerdictAccepted {
+			t.Fatalf("unpersisted %v", tasks)
+		}
+		tasks, err = b.ListUnpersisted(ctx, time.Now().Add(-time.Minute), 10)
+		if err != nil || len(tasks) != 0 {
+			t.Fatal("unpersisted before the completion:", tasks, err)
+		}
+	})
+
+	t.Run("EnqueueQueuedSubmission", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "", "alice", 1))
+		rejudge := newTestTask("s1", "", "alice", 1)
+		rejudge.RejudgeId = "r1"
+		if err := b.Enqueue(ctx, rejudge); err != ErrAlreadyQueued {
+			t.Fatal("enqueue a pending submission:", err)
+		}
+		task := pick(t, b)
+		if task.RejudgeId != "" {
+			t.Fatal("pending submission overwritten by the rejudge")
+		}
+		if err := b.Enqueue(ctx, rejudge); err != ErrAlreadyQueued {
+			t.Fatal("enqueue a leased submission:", err)
+		}
+		assertQueueEmpty(t, b)
+
+		task.FinalVerdict = base.VerdictAccepted
+		if err := b.CompleteJudgeSubmissionTask(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+		enqueue(t, b, rejudge)
+		if task := pick(t, b); task.Id != "s1" || task.RejudgeId != "r1" {
+			t.Fatal("picked", task.Id, task.RejudgeId)
+		}
+	})
+
+	t.Run("IdempotencyKey", func(t *testing.T) {
+		b := newBroker(t)
+		id, err := b.ClaimIdempotencyKey(ctx, "k", "s1", time.Minute)
+		if err != nil || id != "s1" {
+			t.Fatal("claim:", id, err)
+		}
+		if id, _ := b.ClaimIdempotencyKey(ctx, "k", "s2", time.Minute); id != "s1" {
+			t.Fatal("claim a bound key:", id)
+		}
+		b.ReleaseIdempotencyKey(ctx, "k", "s2")
+		if id, _ := b.ClaimIdempotencyKey(ctx, "k", "s2", time.Minute); id != "s1" {
+			t.Fatal("released by another submission:", id)
+		}
+		b.ReleaseIdempotencyKey(ctx, "k", "s1")
+		if id, _ := b.ClaimIdempotencyKey(ctx, "k", "s2", time.Minute); id != "s2" {
+			t.Fatal("claim a released key:", id)
+		}
+	})
+
+	t.Run("Workers", func(t *testing.T) {
+		b := newBroker(t)
+		for _, id := range []string{"w2", "w1"} {
+			err := b.Heartbeat(ctx, &base.WorkerInfo{Id: id, Slots: 2, Languages: []string{"cpp"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		workers, err := b.ListWorkers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(workers) != 2 || workers[0].Slots != 2 || workers[0].LastHeartbeat.IsZero() {
+			t.Fatalf("workers %v", workers)
+		}
+		if err := b.DeregisterWorker(ctx, "w1"); err != nil {
+			t.Fatal(err)
+		}
+		workers, _ = b.ListWorkers(ctx)
+		if len(workers) != 1 || workers[0].Id != "w2" {
+			t.Fatalf("workers %v", workers)
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		b := newBroker(t)
+		enqueue(t, b, newTestTask("s1", "c1", "alice", 1), newTestTask("s2", "", "alice", 1), newTestTask("s3", "", "bob", 1))
+		pick(t, b)
+		stats, err := b.Stats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		depth := stats.Queues[queueNameContest].Depth + stats.Queues[queueNamePractice].Depth
+		if depth != 2 || stats.InFlight != 1 {
+			t.Fatalf("depth %d in flight %d", depth, stats.InFlight)
+		}
+		if stats.Counters[counterEnqueued] != 3 || stats.Counters[counterPicked] != 1 {
+			t.Fatal("counters", stats.Counters)
+		}
+	})
+
+	t.Run("Sharding", func(t *testing.T) {
+		b := newBroker(t)
+		parent := shardTestTask(t, b, 2)
+		if err := b.CompleteJudgeSubmissionTask(ctx, parent); err != ErrLeaseLost {
+			t.Fatal("complete a sharded parent:", err)
+		}
+
+		for k := 0; k < 2; k++ {
+			shard := pick(t, b)
+			if shard.ParentId != "s1" {
+				t.Fatalf("picked %s, want a shard", shard.Id)
+			}
+			for id := range shard.Results {
+				judge(t, b, shard, id, base.VerdictAccepted)
+			}
+			merged, err := b.MergeShard(ctx, shard)
+			if err != nil {
+				t.Fatal("merge:", err)
+			}
+			if k == 0 && merged != nil {
+				t.Fatal("parent returned before its last shard merged")
+			}
+			if k == 1 {
+				if merged == nil || merged.Id != "s1" || merged.Lease == nil {
+					t.Fatal("parent not returned by the last merge")
+				}
+				if len(merged.Results) != 4 {
+					t.Fatal("merged results", merged.Results)
+				}
+				for _, r := range merged.Results {
+					if r.VerdictCode != base.VerdictAccepted {
+						t.Fatal("merged results", merged.Results)
+					}
+				}
+				merged.FinalVerdict = base.VerdictAccepted
+				if err := b.CompleteJudgeSubmissionTask(ctx, merged); err != nil {
+					t.Fatal("complete the merged parent:", err)
+				}
+			}
+		}
+		assertQueueEmpty(t, b)
+	})
+	t.Run("CancelShard", func(t *testing.T) {
+		b := newBroker(t)
+		shardTestTask(t, b, 2)
+		leased := pick(t, b)
+		for _, id := range []string{leased.Id, base.ShardId("s1", 1)} {
+			if _, err := b.Cancel(ctx, id); err != ErrTaskNotFound {
+				t.Fatal("cancel shard", id, ":", err)
+			}
+		}
+		for _, shard := range []*base.JudgeSubmissionTask{leased, pick(t, b)} {
+			if _, err := b.MergeShard(ctx, shard); err != nil {
+				t.Fatal("merge:", err)
+			}
+		}
+		if _, err := b.GetSubmission(ctx, leased.Id); err != ErrTaskNotFound {
+			t.Fatal("shard kept:", err)
+		}
+		if leased, err := b.Cancel(ctx, "s1"); err != nil || !leased {
+			t.Fatal("cancel the merged parent:", leased, err)
+		}
+	})
+
+	t.Run("CancelSharded", func(t *testing.T) {
+		b := newBroker(t)
+		shardTestTask(t, b, 3)
+		events, err := b.Subscribe(ctx, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.MergeShard(ctx, pick(t, b)); err != nil {
+			t.Fatal("merge:", err)
+		}
+		leased := pick(t, b)
+
+		if leased, err := b.Cancel(ctx, "s1"); err != nil || leased {
+			t.Fatal("cancel a sharded submission:", leased, err)
+		}
+		if e := nextEvent(t, events); e.Type != base.EventFinal || e.Task.FinalVerdict != base.VerdictCancelled {
+			t.Fatalf("event %+v", e)
+		}
+		assertQueueEmpty(t, b)
+		_, lost, err := b.ExtendLease(map[string]int64{leased.Id: leased.Lease.Token()}, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertIds(t, lost, leased.Id)
+		if _, err := b.MergeShard(ctx, leased); err != ErrLeaseLost {
+			t.Fatal("merge a dropped shard:", err)
+		}
+		if _, err := b.Cancel(ctx, "s1"); err != ErrTaskNotFound {
+			t.Fatal("cancel twice:", err)
+		}
+		if result := b.expireLeases(t); len(result.Requeued)+len(result.DeadLettered)+len(result.Cancelled) != 0 {
+			t.Fatalf("recovered %+v", result)
+		}
+	})
+}
+
+// shardTestTask picks s1 with two subtests per shard and shards it, the test is skipped
+// when the broker does not support sharding
+func shardTestTask(t *testing.T, b *testBroker, n int) *base.JudgeSubmissionTask {
+	t.Helper()
+	enqueue(t, b, newTestTask("s1", "", "alice", 2*n))
+	parent := pick(t, b)
+	shards := make([]*base.JudgeSubmissionTask, n)
+	for k := range shards {
+		shard := newTestTask(base.ShardId("s1", k), "", "alice", 0)
+		shard.ParentId = "s1"
+		shard.Results = map[int]*base.SubtestResult{2 * k: {}, 2*k + 1: {}}
+		shards[k] = shard
+	}
+	err := b.Shard(context.Background(), parent, shards)
+	if err == ErrShardingUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal("shard:", err)
+	}
+	return parent
+}
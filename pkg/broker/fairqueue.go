@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"slices"
+
+	"github.com/khoakmp/judgo/pkg/base"
+)
+
+// fairQueue dispatches round-robin over the contests having pending submissions,
+// then round-robin over the users of the picked contest, and FIFO for one user.
+// Practice submissions all belong to the contest "".
+// fairQueueCmd keeps the same structure in redis.
+type fairQueue struct {
+	contests []string            // ring of contest ids
+	users    map[string][]string // contest id -> ring of usernames
+	flows    map[flowKey][]string
+	size     int
+}
+
+type flowKey struct {
+	contestId string
+	username  string
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		contests: make([]string, 0),
+		users:    make(map[string][]string),
+		flows:    make(map[flowKey][]string),
+	}
+}
+
+func submissionFlow(s *base.SubmissionDescription) flowKey {
+	if !s.InContest {
+		return flowKey{username: s.Username}
+	}
+	return flowKey{contestId: s.ContestId, username: s.Username}
+}
+
+func (q *fairQueue) len() int {
+	return q.size
+}
+
+// push appends the submission to the flow of its user, or puts it at the front of that flow
+func (q *fairQueue) push(s *base.SubmissionDescription, front bool) {
+	key := submissionFlow(s)
+	flow := q.flows[key]
+	if len(flow) == 0 {
+		if len(q.users[key.contestId]) == 0 {
+			q.contests = append(q.contests, key.contestId)
+		}
+		q.users[key.contestId] = append(q.users[key.contestId], key.username)
+	}
+	if front {
+		flow = append([]string{s.Id}, flow...)
+	} else {
+		flow = append(flow, s.Id)
+	}
+	q.flows[key] = flow
+	q.size++
+}
+
+func (q *fairQueue) head() (flowKey, bool) {
+	if len(q.contests) == 0 {
+		return flowKey{}, false
+	}
+	contestId := q.contests[0]
+	return flowKey{contestId: contestId, username: q.users[contestId][0]}, true
+}
+
+// peek returns the submission pop would return
+func (q *fairQueue) peek() (string, bool) {
+	key, ok := q.head()
+	if !ok {
+		return "", false
+	}
+	return q.flows[key][0], true
+}
+
+func (q *fairQueue) pop() (string, bool) {
+	key, ok := q.head()
+	if !ok {
+		return "", false
+	}
+	flow := q.flows[key]
+	id := flow[0]
+	q.size--
+
+	users := q.users[key.contestId][1:]
+	if len(flow) == 1 {
+		delete(q.flows, key)
+	} else {
+		q.flows[key] = flow[1:]
+		users = append(users, key.username)
+	}
+	q.contests = q.contests[1:]
+	if len(users) == 0 {
+		delete(q.users, key.contestId)
+	} else {
+		q.users[key.contestId] = users
+		q.contests = append(q.contests, key.contestId)
+	}
+	return id, true
+}
+
+// remove deletes the submission from the flow of its user, the rings are left as if
+// the flow had been drained by pop
+func (q *fairQueue) remove(s *base.SubmissionDescription) bool {
+	key := submissionFlow(s)
+	flow := q.flows[key]
+	idx := slices.Index(flow, s.Id)
+	if idx < 0 {
+		return false
+	}
+	q.size--
+	if len(flow) > 1 {
+		q.flows[key] = append(flow[:idx:idx], flow[idx+1:]...)
+		return true
+	}
+	delete(q.flows, key)
+	users := q.users[key.contestId]
+	idx = slices.Index(users, key.username)
+	users = append(users[:idx:idx], users[idx+1:]...)
+	if len(users) > 0 {
+		q.users[key.contestId] = users
+		return true
+	}
+	delete(q.users, key.contestId)
+	idx = slices.Index(q.contests, key.contestId)
+	q.contests = append(q.contests[:idx:idx], q.contests[idx+1:]...)
+	return true
+}
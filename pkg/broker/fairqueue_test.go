@@ -0,0 +1,196 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/khoakmp/judgo/pkg/base"
+)
+
+func fairSubmission(id, contestId, username string) *base.SubmissionDescription {
+	return &base.SubmissionDescription{Id: id, ContestId: contestId, InContest: contestId != "", Username: username}
+}
+
+func popAll(q *fairQueue) []string {
+	ids := make([]string, 0)
+	for {
+		id, ok := q.pop()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, id)
+	}
+}
+
+func TestFairQueueRotation(t *testing.T) {
+	q := newFairQueue()
+	for _, s := range []*base.SubmissionDescription{
+		fairSubmission("a1", "c1", "alice"),
+		fairSubmission("a2", "c1", "alice"),
+		fairSubmission("a3", "c1", "alice"),
+		fairSubmission("b1", "c1", "bob"),
+		fairSubmission("x1", "c2", "carol"),
+		fairSubmission("x2", "c2", "carol"),
+	} {
+		q.push(s, false)
+	}
+	if q.len() != 6 {
+		t.Fatal("len", q.len())
+	}
+	if id, _ := q.peek(); id != "a1" {
+		t.Fatal("peek", id)
+	}
+	// contests take turns, then the users of a contest, then the submissions of a user
+	assertIds(t, popAll(q), "a1", "x1", "b1", "x2", "a2", "a3")
+	if q.len() != 0 {
+		t.Fatal("len", q.len())
+	}
+}
+
+func TestFairQueuePracticeUsers(t *testing.T) {
+	q := newFairQueue()
+	// practice submissions of a user share one flow whatever their contest id
+	q.push(fairSubmission("a1", "", "alice"), false)
+	q.push(&base.SubmissionDescription{Id: "a2", ContestId: "c1", Username: "alice"}, false)
+	q.push(fairSubmission("b1", "", "bob"), false)
+	assertIds(t, popAll(q), "a1", "b1", "a2")
+}
+
+func TestFairQueuePushFront(t *testing.T) {
+	q := newFairQueue()
+	q.push(fairSubmission("a1", "", "alice"), false)
+	q.push(fairSubmission("b1", "", "bob"), false)
+	q.push(fairSubmission("a0", "", "alice"), true)
+	assertIds(t, popAll(q), "a0", "b1", "a1")
+}
+
+func TestFairQueueRemove(t *testing.T) {
+	q := newFairQueue()
+	for _, s := range []*base.SubmissionDescription{
+		fairSubmission("a1", "c1", "alice"),
+		fairSubmission("a2", "c1", "alice"),
+		fairSubmission("b1", "c1", "bob"),
+		fairSubmission("x1", "c2", "carol"),
+	} {
+		q.push(s, false)
+	}
+	if q.remove(fairSubmission("missing", "c1", "alice")) {
+		t.Fatal("removed a missing submission")
+	}
+	if !q.remove(fairSubmission("x1", "c2", "carol")) || !q.remove(fairSubmission("a1", "c1", "alice")) {
+		t.Fatal("not removed")
+	}
+	assertIds(t, popAll(q), "a2", "b1")
+}
+
+const fairQueueTestCmd = fairQueueCmd + `
+	if ARGV[1] == "push" then
+		fq_push(KEYS[1], ARGV[2], ARGV[3], ARGV[4] == "1")
+		return ""
+	elseif ARGV[1] == "remove" then
+		if fq_remove(KEYS[1], ARGV[2], ARGV[3]) then
+			return "1"
+		end
+		return "0"
+	elseif ARGV[1] == "peek" then
+		return fq_peek(KEYS[1]) or ""
+	end
+	return fq_pop(KEYS[1]) or ""
+`
+
+// TestFairQueueLuaParity runs the same random operations on fairQueue and on the fq_ functions
+// of the lua scripts, they must pop in the same order
+func TestFairQueueLuaParity(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(1))
+	q := newFairQueue()
+	pending := make([]*base.SubmissionDescription, 0)
+	contests := []string{"", "c1", "c2"}
+	users := []string{"alice", "bob", "carol"}
+
+	lua := func(args ...interface{}) string {
+		t.Helper()
+		v, err := client.Eval(ctx, fairQueueTestCmd, []string{"test:q"}, args...).Text()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for i := 0; i < 500; i++ {
+		switch op := rnd.Intn(10); {
+		case op < 5:
+			s := fairSubmission(fmt.Sprintf("s%d", i), contests[rnd.Intn(len(contests))], users[rnd.Intn(len(users))])
+			front := rnd.Intn(4) == 0
+			q.push(s, front)
+			frontArg := "0"
+			if front {
+				frontArg = "1"
+			}
+			lua("push", s.Encode(), s.Id, frontArg)
+			pending = append(pending, s)
+		case op < 6 && len(pending) > 0:
+			s := pending[rnd.Intn(len(pending))]
+			removed := q.remove(s)
+			if got := lua("remove", s.Encode(), s.Id); got != map[bool]string{true: "1", false: "0"}[removed] {
+				t.Fatalf("op %d: remove %s: lua %s, go %v", i, s.Id, got, removed)
+			}
+		default:
+			want, _ := q.peek()
+			if got := lua("peek"); got != want {
+				t.Fatalf("op %d: peek: lua %q, go %q", i, got, want)
+			}
+			want, _ = q.pop()
+			if got := lua("pop"); got != want {
+				t.Fatalf("op %d: pop: lua %q, go %q", i, got, want)
+			}
+		}
+	}
+	for {
+		want, _ := q.pop()
+		if got := lua("pop"); got != want {
+			t.Fatalf("drain: lua %q, go %q", got, want)
+		}
+		if want == "" {
+			break
+		}
+	}
+}
+
+func TestRDBMigratesLegacyQueues(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	// the versions before fair queuing pushed plain ids with json payloads
+	legacy := []*base.JudgeSubmissionTask{
+		newTestTask("l1", "c1", "alice", 1),
+		newTestTask("l2", "c1", "alice", 1),
+		newTestTask("l3", "", "bob", 1),
+	}
+	for _, task := range legacy {
+		queue := legacyPracticePendingQueueKey
+		if task.InContest {
+			queue = legacyContestPendingQueueKey
+		}
+		submission, _ := json.Marshal(task.SubmissionDescription)
+		description, _ := json.Marshal(task.JudgeTaskDescription)
+		client.Set(ctx, submissionKeyPrefix+task.Id, submission, 0)
+		client.Set(ctx, judgeTaskKeyPrefix+task.Id, description, 0)
+		client.HSet(ctx, submissionResultPrefix+task.Id, 0, `{"verdict_code":0}`)
+		client.RPush(ctx, queue, task.Id)
+	}
+	client.RPush(ctx, legacyContestPendingQueueKey, "gone")
+
+	b := NewRDB(client)
+	b.SetSchedulePolicy(SchedulePolicy{ContestWeight: 1})
+	enqueue(t, b, newTestTask("s1", "c1", "alice", 1))
+	assertIds(t, pickIds(t, b, 4), "l1", "l2", "s1", "l3")
+	assertQueueEmpty(t, b)
+	for _, key := range []string{legacyContestPendingQueueKey, legacyPracticePendingQueueKey} {
+		if n := client.Exists(ctx, key).Val(); n != 0 {
+			t.Fatal("legacy queue left:", key)
+		}
+	}
+}
@@ -0,0 +1,801 @@
+package broker
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/khoakmp/judgo/pkg/base"
+)
+
+// Memory is an in-process Broker for single-node deployments and tests,
+// it keeps the same semantics as the lua scripts of RDB.
+type Memory struct {
+	mu           sync.Mutex
+	submissions  map[string]*base.SubmissionDescription
+	tasks        map[string]*base.JudgeTaskDescription
+	results      map[string]map[int]*base.SubtestResult
+	queues       map[string]*routeQueues // pending queues by route
+	routes       []string                // routes picked from
+	nextRoute    int
+	leases       map[string]time.Time
+	tokens       map[string]int64 // fencing token of the current lease
+	lastToken    int64
+	deadLetters  []string
+	pendingCh    chan struct{} // closed and replaced whenever a submission becomes pending
+	pendingSince map[string]time.Time
+	cancelled    map[string]bool // leased submissions whose judger must abort
+	subscribers  map[string]map[chan *base.ResultEvent]struct{}
+	workers      map[string]*base.WorkerInfo
+	idempotency  map[string]idempotencyKey
+	counters     map[string]int64
+	completed    map[string]time.Time // finished submissions until persisted
+	expireAt     map[string]time.Time // persisted submissions whose task and results are dropped then
+	shards       map[string]int       // sharded submission id -> shards not merged yet
+	shardTotal   map[string]int       // sharded submission id -> number of shards
+	retention    time.Duration
+	scheduler    *scheduler
+}
+
+var _ Broker = (*Memory)(nil)
+
+type routeQueues struct {
+	contest  *fairQueue
+	practice *fairQueue
+	rejudge  *fairQueue // only picked from when both other queues are empty
+}
+
+type idempotencyKey struct {
+	id       string
+	expireAt time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		submissions:  make(map[string]*base.SubmissionDescription),
+		tasks:        make(map[string]*base.JudgeTaskDescription),
+		results:      make(map[string]map[int]*base.SubtestResult),
+		queues:       make(map[string]*routeQueues),
+		routes:       DefaultRoutes,
+		leases:       make(map[string]time.Time),
+		tokens:       make(map[string]int64),
+		deadLetters:  make([]string, 0),
+		pendingCh:    make(chan struct{}),
+		pendingSince: make(map[string]time.Time),
+		cancelled:    make(map[string]bool),
+		subscribers:  make(map[string]map[chan *base.ResultEvent]struct{}),
+		workers:      make(map[string]*base.WorkerInfo),
+		idempotency:  make(map[string]idempotencyKey),
+		counters:     newStats().Counters,
+		completed:    make(map[string]time.Time),
+		expireAt:     make(map[string]time.Time),
+		shards:       make(map[string]int),
+		shardTotal:   make(map[string]int),
+		retention:    DefaultRetention,
+		scheduler:    newScheduler(DefaultSchedulePolicy),
+	}
+}
+
+func (m *Memory) SetSchedulePolicy(policy SchedulePolicy) {
+	m.scheduler.setPolicy(policy)
+}
+
+// SetRoutes sets the routes submissions are picked from, see base.Routes
+func (m *Memory) SetRoutes(routes []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes = routes
+}
+
+func (m *Memory) SetRetention(retention time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retention = retention
+}
+
+func (m *Memory) Enqueue(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.submissions[t.Id]; ok {
+		return ErrAlreadyQueued
+	}
+	submission := *t.SubmissionDescription
+	task := *t.JudgeTaskDescription
+	m.submissions[t.Id] = &submission
+	m.tasks[t.Id] = &task
+	m.results[t.Id] = copyResults(t.Results)
+	delete(m.completed, t.Id)
+	delete(m.expireAt, t.Id)
+	m.pendingQueue(&submission).push(&submission, false)
+	m.pendingSince[t.Id] = time.Now()
+	m.counters[counterEnqueued]++
+	m.notifyPending()
+	return nil
+}
+
+// routeQueues returns the queues of route, created on first use. The caller must hold m.mu
+func (m *Memory) routeQueues(route string) *routeQueues {
+	queues, ok := m.queues[route]
+	if !ok {
+		queues = &routeQueues{
+			contest:  newFairQueue(),
+			practice: newFairQueue(),
+			rejudge:  newFairQueue(),
+		}
+		m.queues[route] = queues
+	}
+	return queues
+}
+
+func (m *Memory) pendingQueue(s *base.SubmissionDescription) *fairQueue {
+	queues := m.routeQueues(s.Route())
+	if s.RejudgeId != "" {
+		return queues.rejudge
+	}
+	if s.InContest {
+		return queues.contest
+	}
+	return queues.practice
+}
+
+// notifyPending wakes up every blocked picker, the caller must hold m.mu
+func (m *Memory) notifyPending() {
+	close(m.pendingCh)
+	m.pendingCh = make(chan struct{})
+}
+
+func (m *Memory) PickOneSubmission() (*base.JudgeSubmissionTask, *time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pick()
+}
+
+func (m *Memory) BlockingPickOneSubmission(ctx context.Context, timeout time.Duration) (*base.JudgeSubmissionTask, *time.Time, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		m.mu.Lock()
+		t, leaseDeadline, err := m.pick()
+		pendingCh := m.pendingCh
+		m.mu.Unlock()
+		if err != ErrQueueEmpty {
+			return t, leaseDeadline, err
+		}
+		select {
+		case <-pendingCh:
+		case <-timer.C:
+			return nil, nil, ErrQueueEmpty
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (m *Memory) PickSubmissions(ctx context.Context, n int) ([]*base.JudgeSubmissionTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tasks := make([]*base.JudgeSubmissionTask, 0, n)
+	for len(tasks) < n {
+		t, _, err := m.pick()
+		if err != nil {
+			break
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
+
+// pick leases the first pending submission of the routes, starting from the next route in turn.
+// The caller must hold m.mu
+func (m *Memory) pick() (*base.JudgeSubmissionTask, *time.Time, error) {
+	id, ok := "", false
+	m.nextRoute++
+	for i := range m.routes {
+		if id, ok = m.popRoute(m.routes[(m.nextRoute+i)%len(m.routes)]); ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, nil, ErrQueueEmpty
+	}
+	delete(m.pendingSince, id)
+	m.counters[counterPicked]++
+
+	leaseDeadline := time.Now().Add(base.DefaultLeaseDuration)
+	m.leases[id] = leaseDeadline
+	m.lastToken++
+	m.tokens[id] = m.lastToken
+
+	t := m.load(id)
+	t.Lease = base.NewLease(leaseDeadline, m.lastToken)
+	t.Mutex = &sync.Mutex{}
+	return t, &leaseDeadline, nil
+}
+
+// popRoute pops the next submission of a route, rejudges only when no contest nor practice
+// submission is pending. The caller must hold m.mu
+func (m *Memory) popRoute(route string) (string, bool) {
+	rq := m.routeQueues(route)
+	queues := [2]*fairQueue{rq.contest, rq.practice}
+	var practiceWait time.Duration
+	if id, ok := rq.practice.peek(); ok {
+		practiceWait = time.Since(m.pendingSince[id])
+	}
+	order := m.scheduler.order(rq.contest.len() > 0, rq.practice.len() > 0, practiceWait)
+	for _, q := range order {
+		if id, ok := queues[q].pop(); ok {
+			m.scheduler.served(q, queues[1-q].len() > 0)
+			return id, true
+		}
+	}
+	return rq.rejudge.pop()
+}
+
+// load returns a copy of the stored task, the caller must hold m.mu
+func (m *Memory) load(id string) *base.JudgeSubmissionTask {
+	t := new(base.JudgeSubmissionTask)
+	t.SubmissionDescription = new(base.SubmissionDescription)
+	if s, ok := m.submissions[id]; ok {
+		*t.SubmissionDescription = *s
+	}
+	t.JudgeTaskDescription = new(base.JudgeTaskDescription)
+	if task, ok := m.tasks[id]; ok {
+		*t.JudgeTaskDescription = *task
+	}
+	t.Results = copyResults(m.results[id])
+	return t
+}
+
+func copyResults(results map[int]*base.SubtestResult) map[int]*base.SubtestResult {
+	copied := make(map[int]*base.SubtestResult, len(results))
+	for id, r := range results {
+		result := *r
+		copied[id] = &result
+	}
+	return copied
+}
+
+func (m *Memory) UpdatePartialResult(t *base.JudgeSubmissionTask, subtestID int) error {
+	t.Mutex.Lock()
+	result := *t.Results[subtestID]
+	t.Mutex.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens[t.Id] != t.Lease.Token() {
+		return ErrLeaseLost
+	}
+	results, ok := m.results[t.Id]
+	if !ok {
+		results = make(map[int]*base.SubtestResult)
+		m.results[t.Id] = results
+	}
+	results[subtestID] = &result
+	m.publish(&base.ResultEvent{
+		Type:         base.EventSubtest,
+		SubmissionId: t.EventId(),
+		SubtestId:    subtestID,
+		Subtest:      &result,
+	})
+	return nil
+}
+
+func (m *Memory) CompleteJudgeSubmissionTask(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens[t.Id] != t.Lease.Token() {
+		return ErrLeaseLost
+	}
+	task := *t.JudgeTaskDescription
+	m.tasks[t.Id] = &task
+	delete(m.submissions, t.Id)
+	delete(m.leases, t.Id)
+	delete(m.tokens, t.Id)
+	delete(m.cancelled, t.Id)
+	m.completed[t.Id] = time.Now()
+	m.counters[counterCompleted]++
+	final := task
+	m.publish(&base.ResultEvent{
+		Type:         base.EventFinal,
+		SubmissionId: t.Id,
+		Task:         &final,
+	})
+	return nil
+}
+
+func (m *Memory) ExtendLease(leases map[string]int64, deadline time.Time) ([]string, []string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cancelled := make([]string, 0)
+	lost := make([]string, 0)
+	for id, token := range leases {
+		if m.tokens[id] != token {
+			lost = append(lost, id)
+			continue
+		}
+		m.leases[id] = deadline
+		if m.cancelled[id] {
+			cancelled = append(cancelled, id)
+		}
+	}
+	return cancelled, lost, nil
+}
+
+func (m *Memory) RecoverExpiredLeases(ctx context.Context, now time.Time) (*RecoverResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expired := make([]string, 0)
+	for id, deadline := range m.leases {
+		if !deadline.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return m.leases[expired[i]].Before(m.leases[expired[j]])
+	})
+
+	result := &RecoverResult{
+		Requeued:     make([]string, 0),
+		DeadLettered: make([]string, 0),
+		Cancelled:    make([]string, 0),
+	}
+	for _, id := range expired {
+		delete(m.leases, id)
+		delete(m.tokens, id)
+		submission, ok := m.submissions[id]
+		task, ok2 := m.tasks[id]
+		if !ok || !ok2 {
+			continue
+		}
+		if m.cancelled[id] {
+			delete(m.cancelled, id)
+			m.markCancelled(id)
+			result.Cancelled = append(result.Cancelled, id)
+			continue
+		}
+		task.Retried++
+		if task.Retried > task.MaxRetry {
+			if task.Error == "" {
+				task.Error = base.LeaseExpiredError(task.Retried, (&base.JudgeSubmissionTask{Results: m.results[id]}).SubtestError())
+			}
+			if submission.ParentId == "" {
+				// persisted by the recoverer, or by the sweeper if that fails
+				task.FinalVerdict = base.VerdictInternalError
+				m.completed[id] = time.Now()
+			}
+			m.deadLetters = append(m.deadLetters, id)
+			result.DeadLettered = append(result.DeadLettered, id)
+			continue
+		}
+		m.pendingQueue(submission).push(submission, true)
+		m.pendingSince[id] = now
+		result.Requeued = append(result.Requeued, id)
+	}
+	if len(result.Requeued) > 0 {
+		m.notifyPending()
+	}
+	m.counters[counterRequeued] += int64(len(result.Requeued))
+	m.counters[counterDeadLettered] += int64(len(result.DeadLettered))
+	m.counters[counterCancelled] += int64(len(result.Cancelled))
+	return result, nil
+}
+
+func (m *Memory) Release(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens[t.Id] != t.Lease.Token() {
+		return ErrLeaseLost
+	}
+	delete(m.leases, t.Id)
+	delete(m.tokens, t.Id)
+	submission, ok := m.submissions[t.Id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	m.pendingQueue(submission).push(submission, true)
+	m.pendingSince[t.Id] = time.Now()
+	m.counters[counterReleased]++
+	m.notifyPending()
+	return nil
+}
+
+func (m *Memory) Shard(ctx context.Context, parent *base.JudgeSubmissionTask, shards []*base.JudgeSubmissionTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens[parent.Id] != parent.Lease.Token() {
+		return ErrLeaseLost
+	}
+	delete(m.leases, parent.Id)
+	delete(m.tokens, parent.Id)
+	m.shards[parent.Id] = len(shards)
+	m.shardTotal[parent.Id] = len(shards)
+	now := time.Now()
+	for _, t := range shards {
+		submission := *t.SubmissionDescription
+		task := *t.JudgeTaskDescription
+		m.submissions[t.Id] = &submission
+		m.tasks[t.Id] = &task
+		m.results[t.Id] = copyResults(t.Results)
+		m.pendingQueue(&submission).push(&submission, false)
+		m.pendingSince[t.Id] = now
+	}
+	m.counters[counterEnqueued] += int64(len(shards))
+	m.notifyPending()
+	return nil
+}
+
+func (m *Memory) MergeShard(ctx context.Context, shard *base.JudgeSubmissionTask) (*base.JudgeSubmissionTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if shard.Lease != nil {
+		if m.tokens[shard.Id] != shard.Lease.Token() {
+			return nil, ErrLeaseLost
+		}
+	} else if idx := slices.Index(m.deadLetters, shard.Id); idx >= 0 {
+		m.deadLetters = append(m.deadLetters[:idx], m.deadLetters[idx+1:]...)
+	} else {
+		return nil, ErrTaskNotFound
+	}
+
+	results, ok := m.results[shard.ParentId]
+	if !ok {
+		results = make(map[int]*base.SubtestResult)
+		m.results[shard.ParentId] = results
+	}
+	for id, result := range m.results[shard.Id] {
+		r := *result
+		results[id] = &r
+	}
+	delete(m.submissions, shard.Id)
+	delete(m.tasks, shard.Id)
+	delete(m.results, shard.Id)
+	delete(m.leases, shard.Id)
+	delete(m.tokens, shard.Id)
+	delete(m.cancelled, shard.Id)
+
+	m.shards[shard.ParentId]--
+	if m.shards[shard.ParentId] > 0 {
+		return nil, nil
+	}
+	delete(m.shards, shard.ParentId)
+	delete(m.shardTotal, shard.ParentId)
+	if _, ok := m.submissions[shard.ParentId]; !ok {
+		return nil, nil
+	}
+	leaseDeadline := time.Now().Add(base.DefaultLeaseDuration)
+	m.leases[shard.ParentId] = leaseDeadline
+	m.lastToken++
+	m.tokens[shard.ParentId] = m.lastToken
+	t := m.load(shard.ParentId)
+	t.Lease = base.NewLease(leaseDeadline, m.lastToken)
+	t.Mutex = &sync.Mutex{}
+	return t, nil
+}
+
+func (m *Memory) ListDeadLetters(ctx context.Context, offset, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if offset < 0 || limit <= 0 || offset >= len(m.deadLetters) {
+		return []string{}, nil
+	}
+	end := offset + limit
+	if end > len(m.deadLetters) {
+		end = len(m.deadLetters)
+	}
+	ids := make([]string, end-offset)
+	copy(ids, m.deadLetters[offset:end])
+	return ids, nil
+}
+
+func (m *Memory) GetDeadLetter(ctx context.Context, id string) (*base.JudgeSubmissionTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !slices.Contains(m.deadLetters, id) {
+		return nil, ErrTaskNotFound
+	}
+	if _, ok := m.submissions[id]; !ok {
+		return nil, ErrTaskNotFound
+	}
+	return m.load(id), nil
+}
+
+func (m *Memory) RedriveDeadLetter(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idx := slices.Index(m.deadLetters, id)
+	if idx < 0 {
+		return ErrTaskNotFound
+	}
+	m.deadLetters = append(m.deadLetters[:idx], m.deadLetters[idx+1:]...)
+	submission, ok := m.submissions[id]
+	task, ok2 := m.tasks[id]
+	if !ok || !ok2 {
+		return ErrTaskNotFound
+	}
+	task.Retried = 0
+	task.Error = ""
+	task.FinalVerdict = base.VerdictUnjudge
+	delete(m.completed, id)
+	m.pendingQueue(submission).push(submission, false)
+	m.pendingSince[id] = time.Now()
+	m.counters[counterRedriven]++
+	m.notifyPending()
+	return nil
+}
+
+func (m *Memory) Cancel(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	submission, ok := m.submissions[id]
+	// a shard is only cancelled with its parent
+	if !ok || submission.ParentId != "" {
+		return false, ErrTaskNotFound
+	}
+	if total, ok := m.shardTotal[id]; ok {
+		// the judgers of leased shards see their lease lost
+		for k := 0; k < total; k++ {
+			m.dropShard(base.ShardId(id, k))
+		}
+		delete(m.shards, id)
+		delete(m.shardTotal, id)
+		m.markCancelled(id)
+		m.counters[counterCancelled]++
+		return false, nil
+	}
+	if _, ok := m.leases[id]; ok {
+		m.cancelled[id] = true
+		return true, nil
+	}
+	if !m.pendingQueue(submission).remove(submission) {
+		idx := slices.Index(m.deadLetters, id)
+		if idx < 0 {
+			return false, ErrTaskNotFound
+		}
+		m.deadLetters = append(m.deadLetters[:idx], m.deadLetters[idx+1:]...)
+	}
+	delete(m.pendingSince, id)
+	m.markCancelled(id)
+	m.counters[counterCancelled]++
+	return false, nil
+}
+
+// dropShard removes a shard not merged yet wherever it is, the caller must hold m.mu
+func (m *Memory) dropShard(id string) {
+	submission, ok := m.submissions[id]
+	if !ok {
+		return
+	}
+	if !m.pendingQueue(submission).remove(submission) {
+		if idx := slices.Index(m.deadLetters, id); idx >= 0 {
+			m.deadLetters = append(m.deadLetters[:idx], m.deadLetters[idx+1:]...)
+		}
+	}
+	delete(m.submissions, id)
+	delete(m.tasks, id)
+	delete(m.results, id)
+	delete(m.leases, id)
+	delete(m.tokens, id)
+	delete(m.cancelled, id)
+	delete(m.pendingSince, id)
+}
+
+// markCancelled gives the task its final cancelled verdict, the caller must hold m.mu
+func (m *Memory) markCancelled(id string) {
+	if task, ok := m.tasks[id]; ok {
+		task.FinalVerdict = base.VerdictCancelled
+		final := *task
+		m.publish(&base.ResultEvent{
+			Type:         base.EventFinal,
+			SubmissionId: id,
+			Task:         &final,
+		})
+	}
+	delete(m.submissions, id)
+	m.completed[id] = time.Now()
+}
+
+func (m *Memory) PublishEvent(ctx context.Context, e *base.ResultEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.publish(e)
+	return nil
+}
+
+// publish sends e to the subscribers of its submission, like redis pub/sub an event is
+// dropped for a subscriber which is not keeping up. The caller must hold m.mu
+func (m *Memory) publish(e *base.ResultEvent) {
+	for ch := range m.subscribers[e.SubmissionId] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (m *Memory) Subscribe(ctx context.Context, id string) (<-chan *base.ResultEvent, error) {
+	ch := make(chan *base.ResultEvent, 64)
+	m.mu.Lock()
+	if m.subscribers[id] == nil {
+		m.subscribers[id] = make(map[chan *base.ResultEvent]struct{})
+	}
+	m.subscribers[id][ch] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers[id], ch)
+		if len(m.subscribers[id]) == 0 {
+			delete(m.subscribers, id)
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (m *Memory) GetSubmission(ctx context.Context, id string) (*base.JudgeSubmissionTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tasks[id]; !ok {
+		return nil, ErrTaskNotFound
+	}
+	t := m.load(id)
+	t.Id = id
+	return t, nil
+}
+
+func (m *Memory) Heartbeat(ctx context.Context, w *base.WorkerInfo) error {
+	w.LastHeartbeat = time.Now()
+	worker := *w
+	worker.Languages = append([]string(nil), w.Languages...)
+	worker.ResourceClasses = append([]string(nil), w.ResourceClasses...)
+	worker.Submissions = append([]string(nil), w.Submissions...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers[w.Id] = &worker
+	return nil
+}
+
+func (m *Memory) DeregisterWorker(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.workers, id)
+	return nil
+}
+
+func (m *Memory) ListWorkers(ctx context.Context) ([]*base.WorkerInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldest := time.Now().Add(-base.WorkerTTL)
+	workers := make([]*base.WorkerInfo, 0, len(m.workers))
+	for id, w := range m.workers {
+		if w.LastHeartbeat.Before(oldest) {
+			delete(m.workers, id)
+			continue
+		}
+		worker := *w
+		workers = append(workers, &worker)
+	}
+	sortWorkers(workers)
+	return workers, nil
+}
+
+func (m *Memory) ClaimIdempotencyKey(ctx context.Context, key, id string, window time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, v := range m.idempotency {
+		if !v.expireAt.After(now) {
+			delete(m.idempotency, k)
+		}
+	}
+	if v, ok := m.idempotency[key]; ok {
+		return v.id, nil
+	}
+	m.idempotency[key] = idempotencyKey{id: id, expireAt: now.Add(window)}
+	return id, nil
+}
+
+func (m *Memory) ReleaseIdempotencyKey(ctx context.Context, key, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.idempotency[key]; ok && v.id == id {
+		delete(m.idempotency, key)
+	}
+	return nil
+}
+
+func (m *Memory) Stats(ctx context.Context) (*Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := newStats()
+	queues := make(map[*fairQueue]*QueueStats)
+	for _, rq := range m.queues {
+		queues[rq.contest] = stats.Queues[queueNameContest]
+		queues[rq.practice] = stats.Queues[queueNamePractice]
+		queues[rq.rejudge] = stats.Queues[queueNameRejudge]
+	}
+	now := time.Now()
+	for q, qs := range queues {
+		qs.Depth += int64(q.len())
+	}
+	for id, since := range m.pendingSince {
+		submission, ok := m.submissions[id]
+		if !ok {
+			continue
+		}
+		qs := queues[m.pendingQueue(submission)]
+		if age := now.Sub(since).Milliseconds(); age > qs.OldestAgeMs {
+			qs.OldestAgeMs = age
+		}
+	}
+	for _, deadline := range m.leases {
+		stats.InFlight++
+		if !deadline.After(now) {
+			stats.ExpiredLeases++
+		}
+	}
+	stats.DeadLetters = int64(len(m.deadLetters))
+	for name, v := range m.counters {
+		stats.Counters[name] = v
+	}
+	return stats, nil
+}
+
+func (m *Memory) MarkPersisted(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	delete(m.completed, id)
+	if _, ok := m.submissions[id]; !ok {
+		m.expireAt[id] = now.Add(m.retention)
+	}
+	m.purge(now)
+	return nil
+}
+
+func (m *Memory) ListUnpersisted(ctx context.Context, before time.Time, limit int) ([]*base.JudgeSubmissionTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purge(time.Now())
+	ids := make([]string, 0)
+	for id, at := range m.completed {
+		if _, ok := m.submissions[id]; ok && m.tasks[id].FinalVerdict == base.VerdictUnjudge {
+			// judged again, a dead-lettered submission keeps its verdict until it is redriven
+			delete(m.completed, id)
+			continue
+		}
+		if !at.After(before) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return m.completed[ids[i]].Before(m.completed[ids[j]])
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	tasks := make([]*base.JudgeSubmissionTask, 0, len(ids))
+	for _, id := range ids {
+		t := m.load(id)
+		t.Id = id
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
+
+// purge drops the task and results of the persisted submissions past their retention,
+// the caller must hold m.mu
+func (m *Memory) purge(now time.Time) {
+	for id, at := range m.expireAt {
+		if at.After(now) {
+			continue
+		}
+		delete(m.expireAt, id)
+		delete(m.tasks, id)
+		delete(m.results, id)
+	}
+}
@@ -0,0 +1,12 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	runBrokerSuite(t, func(t *testing.T) *testBroker {
+		return &testBroker{Broker: NewMemory(), advance: func(time.Duration) {}}
+	})
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/judgo/pkg/base"
+)
+
+// payloadTestCmd decodes ARGV[1] like the scripts do, bumps retried and writes it back
+const payloadTestCmd = payloadCmd + `
+	local v, header = decode_payload(ARGV[1])
+	if v.retried then
+		v.retried = v.retried + 1
+	end
+	local compressed = "0"
+	if v.src_z then
+		compressed = "1"
+	end
+	return {v.id or "", v.username or "", tostring(v.in_contest), compressed, header, encode_payload(v, header)}
+`
+
+func evalPayload(t *testing.T, buf []byte) []interface{} {
+	t.Helper()
+	_, client := newTestRedis(t)
+	reply, err := client.Eval(context.Background(), payloadTestCmd, nil, buf).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestLuaDecodeSubmission(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		buf    func(s *base.SubmissionDescription) []byte
+		src    string
+		header string
+	}{
+		{"msgpack", (*base.SubmissionDescription).Encode, "int main() {}", string(base.CodecVersion)},
+		{"deflated", (*base.SubmissionDescription).Encode, strings.Repeat("int a;\n", 1024), string(base.CodecVersion)},
+		{"legacy json", func(s *base.SubmissionDescription) []byte {
+			buf, _ := json.Marshal(s)
+			return buf
+		}, "int main() {}", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &base.SubmissionDescription{
+				Id:         "s1",
+				SourceCode: tc.src,
+				Username:   "alice",
+				Language:   "cpp",
+				ContestId:  "c1",
+				InContest:  true,
+			}
+			reply := evalPayload(t, tc.buf(s))
+			compressed := "0"
+			if len(tc.src) > 1024 {
+				compressed = "1"
+			}
+			want := []interface{}{"s1", "alice", "true", compressed, tc.header}
+			if !reflect.DeepEqual(reply[:5], want) {
+				t.Fatalf("got %v, want %v", reply[:5], want)
+			}
+
+			// written back by the script, the source must survive
+			got := new(base.SubmissionDescription)
+			if err := got.Decode([]byte(reply[5].(string))); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, s) {
+				t.Fatalf("got %+v, want %+v", got, s)
+			}
+		})
+	}
+}
+
+func TestLuaDecodeTask(t *testing.T) {
+	task := &base.JudgeTaskDescription{Retried: 1, MaxRetry: 3, TimeLimit: 1000, MemoryLimit: 256, Error: "testcase missing"}
+	reply := evalPayload(t, task.Encode())
+	got := new(base.JudgeTaskDescription)
+	if err := got.Decode([]byte(reply[5].(string))); err != nil {
+		t.Fatal(err)
+	}
+	task.Retried++
+	if !reflect.DeepEqual(got, task) {
+		t.Fatalf("got %+v, want %+v", got, task)
+	}
+}
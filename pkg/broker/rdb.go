@@ -2,11 +2,12 @@ package broker
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/khoakmp/judgo/pkg/base"
@@ -14,7 +15,66 @@ import (
 )
 
 type RDB struct {
-	client *redis.Client
+	client     *redis.Client
+	policy     SchedulePolicy
+	retention  time.Duration
+	routes     []string      // routes this judger picks from
+	nextRoute  atomic.Uint32 // route picked from first by the next pick, rotated so none starves
+	routesMu   sync.Mutex
+	registered map[string]bool // routes known to be in routesKey
+	migrateMu  sync.Mutex
+	migrated   bool // legacy pending lists are empty
+}
+
+var _ Broker = (*RDB)(nil)
+
+func NewRDB(client *redis.Client) *RDB {
+	return &RDB{
+		client:     client,
+		policy:     DefaultSchedulePolicy,
+		retention:  DefaultRetention,
+		routes:     DefaultRoutes,
+		registered: make(map[string]bool),
+	}
+}
+
+// SetRoutes sets the routes this judger picks submissions from, see base.Routes
+func (r *RDB) SetRoutes(routes []string) {
+	r.routes = routes
+}
+
+// registerRoute adds route to the routes scanned by Stats, once per process
+func (r *RDB) registerRoute(ctx context.Context, route string) error {
+	r.routesMu.Lock()
+	registered := r.registered[route]
+	r.routesMu.Unlock()
+	if registered {
+		return nil
+	}
+	if err := r.client.SAdd(ctx, routesKey, route).Err(); err != nil {
+		return err
+	}
+	r.routesMu.Lock()
+	r.registered[route] = true
+	r.routesMu.Unlock()
+	return nil
+}
+
+// allRoutes returns every route a submission was enqueued on
+func (r *RDB) allRoutes(ctx context.Context) ([]string, error) {
+	routes, err := r.client.SMembers(ctx, routesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	return withDefaultRoute(routes), nil
+}
+
+func (r *RDB) SetSchedulePolicy(policy SchedulePolicy) {
+	r.policy = policy
+}
+
+func (r *RDB) SetRetention(retention time.Duration) {
+	r.retention = retention
 }
 
 type SubmissionDescription struct {
@@ -36,113 +96,566 @@ const (
 	submissionKeyPrefix     = appPrefix + "s:"
 	submissionResultPrefix  = appPrefix + "s:results:"  // use with hash: subtestid -> encoded result
 	judgeTaskKeyPrefix      = appPrefix + "judge:task:" //  with submission id
-	practicePendingQueueKey = appPrefix + "practice:pending:q"
-	contestPendingQueueKey  = appPrefix + "contest:pending:q"
+	practicePendingQueueKey = appPrefix + "practice:pending:fq"
+	rejudgePendingQueueKey  = appPrefix + "rejudge:pending:q" // only picked when the other queues are empty
+	contestPendingQueueKey  = appPrefix + "contest:pending:fq"
 	leaseQueueKey           = appPrefix + "lease:q"
+	deadLetterQueueKey      = appPrefix + "deadletter:q"
+	pendingSignalKey        = appPrefix + "pending:signal" // one token pushed per submission made pending
+	pendingSinceKey         = appPrefix + "pending:since"  // hash: submission id -> unix ms it became pending
+	scheduleKey             = appPrefix + "schedule"       // hash: queue name -> scheduler pass
+	cancelledSetKey         = appPrefix + "cancelled"      // leased submissions whose judger must abort
+	eventChannelPrefix      = appPrefix + "events:"        // pub/sub channel with submission id
+	fencingKey              = appPrefix + "fencing"        // hash: leased submission id -> current fencing token
+	fencingCounterKey       = appPrefix + "fencing:counter"
+	workersKey              = appPrefix + "workers"           // hash: worker id -> encoded worker info
+	workerHeartbeatKey      = appPrefix + "workers:heartbeat" // zset: worker id -> unix ms of last heartbeat
+	idempotencyKeyPrefix    = appPrefix + "idem:"             // with idempotency key, value is the submission id
+	statsKey                = appPrefix + "stats"             // hash: counter name -> total
+	completedKey            = appPrefix + "completed"         // zset: finished submission id -> unix ms, until persisted
+	shardsKey               = appPrefix + "shards"            // hash: sharded submission id -> shards not merged yet
+	shardsTotalKey          = appPrefix + "shards:total"      // hash: sharded submission id -> number of shards
+	routesKey               = appPrefix + "routes"            // set: routes submissions were enqueued on
 )
 
-const enqueueCmd = `
+// FIFO lists of submission ids of the versions before fair queuing, see migrateLegacyQueues
+const (
+	legacyContestPendingQueueKey  = appPrefix + "contest:pending:q"
+	legacyPracticePendingQueueKey = appPrefix + "practice:pending:q"
+)
+
+// defines grant_token(id) which gives a new fencing token to the lease of id,
+// expects the fencing hash and counter at KEYS[#KEYS-1] and KEYS[#KEYS]
+const grantTokenCmd = `
+	local function grant_token(id)
+		local token = redis.call("INCR", KEYS[#KEYS])
+		redis.call("HSET", KEYS[#KEYS-1], id, token)
+		return token
+	end
+`
+
+const enqueueCmd = fairQueueCmd + signalPendingCmd + `
+	if redis.call("EXISTS", KEYS[1] .. ARGV[1]) == 1 then
+		return 0
+	end
 	redis.call("SET", KEYS[1] .. ARGV[1], ARGV[2])
 	redis.call("SET", KEYS[2] .. ARGV[1], ARGV[3])
-	redis.call("RPUSH", KEYS[3] .. ARGV[1], ARGV[1])
+	fq_push(KEYS[4], ARGV[2], ARGV[1], false)
 
+	-- a rejudge starts from empty results
+	redis.call("DEL", KEYS[3] .. ARGV[1])
 	for i=4,#ARGV,2 do 
-		redis.call("HSET", KEYS[4], ARGV[i], ARGV[i+1])
+		redis.call("HSET", KEYS[3] .. ARGV[1], ARGV[i], ARGV[i+1])
 	end
-	return "OK"	
+	` + nowMsCmd + `
+	redis.call("HSET", KEYS[5], ARGV[1], now_ms())
+	signal_pending(KEYS[#KEYS])
+	return 1
 `
 
-func (r *RDB) Enqueue(ctx context.Context, t *base.JudgeSubmissionTask) error {
-	submission := t.SubmissionDescription.Encode()
-	taskDescription := t.JudgeTaskDescription.Encode()
+// defines decode_payload and encode_payload for the payloads written by the base codec:
+// a version byte followed by msgpack, or the legacy JSON. decode_payload also returns the
+// header to write the payload back with.
+const payloadCmd = `
+	local function decode_payload(buf)
+		if string.sub(buf, 1, 1) == "{" then
+			return cjson.decode(buf), ""
+		end
+		return cmsgpack.unpack(string.sub(buf, 2)), string.sub(buf, 1, 1)
+	end
+
+	local function encode_payload(v, header)
+		if header == "" then
+			return cjson.encode(v)
+		end
+		return header .. cmsgpack.pack(v)
+	end
+`
+
+// defines subtest_error returning the error of the first unjudged subtest of the results hash
+// which failed with one, like JudgeSubmissionTask.SubtestError
+const subtestErrorCmd = `
+	local function subtest_error(results)
+		local fields = redis.call("HGETALL", results)
+		local first, msg = nil, ""
+		for i = 1, #fields, 2 do
+			local id = tonumber(fields[i])
+			local r = decode_payload(fields[i + 1])
+			if (r["verdict_code"] or 0) == 0 and r["err_msg"] and r["err_msg"] ~= "" and (first == nil or id < first) then
+				first, msg = id, r["err_msg"]
+			end
+		end
+		return msg
+	end
+
+	local function lease_expired_error(retried, results)
+		local msg = "lease expired " .. retried .. " times"
+		local err = subtest_error(results)
+		if err ~= "" then
+			msg = msg .. ": " .. err
+		end
+		return msg
+	end
+`
+
+// defines fq_push, fq_remove, fq_peek and fq_pop on a pending queue q with the same structure as fairQueue:
+// q is the ring of contest ids, q:u:<contest id> the ring of usernames and
+// q:f:<contest id>:<username> the FIFO of submission ids of one user.
+// q:since is a zset of the submission ids by the unix ms they were pushed at, for Stats.
+const fairQueueCmd = payloadCmd + `
+	local function fq_push(q, submission, id, front)
+		local s = decode_payload(submission)
+		local contest = ""
+		if s["in_contest"] then
+			contest = s["contest_id"] or ""
+		end
+		local user = s["username"] or ""
+		local users = q .. ":u:" .. contest
+		local flow = q .. ":f:" .. contest .. ":" .. user
+		if redis.call("LLEN", flow) == 0 then
+			if redis.call("LLEN", users) == 0 then
+				redis.call("RPUSH", q, contest)
+			end
+			redis.call("RPUSH", users, user)
+		end
+		if front then
+			redis.call("LPUSH", flow, id)
+		else
+			redis.call("RPUSH", flow, id)
+		end
+		local t = redis.call("TIME")
+		redis.call("ZADD", q .. ":since", tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000), id)
+	end
+
+	local function fq_remove(q, submission, id)
+		local s = decode_payload(submission)
+		local contest = ""
+		if s["in_contest"] then
+			contest = s["contest_id"] or ""
+		end
+		local user = s["username"] or ""
+		local users = q .. ":u:" .. contest
+		local flow = q .. ":f:" .. contest .. ":" .. user
+		if redis.call("LREM", flow, 0, id) == 0 then
+			return false
+		end
+		redis.call("ZREM", q .. ":since", id)
+		if redis.call("LLEN", flow) == 0 then
+			redis.call("LREM", users, 0, user)
+			if redis.call("LLEN", users) == 0 then
+				redis.call("LREM", q, 0, contest)
+			end
+		end
+		return true
+	end
+
+	local function fq_head(q)
+		local contest = redis.call("LINDEX", q, 0)
+		if not contest then
+			return nil, nil
+		end
+		local users = q .. ":u:" .. contest
+		local user = redis.call("LINDEX", users, 0)
+		return users, q .. ":f:" .. contest .. ":" .. user
+	end
+
+	local function fq_peek(q)
+		local users, flow = fq_head(q)
+		if not users then
+			return nil
+		end
+		return redis.call("LINDEX", flow, 0)
+	end
+
+	local function fq_pop(q)
+		local users, flow = fq_head(q)
+		if not users then
+			return nil
+		end
+		local id = redis.call("LPOP", flow)
+		redis.call("ZREM", q .. ":since", id)
+		if redis.call("LLEN", flow) == 0 then
+			redis.call("LPOP", users)
+		else
+			redis.call("LMOVE", users, users, "LEFT", "RIGHT")
+		end
+		if redis.call("LLEN", users) == 0 then
+			redis.call("LPOP", q)
+		else
+			redis.call("LMOVE", q, q, "LEFT", "RIGHT")
+		end
+		return id
+	end
+`
 
+// defines pending_of returning the pending queue, or stream, of an encoded submission in its route
+// and the key suffix of that route, see routeSuffix
+const pendingOfCmd = `
+	local function route_suffix(s)
+		local class = s["resource_class"]
+		if not class or class == "" then
+			class = "` + base.DefaultResourceClass + `"
+		end
+		local route = (s["language"] or "") .. "/" .. class
+		if route == "` + base.DefaultRoute + `" then
+			return ""
+		end
+		return "` + routeKeyInfix + `" .. route
+	end
+
+	local function pending_of(submission, contest, practice, rejudge)
+		local s = decode_payload(submission)
+		local route = route_suffix(s)
+		if s["rejudge_id"] and s["rejudge_id"] ~= "" then
+			return rejudge .. route, route
+		end
+		if s["in_contest"] then
+			return contest .. route, route
+		end
+		return practice .. route, route
+	end
+`
+
+// defines now_ms() from the redis server clock
+const nowMsCmd = `
+	local function now_ms()
+		local t = redis.call("TIME")
+		return tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+	end
+`
+
+// defines signal_pending(key) which wakes up one judger blocked in BlockingPickOneSubmission on the
+// signal list key of a route. The list is trimmed since tokens are left over when submissions are
+// picked without blocking.
+const signalPendingCmd = `
+	local function signal_pending(key)
+		redis.call("RPUSH", key, 1)
+		redis.call("LTRIM", key, -1024, -1)
+	end
+`
+
+func (r *RDB) Enqueue(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	if err := r.migrateLegacyQueues(ctx); err != nil {
+		return err
+	}
+	route := t.Route()
+	if err := r.registerRoute(ctx, route); err != nil {
+		return err
+	}
 	keys := []string{
 		submissionKeyPrefix,
 		judgeTaskKeyPrefix,
 		submissionResultPrefix,
 	}
 
-	if t.SubmissionDescription.InContest {
-		keys = append(keys, contestPendingQueueKey)
-	} else {
-		keys = append(keys, practicePendingQueueKey)
+	keys = append(keys, pendingQueueKey(t.SubmissionDescription), pendingSinceKey, pendingSignalKey+routeSuffix(route))
+	return r.enqueued(ctx, r.client.Eval(ctx, enqueueCmd, keys, enqueueArgs(t)...))
+}
+
+// enqueued maps the reply of an enqueue script returning 0 when the submission is already queued
+func (r *RDB) enqueued(ctx context.Context, cmd *redis.Cmd) error {
+	ok, err := cmd.Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrAlreadyQueued
 	}
+	r.count(ctx, counterEnqueued, 1)
+	return nil
+}
+
+func pendingQueueKey(s *base.SubmissionDescription) string {
+	suffix := routeSuffix(s.Route())
+	if s.RejudgeId != "" {
+		return rejudgePendingQueueKey + suffix
+	}
+	if s.InContest {
+		return contestPendingQueueKey + suffix
+	}
+	return practicePendingQueueKey + suffix
+}
+
+// enqueueArgs returns {id, encoded submission, encoded task description, subtest id, encoded result, ...}
+func enqueueArgs(t *base.JudgeSubmissionTask) []interface{} {
 	args := []interface{}{
 		t.Id,
-		submission,
-		taskDescription,
+		t.SubmissionDescription.Encode(),
+		t.JudgeTaskDescription.Encode(),
 	}
 	for id, res := range t.Results {
-		encoded := res.Encode()
-		args = append(args, id, encoded)
-	}
-	return r.client.Eval(ctx, enqueueCmd, keys, args...).Err()
-}
-
-// rpush lpop dung
-const pickOneSubmissionCmd = `
- 	local id = redis.call("LPOP", KEYS[1])	
-	if id then
-		local results = {}
-		local sub_key = KEYS[2] .. id
-		local submission = redis.call("GET", sub)
-		table.insert(results, submission)
-		
-		local t = redis.call("GET", KEYS[3] .. id )
-		table.insert(results, t)
-	
-		local subtests = redis.call("HGETALL", KEYS[4] .. id)
-		table.insert(results, subtests)
-		redis.call("ZADD", KEYS[5], ARGV[1], id)
-		return results
-	end
-
-	return nil
-	`
+		args = append(args, id, res.Encode())
+	}
+	return args
+}
 
 var ErrQueueEmpty = errors.New("queue is empty")
 
 func (r *RDB) PickOneSubmission() (*base.JudgeSubmissionTask, *time.Time, error) {
-	queues := []string{contestPendingQueueKey, practicePendingQueueKey}
-	for _, q := range queues {
-		keys := []string{
-			q, submissionKeyPrefix, judgeTaskKeyPrefix, submissionResultPrefix,
-		}
-		leaseDeadline := time.Now().Add(base.DefaultLeaseDuration)
+	tasks, err := r.PickSubmissions(context.Background(), 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, nil, ErrQueueEmpty
+	}
+	leaseDeadline := tasks[0].Lease.Deadline()
+	return tasks[0], &leaseDeadline, nil
+}
 
-		result, err := r.client.Eval(context.Background(), pickOneSubmissionCmd, keys,
-			leaseDeadline.UnixMilli()).Result()
+// decodeTask builds a task from the reply {submission, task description, HGETALL of results}
+func decodeTask(arr []interface{}) (*base.JudgeSubmissionTask, error) {
+	t := new(base.JudgeSubmissionTask)
+	t.JudgeTaskDescription = new(base.JudgeTaskDescription)
+	if err := t.JudgeTaskDescription.Decode([]byte(arr[1].(string))); err != nil {
+		return nil, fmt.Errorf("decode task description: %w", err)
+	}
 
-		if err != nil {
-			if err == redis.Nil {
-				continue
-			}
-			return nil, nil, err
+	t.SubmissionDescription = new(base.SubmissionDescription)
+	if err := t.SubmissionDescription.Decode([]byte(arr[0].(string))); err != nil {
+		return nil, fmt.Errorf("decode submission: %w", err)
+	}
+
+	subtests := arr[2].([]interface{})
+	t.Results = make(map[int]*base.SubtestResult, len(subtests)/2)
+	for i := 0; i < len(subtests)/2; i++ {
+		id, _ := strconv.Atoi(subtests[i<<1].(string))
+		subtestResult := new(base.SubtestResult)
+		if err := subtestResult.Decode([]byte(subtests[i<<1|1].(string))); err != nil {
+			return nil, fmt.Errorf("decode result of subtest %d: %w", id, err)
 		}
-		arr := result.([]interface{})
-		t := new(base.JudgeSubmissionTask)
-		t.JudgeTaskDescription.Decode([]byte(arr[1].(string)))
+		t.Results[id] = subtestResult
+	}
+	return t, nil
+}
 
-		t.SubmissionDescription = new(base.SubmissionDescription)
-		t.SubmissionDescription.Decode([]byte(arr[0].(string)))
+// same logic as scheduler, the passes are shared by all judgers through KEYS[7].
+// The rejudge queue at KEYS[9] is only picked from when both other queues are empty.
+const pickSubmissionsCmd = nowMsCmd + fairQueueCmd + grantTokenCmd + `
+	local names = {"contest", "practice"}
+	local steps = {tonumber(ARGV[3]), tonumber(ARGV[4])}
+	local aging = tonumber(ARGV[5])
 
-		//json.Unmarshal([]byte(arr[0].(string)), t.Submission)
-		//json.Unmarshal([]byte(arr[1].(string)), t)
+	local function choose()
+		local clen = redis.call("LLEN", KEYS[1])
+		local plen = redis.call("LLEN", KEYS[2])
+		if clen == 0 and plen == 0 then
+			return 0
+		end
+		if plen == 0 then
+			return 1
+		end
+		if clen == 0 then
+			return 2
+		end
+		if aging > 0 then
+			local since = redis.call("HGET", KEYS[8], fq_peek(KEYS[2]))
+			if since and now_ms() - tonumber(since) >= aging then
+				return 2
+			end
+		end
+		if steps[2] < 0 then
+			return 1
+		end
+		if steps[1] < 0 then
+			return 2
+		end
+		local cpass = tonumber(redis.call("HGET", KEYS[7], names[1]) or "0")
+		local ppass = tonumber(redis.call("HGET", KEYS[7], names[2]) or "0")
+		if ppass + steps[2] < cpass + steps[1] then
+			return 2
+		end
+		return 1
+	end
 
-		subtests := arr[1].([]interface{})
-		for i := 0; i < len(subtests)/2; i++ {
-			id, _ := strconv.Atoi(subtests[i<<1].(string))
-			subtestResult := new(base.SubtestResult)
-			json.Unmarshal([]byte(subtests[i<<1|1].(string)), subtestResult)
-			t.Results[id] = subtestResult
+	local function served(q)
+		if steps[q] > 0 then
+			redis.call("HINCRBYFLOAT", KEYS[7], names[q], steps[q])
+		end
+		local other = 3 - q
+		if redis.call("LLEN", KEYS[other]) == 0 then
+			local pass = tonumber(redis.call("HGET", KEYS[7], names[q]) or "0")
+			local other_pass = tonumber(redis.call("HGET", KEYS[7], names[other]) or "0")
+			if other_pass < pass then
+				redis.call("HSET", KEYS[7], names[other], pass)
+			end
+		end
+	end
+
+	local results = {}
+	local n = tonumber(ARGV[2])
+	while #results < n do
+		local q = choose()
+		local id
+		if q ~= 0 then
+			id = fq_pop(KEYS[q])
+			served(q)
+		elseif redis.call("LLEN", KEYS[9]) > 0 then
+			id = fq_pop(KEYS[9])
+		else
+			break
+		end
+		redis.call("HDEL", KEYS[8], id)
+		local submission = redis.call("GET", KEYS[3] .. id)
+		local t = redis.call("GET", KEYS[4] .. id)
+		if submission and t then
+			redis.call("ZADD", KEYS[6], ARGV[1], id)
+			table.insert(results, {submission, t, redis.call("HGETALL", KEYS[5] .. id), grant_token(id)})
+		end
+	end
+	return results
+`
+
+const migrateLegacyQueuesCmd = fairQueueCmd + nowMsCmd + pendingOfCmd + signalPendingCmd + `
+	local moved = 0
+	for _, legacy in ipairs({KEYS[1], KEYS[2]}) do
+		while moved < tonumber(ARGV[1]) do
+			local id = redis.call("LPOP", legacy)
+			if not id then
+				break
+			end
+			local submission = redis.call("GET", KEYS[3] .. id)
+			if submission then
+				local q, route = pending_of(submission, KEYS[4], KEYS[5], KEYS[6])
+				fq_push(q, submission, id, false)
+				redis.call("HSETNX", KEYS[7], id, now_ms())
+				signal_pending(KEYS[#KEYS] .. route)
+			end
+			moved = moved + 1
+		end
+	end
+	return moved
+`
+
+// max number of legacy pending ids moved per script call
+const migrateBatchSize = 1000
+
+// migrateLegacyQueues moves the submissions left in the pending lists of the versions before fair
+// queuing to the fair queues, in order. It runs once per process, before the first enqueue, pick or cancel.
+func (r *RDB) migrateLegacyQueues(ctx context.Context) error {
+	r.migrateMu.Lock()
+	defer r.migrateMu.Unlock()
+	if r.migrated {
+		return nil
+	}
+	keys := []string{
+		legacyContestPendingQueueKey,
+		legacyPracticePendingQueueKey,
+		submissionKeyPrefix,
+		contestPendingQueueKey,
+		practicePendingQueueKey,
+		rejudgePendingQueueKey,
+		pendingSinceKey,
+		pendingSignalKey,
+	}
+	for {
+		moved, err := r.client.Eval(ctx, migrateLegacyQueuesCmd, keys, migrateBatchSize).Int()
+		if err != nil {
+			return err
+		}
+		if moved < migrateBatchSize {
+			break
 		}
+	}
+	r.migrated = true
+	return nil
+}
 
-		t.Lease = base.NewLease(leaseDeadline)
+// PickSubmissions leases up to n submissions with one round-trip per route, the queue of
+// each pick is chosen by the schedule policy whose passes are shared by the routes.
+// The tasks already leased are returned together with the error if a later route fails.
+func (r *RDB) PickSubmissions(ctx context.Context, n int) ([]*base.JudgeSubmissionTask, error) {
+	if err := r.migrateLegacyQueues(ctx); err != nil {
+		return nil, err
+	}
+	tasks := make([]*base.JudgeSubmissionTask, 0, n)
+	var err error
+	first := int(r.nextRoute.Add(1))
+	for i := range r.routes {
+		if len(tasks) == n {
+			break
+		}
+		picked, pickErr := r.pickRoute(ctx, r.routes[(first+i)%len(r.routes)], n-len(tasks))
+		tasks = append(tasks, picked...)
+		if pickErr != nil {
+			err = pickErr
+		}
+	}
+	r.count(ctx, counterPicked, len(tasks))
+	return tasks, err
+}
+
+func (r *RDB) pickRoute(ctx context.Context, route string, n int) ([]*base.JudgeSubmissionTask, error) {
+	suffix := routeSuffix(route)
+	keys := []string{
+		contestPendingQueueKey + suffix,
+		practicePendingQueueKey + suffix,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+		leaseQueueKey,
+		scheduleKey,
+		pendingSinceKey,
+		rejudgePendingQueueKey + suffix,
+		fencingKey,
+		fencingCounterKey,
+	}
+	steps := r.policy.steps()
+	leaseDeadline := time.Now().Add(base.DefaultLeaseDuration)
+	args := []interface{}{
+		leaseDeadline.UnixMilli(),
+		n,
+		steps[queueContest],
+		steps[queuePractice],
+		r.policy.PracticeAging.Milliseconds(),
+	}
+	result, err := r.client.Eval(ctx, pickSubmissionsCmd, keys, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+	// a task which cannot be decoded stays leased, it is retried once its lease expires
+	// and ends up in the dead-letter queue
+	var decodeErr error
+	tasks := make([]*base.JudgeSubmissionTask, 0, len(result))
+	for _, item := range result {
+		arr := item.([]interface{})
+		t, err := decodeTask(arr)
+		if err != nil {
+			decodeErr = err
+			continue
+		}
+		t.Lease = base.NewLease(leaseDeadline, arr[3].(int64))
 		t.Mutex = &sync.Mutex{}
+		tasks = append(tasks, t)
+	}
+	return tasks, decodeErr
+}
 
-		return t, &leaseDeadline, nil
+// BlockingPickOneSubmission waits up to timeout for a submission, with the same priority
+// as PickOneSubmission. It returns ErrQueueEmpty on timeout.
+func (r *RDB) BlockingPickOneSubmission(ctx context.Context, timeout time.Duration) (*base.JudgeSubmissionTask, *time.Time, error) {
+	return blockingPick(ctx, r.client, signalKeys(r.routes), timeout, r.PickOneSubmission)
+}
+
+func blockingPick(ctx context.Context, client *redis.Client, signals []string, timeout time.Duration,
+	pick func() (*base.JudgeSubmissionTask, *time.Time, error)) (*base.JudgeSubmissionTask, *time.Time, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		t, leaseDeadline, err := pick()
+		if err != ErrQueueEmpty {
+			return t, leaseDeadline, err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, nil, ErrQueueEmpty
+		}
+		// BLPOP only supports whole seconds
+		wait = (wait + time.Second - 1).Truncate(time.Second)
+		err = client.BLPop(ctx, wait, signals...).Err()
+		if err != nil && err != redis.Nil {
+			return nil, nil, err
+		}
 	}
-	return nil, nil, ErrQueueEmpty
 }
 
 type UpdateSubtestResultParam struct {
@@ -152,14 +665,96 @@ type UpdateSubtestResultParam struct {
 }
 
 func (r *RDB) UpdateSubtestResult(ctx context.Context, param UpdateSubtestResultParam) error {
-	encoded, _ := json.Marshal(param.result)
-	return r.client.HSet(ctx, fmt.Sprintf("%s%s", submissionResultPrefix, param.SubmissionId), param.SubtestId, encoded).Err()
+	return r.client.HSet(ctx, fmt.Sprintf("%s%s", submissionResultPrefix, param.SubmissionId), param.SubtestId, param.result.Encode()).Err()
 }
 
+const updatePartialResultCmd = `
+	if redis.call("HGET", KEYS[2], ARGV[1]) ~= ARGV[2] then
+		return 0
+	end
+	redis.call("HSET", KEYS[1], ARGV[3], ARGV[4])
+	redis.call("PUBLISH", ARGV[5], ARGV[6])
+	return 1
+`
+
 func (r *RDB) UpdatePartialResult(t *base.JudgeSubmissionTask, subtestID int) error {
-	encoded := t.Results[subtestID].Encode()
-	key := fmt.Sprintf("%s%s", submissionResultPrefix, t.Id)
-	return r.client.HSet(context.Background(), key, subtestID, encoded).Err()
+	result := t.Results[subtestID]
+	event := &base.ResultEvent{
+		Type:         base.EventSubtest,
+		SubmissionId: t.EventId(),
+		SubtestId:    subtestID,
+		Subtest:      result,
+	}
+	keys := []string{
+		fmt.Sprintf("%s%s", submissionResultPrefix, t.Id),
+		fencingKey,
+	}
+	args := []interface{}{
+		t.Id,
+		t.Lease.Token(),
+		subtestID,
+		result.Encode(),
+		eventChannelPrefix + t.EventId(),
+		event.Encode(),
+	}
+	return fencedResult(r.client.Eval(context.Background(), updatePartialResultCmd, keys, args...))
+}
+
+// fencedResult maps the reply of a script returning 0 when the fencing token is stale
+func fencedResult(cmd *redis.Cmd) error {
+	ok, err := cmd.Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func finalEvent(t *base.JudgeSubmissionTask) *base.ResultEvent {
+	return &base.ResultEvent{
+		Type:         base.EventFinal,
+		SubmissionId: t.Id,
+		Task:         t.JudgeTaskDescription,
+	}
+}
+
+func (r *RDB) PublishEvent(ctx context.Context, e *base.ResultEvent) error {
+	return r.client.Publish(ctx, eventChannelPrefix+e.SubmissionId, e.Encode()).Err()
+}
+
+func (r *RDB) Subscribe(ctx context.Context, id string) (<-chan *base.ResultEvent, error) {
+	pubsub := r.client.Subscribe(ctx, eventChannelPrefix+id)
+	// wait for the subscription to be confirmed so no event published after return is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	events := make(chan *base.ResultEvent)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+		msgCh := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgCh:
+				if !ok {
+					return
+				}
+				e := new(base.ResultEvent)
+				e.Decode([]byte(msg.Payload))
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
 }
 
 /* type SubmissionTotalResult struct {
@@ -180,47 +775,761 @@ func (r *RDB) MarkJudgeSubmissionComplete(ctx context.Context, submissionId stri
 	return r.client.Eval(ctx, markJudgeSubmissionCompleteCmd, keys, args...).Err()
 }
 
-const completeJudgeSubmissionTaskCmd = `
+const completeJudgeSubmissionTaskCmd = nowMsCmd + `
+	if redis.call("HGET", KEYS[5], ARGV[2]) ~= ARGV[5] then
+		return 0
+	end
 	-- set task result 
 	redis.call("SET" ,KEYS[1], ARGV[1])
 	-- delete submission description
 	redis.call("DEL", KEYS[2]) 
 	-- remove submission id from lease queue
 	redis.call("ZREM", KEYS[3], ARGV[2])
-	return "OK"
+	redis.call("SREM", KEYS[4], ARGV[2])
+	redis.call("HDEL", KEYS[5], ARGV[2])
+	redis.call("ZADD", KEYS[6], now_ms(), ARGV[2])
+	redis.call("PUBLISH", ARGV[3], ARGV[4])
+	return 1
 `
 
 func (r *RDB) CompleteJudgeSubmissionTask(ctx context.Context, t *base.JudgeSubmissionTask) error {
 
-	taskEncoded := t.Encode()
+	taskEncoded := t.JudgeTaskDescription.Encode()
 	keys := []string{
 		fmt.Sprintf("%s%s", judgeTaskKeyPrefix, t.Id),
 		fmt.Sprintf("%s%s", submissionKeyPrefix, t.Id),
 		leaseQueueKey,
+		cancelledSetKey,
+		fencingKey,
+		completedKey,
 	}
 	args := []interface{}{
 		taskEncoded,
 		t.Id,
+		eventChannelPrefix + t.Id,
+		finalEvent(t).Encode(),
+		t.Lease.Token(),
+	}
+	err := fencedResult(r.client.Eval(ctx, completeJudgeSubmissionTaskCmd, keys, args...))
+	if err == nil {
+		r.count(ctx, counterCompleted, 1)
 	}
-	return r.client.Eval(ctx, completeJudgeSubmissionTaskCmd, keys, args...).Err()
+	return err
 }
 
 const extendLeaseCmd = `
-	for i=2,#ARGV,1 do 
-		redis.call("ZADD", KEYS[1], "XX", ARGV[1], ARGV[2])
+	local cancelled = {}
+	local lost = {}
+	for i=2,#ARGV,2 do 
+		if redis.call("HGET", KEYS[3], ARGV[i]) ~= ARGV[i+1] then
+			table.insert(lost, ARGV[i])
+		else
+			redis.call("ZADD", KEYS[1], "XX", ARGV[1], ARGV[i])
+			if redis.call("SISMEMBER", KEYS[2], ARGV[i]) == 1 then
+				table.insert(cancelled, ARGV[i])
+			end
+		end
 	end 
-	return "OK"
+	return {cancelled, lost}
 `
 
-func (r *RDB) ExtendLease(ids []string, deadline time.Time) error {
+func (r *RDB) ExtendLease(leases map[string]int64, deadline time.Time) ([]string, []string, error) {
 	keys := []string{
 		leaseQueueKey,
+		cancelledSetKey,
+		fencingKey,
 	}
 	args := []interface{}{
 		deadline.UnixMilli(),
 	}
-	for _, id := range ids {
-		args = append(args, id)
+	for id, token := range leases {
+		args = append(args, id, token)
+	}
+	result, err := r.client.Eval(context.Background(), extendLeaseCmd, keys, args...).Slice()
+	if err != nil {
+		return nil, nil, err
+	}
+	return appendIds(nil, result[0]), appendIds(nil, result[1]), nil
+}
+
+const recoverExpiredLeasesCmd = nowMsCmd + fairQueueCmd + subtestErrorCmd + pendingOfCmd + signalPendingCmd + `
+	local requeued = {}
+	local dead = {}
+	local cancelled = {}
+	local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+	for _, id in ipairs(ids) do
+		redis.call("ZREM", KEYS[1], id)
+		-- the expired token is revoked, writes of the former holder fail until the next grant
+		redis.call("HDEL", KEYS[9], id)
+		local submission = redis.call("GET", KEYS[2] .. id)
+		local task = redis.call("GET", KEYS[3] .. id)
+		if submission and task then
+			local t, header = decode_payload(task)
+			t["retried"] = (t["retried"] or 0) + 1
+			if redis.call("SREM", KEYS[8], id) == 1 then
+				t["final_verdict"] = tonumber(ARGV[3])
+				redis.call("SET", KEYS[3] .. id, encode_payload(t, header))
+				redis.call("DEL", KEYS[2] .. id)
+				redis.call("ZADD", KEYS[11], now_ms(), id)
+				table.insert(cancelled, id)
+			elseif t["retried"] > (t["max_retry"] or 0) then
+				if t["error"] == nil or t["error"] == "" then
+					t["error"] = lease_expired_error(t["retried"], KEYS[12] .. id)
+				end
+				local s = decode_payload(submission)
+				if not s["parent_id"] or s["parent_id"] == "" then
+					-- persisted by the recoverer, or by the sweeper if that fails
+					t["final_verdict"] = tonumber(ARGV[4])
+					redis.call("ZADD", KEYS[11], now_ms(), id)
+				end
+				redis.call("SET", KEYS[3] .. id, encode_payload(t, header))
+				redis.call("RPUSH", KEYS[6], id)
+				table.insert(dead, id)
+			else
+				redis.call("SET", KEYS[3] .. id, encode_payload(t, header))
+				-- subtest results hash is left untouched so verdicted subtests are not judged again
+				local q, route = pending_of(submission, KEYS[4], KEYS[5], KEYS[10])
+				fq_push(q, submission, id, true)
+				redis.call("HSET", KEYS[7], id, now_ms())
+				signal_pending(KEYS[#KEYS] .. route)
+				table.insert(requeued, id)
+			end
+		end
+	end
+	return {#ids, requeued, dead, cancelled}
+`
+
+// max number of expired leases handled per script call
+const recoverBatchSize = 100
+
+// RecoverExpiredLeases moves every submission whose lease deadline is before now
+// back to the front of its pending queue and increases its retried counter.
+// Submissions which already used up MaxRetry are moved to the dead-letter queue instead, with
+// an internal error verdict left for the recoverer to persist.
+func (r *RDB) RecoverExpiredLeases(ctx context.Context, now time.Time) (*RecoverResult, error) {
+	keys := []string{
+		leaseQueueKey,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		contestPendingQueueKey,
+		practicePendingQueueKey,
+		deadLetterQueueKey,
+		pendingSinceKey,
+		cancelledSetKey,
+		fencingKey,
+		rejudgePendingQueueKey,
+		completedKey,
+		submissionResultPrefix,
+		pendingSignalKey,
+	}
+	recovered := &RecoverResult{
+		Requeued:     make([]string, 0),
+		DeadLettered: make([]string, 0),
+		Cancelled:    make([]string, 0),
+	}
+	defer r.countRecovered(ctx, recovered)
+	for {
+		result, err := r.client.Eval(ctx, recoverExpiredLeasesCmd, keys, now.UnixMilli(), recoverBatchSize,
+			base.VerdictCancelled, base.VerdictInternalError).Slice()
+		if err != nil {
+			return recovered, err
+		}
+		recovered.Requeued = appendIds(recovered.Requeued, result[1])
+		recovered.DeadLettered = appendIds(recovered.DeadLettered, result[2])
+		recovered.Cancelled = appendIds(recovered.Cancelled, result[3])
+		if result[0].(int64) < recoverBatchSize {
+			return recovered, nil
+		}
+	}
+}
+
+func appendIds(ids []string, reply interface{}) []string {
+	for _, id := range reply.([]interface{}) {
+		ids = append(ids, id.(string))
+	}
+	return ids
+}
+
+const releaseCmd = nowMsCmd + fairQueueCmd + pendingOfCmd + signalPendingCmd + `
+	if redis.call("HGET", KEYS[2], ARGV[1]) ~= ARGV[2] then
+		return 0
+	end
+	redis.call("HDEL", KEYS[2], ARGV[1])
+	redis.call("ZREM", KEYS[1], ARGV[1])
+	local submission = redis.call("GET", KEYS[3] .. ARGV[1])
+	if not submission then
+		return -1
+	end
+	-- subtest results hash is left untouched so verdicted subtests are not judged again
+	local q, route = pending_of(submission, KEYS[4], KEYS[5], KEYS[6])
+	fq_push(q, submission, ARGV[1], true)
+	redis.call("HSET", KEYS[7], ARGV[1], now_ms())
+	signal_pending(KEYS[#KEYS] .. route)
+	return 1
+`
+
+func (r *RDB) Release(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	keys := []string{
+		leaseQueueKey,
+		fencingKey,
+		submissionKeyPrefix,
+		contestPendingQueueKey,
+		practicePendingQueueKey,
+		rejudgePendingQueueKey,
+		pendingSinceKey,
+		pendingSignalKey,
+	}
+	released, err := r.client.Eval(ctx, releaseCmd, keys, t.Id, t.Lease.Token()).Int()
+	if err != nil {
+		return err
+	}
+	switch released {
+	case 0:
+		return ErrLeaseLost
+	case -1:
+		return ErrTaskNotFound
+	}
+	r.count(ctx, counterReleased, 1)
+	return nil
+}
+
+const shardCmd = nowMsCmd + fairQueueCmd + pendingOfCmd + signalPendingCmd + `
+	if redis.call("HGET", KEYS[9], ARGV[1]) ~= ARGV[2] then
+		return 0
+	end
+	redis.call("HDEL", KEYS[9], ARGV[1])
+	redis.call("ZREM", KEYS[1], ARGV[1])
+	redis.call("HSET", KEYS[8], ARGV[1], ARGV[3])
+	redis.call("HSET", KEYS[11], ARGV[1], ARGV[3])
+	local i = 4
+	for _ = 1, tonumber(ARGV[3]) do
+		local id, submission, n = ARGV[i], ARGV[i+1], tonumber(ARGV[i+3])
+		redis.call("SET", KEYS[2] .. id, submission)
+		redis.call("SET", KEYS[3] .. id, ARGV[i+2])
+		redis.call("DEL", KEYS[4] .. id)
+		for j = 1, n do
+			redis.call("HSET", KEYS[4] .. id, ARGV[i+2+2*j], ARGV[i+3+2*j])
+		end
+		local q, route = pending_of(submission, KEYS[5], KEYS[6], KEYS[7])
+		fq_push(q, submission, id, false)
+		redis.call("HSET", KEYS[10], id, now_ms())
+		signal_pending(KEYS[#KEYS] .. route)
+		i = i + 4 + 2 * n
+	end
+	return 1
+`
+
+// Shard args are {parent id, token, number of shards} followed for each shard by
+// {id, encoded submission, encoded task description, number of results, subtest id, encoded result, ...}
+func (r *RDB) Shard(ctx context.Context, parent *base.JudgeSubmissionTask, shards []*base.JudgeSubmissionTask) error {
+	keys := []string{
+		leaseQueueKey,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+		contestPendingQueueKey,
+		practicePendingQueueKey,
+		rejudgePendingQueueKey,
+		shardsKey,
+		fencingKey,
+		pendingSinceKey,
+		shardsTotalKey,
+		pendingSignalKey,
+	}
+	args := []interface{}{parent.Id, parent.Lease.Token(), len(shards)}
+	for _, t := range shards {
+		shardArgs := enqueueArgs(t)
+		args = append(args, shardArgs[:3]...)
+		args = append(args, len(t.Results))
+		args = append(args, shardArgs[3:]...)
+	}
+	err := fencedResult(r.client.Eval(ctx, shardCmd, keys, args...))
+	if err == nil {
+		r.count(ctx, counterEnqueued, len(shards))
+	}
+	return err
+}
+
+const mergeShardCmd = grantTokenCmd + `
+	if ARGV[2] ~= "" then
+		if redis.call("HGET", KEYS[8], ARGV[1]) ~= ARGV[2] then
+			return 0
+		end
+	elseif redis.call("LREM", KEYS[6], 1, ARGV[1]) == 0 then
+		return -1
+	end
+	redis.call("HDEL", KEYS[8], ARGV[1])
+	redis.call("ZREM", KEYS[1], ARGV[1])
+	local results = redis.call("HGETALL", KEYS[4] .. ARGV[1])
+	for i = 1, #results, 2 do
+		redis.call("HSET", KEYS[4] .. ARGV[3], results[i], results[i+1])
+	end
+	redis.call("DEL", KEYS[2] .. ARGV[1], KEYS[3] .. ARGV[1], KEYS[4] .. ARGV[1])
+
+	if redis.call("HINCRBY", KEYS[5], ARGV[3], -1) > 0 then
+		return 1
+	end
+	redis.call("HDEL", KEYS[5], ARGV[3])
+	redis.call("HDEL", KEYS[7], ARGV[3])
+	local submission = redis.call("GET", KEYS[2] .. ARGV[3])
+	local task = redis.call("GET", KEYS[3] .. ARGV[3])
+	if not submission or not task then
+		return 1
+	end
+	redis.call("ZADD", KEYS[1], ARGV[4], ARGV[3])
+	return {submission, task, redis.call("HGETALL", KEYS[4] .. ARGV[3]), grant_token(ARGV[3])}
+`
+
+func (r *RDB) MergeShard(ctx context.Context, shard *base.JudgeSubmissionTask) (*base.JudgeSubmissionTask, error) {
+	keys := []string{
+		leaseQueueKey,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+		shardsKey,
+		deadLetterQueueKey,
+		shardsTotalKey,
+		fencingKey,
+		fencingCounterKey,
+	}
+	var token interface{} = ""
+	if shard.Lease != nil {
+		token = shard.Lease.Token()
+	}
+	leaseDeadline := time.Now().Add(base.DefaultLeaseDuration)
+	result, err := r.client.Eval(ctx, mergeShardCmd, keys, shard.Id, token, shard.ParentId, leaseDeadline.UnixMilli()).Result()
+	if err != nil {
+		return nil, err
+	}
+	if merged, ok := result.(int64); ok {
+		switch merged {
+		case 0:
+			return nil, ErrLeaseLost
+		case -1:
+			return nil, ErrTaskNotFound
+		}
+		return nil, nil
+	}
+	arr := result.([]interface{})
+	t, err := decodeTask(arr)
+	if err != nil {
+		return nil, err
+	}
+	t.Lease = base.NewLease(leaseDeadline, arr[3].(int64))
+	t.Mutex = &sync.Mutex{}
+	return t, nil
+}
+
+func (r *RDB) ListDeadLetters(ctx context.Context, offset, limit int) ([]string, error) {
+	// negative LRANGE indexes count from the tail
+	if offset < 0 || limit <= 0 {
+		return []string{}, nil
+	}
+	return r.client.LRange(ctx, deadLetterQueueKey, int64(offset), int64(offset+limit-1)).Result()
+}
+
+const getDeadLetterCmd = `
+	if not redis.call("LPOS", KEYS[1], ARGV[1]) then
+		return nil
+	end
+	local submission = redis.call("GET", KEYS[2] .. ARGV[1])
+	local task = redis.call("GET", KEYS[3] .. ARGV[1])
+	if not submission or not task then
+		return nil
+	end
+	return {submission, task, redis.call("HGETALL", KEYS[4] .. ARGV[1])}
+`
+
+func (r *RDB) GetDeadLetter(ctx context.Context, id string) (*base.JudgeSubmissionTask, error) {
+	keys := []string{
+		deadLetterQueueKey,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+	}
+	result, err := r.client.Eval(ctx, getDeadLetterCmd, keys, id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrTaskNotFound
+		}
+		return nil, err
+	}
+	return decodeTask(result.([]interface{}))
+}
+
+const redriveDeadLetterCmd = nowMsCmd + fairQueueCmd + pendingOfCmd + signalPendingCmd + `
+	if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
+		return nil
+	end
+	local submission = redis.call("GET", KEYS[2] .. ARGV[1])
+	local task = redis.call("GET", KEYS[3] .. ARGV[1])
+	if not submission or not task then
+		return nil
+	end
+	local t, header = decode_payload(task)
+	t["retried"] = 0
+	t["error"] = ""
+	t["final_verdict"] = 0
+	redis.call("SET", KEYS[3] .. ARGV[1], encode_payload(t, header))
+	redis.call("ZREM", KEYS[8], ARGV[1])
+	local q, route = pending_of(submission, KEYS[4], KEYS[5], KEYS[7])
+	fq_push(q, submission, ARGV[1], false)
+	redis.call("HSET", KEYS[6], ARGV[1], now_ms())
+	signal_pending(KEYS[#KEYS] .. route)
+	return "OK"
+`
+
+// RedriveDeadLetter puts a dead-lettered submission back to its pending queue with a fresh retry budget.
+func (r *RDB) RedriveDeadLetter(ctx context.Context, id string) error {
+	keys := []string{
+		deadLetterQueueKey,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		contestPendingQueueKey,
+		practicePendingQueueKey,
+		pendingSinceKey,
+		rejudgePendingQueueKey,
+		completedKey,
+		pendingSignalKey,
+	}
+	err := r.client.Eval(ctx, redriveDeadLetterCmd, keys, id).Err()
+	if err == redis.Nil {
+		return ErrTaskNotFound
+	}
+	if err == nil {
+		r.count(ctx, counterRedriven, 1)
+	}
+	return err
+}
+
+const cancelCmd = nowMsCmd + fairQueueCmd + pendingOfCmd + `
+	local submission = redis.call("GET", KEYS[1] .. ARGV[1])
+	local task = redis.call("GET", KEYS[2] .. ARGV[1])
+	if not submission or not task then
+		return nil
+	end
+	-- a shard is only cancelled with its parent
+	local s = decode_payload(submission)
+	if s["parent_id"] and s["parent_id"] ~= "" then
+		return nil
+	end
+	local shards = redis.call("HGET", KEYS[12], ARGV[1])
+	if shards then
+		-- the shards not merged yet are dropped, the judgers of leased ones see their lease lost
+		for k = 0, tonumber(shards) - 1 do
+			local id = ARGV[1] .. ":shard:" .. k -- base.ShardId
+			local shard = redis.call("GET", KEYS[1] .. id)
+			if shard then
+				fq_remove(pending_of(shard, KEYS[3], KEYS[4], KEYS[9]), shard, id)
+				redis.call("LREM", KEYS[6], 0, id)
+				redis.call("ZREM", KEYS[5], id)
+				redis.call("HDEL", KEYS[13], id)
+				redis.call("SREM", KEYS[7], id)
+				redis.call("HDEL", KEYS[8], id)
+				redis.call("DEL", KEYS[1] .. id, KEYS[2] .. id, KEYS[14] .. id)
+			end
+		end
+		redis.call("HDEL", KEYS[11], ARGV[1])
+		redis.call("HDEL", KEYS[12], ARGV[1])
+	elseif redis.call("ZSCORE", KEYS[5], ARGV[1]) then
+		redis.call("SADD", KEYS[7], ARGV[1])
+		return "leased"
+	else
+		local removed = fq_remove(pending_of(submission, KEYS[3], KEYS[4], KEYS[9]), submission, ARGV[1])
+		if not removed and redis.call("LREM", KEYS[6], 0, ARGV[1]) == 0 then
+			return nil
+		end
+	end
+	local t, header = decode_payload(task)
+	t["final_verdict"] = tonumber(ARGV[2])
+	task = encode_payload(t, header)
+	redis.call("SET", KEYS[2] .. ARGV[1], task)
+	redis.call("DEL", KEYS[1] .. ARGV[1])
+	redis.call("HDEL", KEYS[8], ARGV[1])
+	redis.call("ZADD", KEYS[10], now_ms(), ARGV[1])
+	return {"pending", task}
+`
+
+func (r *RDB) Cancel(ctx context.Context, id string) (bool, error) {
+	if err := r.migrateLegacyQueues(ctx); err != nil {
+		return false, err
+	}
+	keys := []string{
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		contestPendingQueueKey,
+		practicePendingQueueKey,
+		leaseQueueKey,
+		deadLetterQueueKey,
+		cancelledSetKey,
+		pendingSinceKey,
+		rejudgePendingQueueKey,
+		completedKey,
+		shardsKey,
+		shardsTotalKey,
+		fencingKey,
+		submissionResultPrefix,
+	}
+	reply, err := r.client.Eval(ctx, cancelCmd, keys, id, base.VerdictCancelled).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, ErrTaskNotFound
+		}
+		return false, err
+	}
+	return r.cancelled(ctx, id, reply), nil
+}
+
+// cancelled handles the reply of a cancel script: "leased", or the state and the task of a
+// submission removed before it was judged, whose final event is published here
+func (r *RDB) cancelled(ctx context.Context, id string, reply interface{}) bool {
+	if state, ok := reply.(string); ok {
+		return state == "leased"
+	}
+	r.count(ctx, counterCancelled, 1)
+	task := new(base.JudgeTaskDescription)
+	if err := task.Decode([]byte(reply.([]interface{})[1].(string))); err != nil {
+		fmt.Println("failed to decode cancelled submission", id, "cause by:", err)
+		return false
+	}
+	e := &base.ResultEvent{
+		Type:         base.EventFinal,
+		SubmissionId: id,
+		Task:         task,
+	}
+	if err := r.PublishEvent(ctx, e); err != nil {
+		fmt.Println("failed to publish final event of submission", id, "cause by:", err)
+	}
+	return false
+}
+
+const getSubmissionCmd = `
+	local task = redis.call("GET", KEYS[2] .. ARGV[1])
+	if not task then
+		return nil
+	end
+	return {redis.call("GET", KEYS[1] .. ARGV[1]) or "", task, redis.call("HGETALL", KEYS[3] .. ARGV[1])}
+`
+
+func (r *RDB) GetSubmission(ctx context.Context, id string) (*base.JudgeSubmissionTask, error) {
+	keys := []string{
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+	}
+	result, err := r.client.Eval(ctx, getSubmissionCmd, keys, id).Slice()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrTaskNotFound
+		}
+		return nil, err
+	}
+	if result[0] == "" {
+		// finished
+		result[0] = string((&base.SubmissionDescription{Id: id}).Encode())
+	}
+	return decodeTask(result)
+}
+
+func (r *RDB) Heartbeat(ctx context.Context, w *base.WorkerInfo) error {
+	w.LastHeartbeat = time.Now()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, workersKey, w.Id, w.Encode())
+		pipe.ZAdd(ctx, workerHeartbeatKey, redis.Z{Score: float64(w.LastHeartbeat.UnixMilli()), Member: w.Id})
+		return nil
+	})
+	return err
+}
+
+func (r *RDB) DeregisterWorker(ctx context.Context, id string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, workersKey, id)
+		pipe.ZRem(ctx, workerHeartbeatKey, id)
+		return nil
+	})
+	return err
+}
+
+const listWorkersCmd = `
+	local stale = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[1])
+	for _, id in ipairs(stale) do
+		redis.call("HDEL", KEYS[1], id)
+	end
+	redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[1])
+	return redis.call("HVALS", KEYS[1])
+`
+
+// ListWorkers also drops the workers which stopped without deregistering
+func (r *RDB) ListWorkers(ctx context.Context) ([]*base.WorkerInfo, error) {
+	oldest := time.Now().Add(-base.WorkerTTL).UnixMilli()
+	values, err := r.client.Eval(ctx, listWorkersCmd, []string{workersKey, workerHeartbeatKey}, oldest).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	workers := make([]*base.WorkerInfo, 0, len(values))
+	for _, v := range values {
+		w := new(base.WorkerInfo)
+		w.Decode([]byte(v))
+		workers = append(workers, w)
+	}
+	sortWorkers(workers)
+	return workers, nil
+}
+
+func sortWorkers(workers []*base.WorkerInfo) {
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Id < workers[j].Id
+	})
+}
+
+const claimIdempotencyKeyCmd = `
+	if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+		return ARGV[1]
+	end
+	return redis.call("GET", KEYS[1])
+`
+
+func (r *RDB) ClaimIdempotencyKey(ctx context.Context, key, id string, window time.Duration) (string, error) {
+	return r.client.Eval(ctx, claimIdempotencyKeyCmd, []string{idempotencyKeyPrefix + key}, id, window.Milliseconds()).Text()
+}
+
+const releaseIdempotencyKeyCmd = `
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		redis.call("DEL", KEYS[1])
+	end
+	return "OK"
+`
+
+func (r *RDB) ReleaseIdempotencyKey(ctx context.Context, key, id string) error {
+	return r.client.Eval(ctx, releaseIdempotencyKeyCmd, []string{idempotencyKeyPrefix + key}, id).Err()
+}
+
+// count adds n to a throughput counter, a failure is only logged since counters are informational
+func (r *RDB) count(ctx context.Context, counter string, n int) {
+	if n == 0 {
+		return
+	}
+	if err := r.client.HIncrBy(ctx, statsKey, counter, int64(n)).Err(); err != nil {
+		fmt.Println("failed to update counter", counter, "cause by:", err)
+	}
+}
+
+func (r *RDB) countRecovered(ctx context.Context, recovered *RecoverResult) {
+	r.count(ctx, counterRequeued, len(recovered.Requeued))
+	r.count(ctx, counterDeadLettered, len(recovered.DeadLettered))
+	r.count(ctx, counterCancelled, len(recovered.Cancelled))
+}
+
+// Stats sums the queues of every route
+func (r *RDB) Stats(ctx context.Context) (*Stats, error) {
+	stats := newStats()
+	routes, err := r.allRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	queues := map[string]string{
+		queueNameContest:  contestPendingQueueKey,
+		queueNamePractice: practicePendingQueueKey,
+		queueNameRejudge:  rejudgePendingQueueKey,
+	}
+	now := time.Now()
+	depths := make(map[string][]*redis.IntCmd)
+	oldest := make(map[string][]*redis.ZSliceCmd)
+	pipe := r.client.Pipeline()
+	for name, key := range queues {
+		for _, route := range routes {
+			since := key + routeSuffix(route) + ":since"
+			depths[name] = append(depths[name], pipe.ZCard(ctx, since))
+			oldest[name] = append(oldest[name], pipe.ZRangeWithScores(ctx, since, 0, 0))
+		}
+	}
+	inFlight := pipe.ZCard(ctx, leaseQueueKey)
+	expired := pipe.ZCount(ctx, leaseQueueKey, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	deadLetters := pipe.LLen(ctx, deadLetterQueueKey)
+	counters := pipe.HGetAll(ctx, statsKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	for name := range queues {
+		q := stats.Queues[name]
+		for _, depth := range depths[name] {
+			q.Depth += depth.Val()
+		}
+		for _, items := range oldest[name] {
+			if len(items.Val()) == 0 {
+				continue
+			}
+			if age := now.UnixMilli() - int64(items.Val()[0].Score); age > q.OldestAgeMs {
+				q.OldestAgeMs = age
+			}
+		}
+	}
+	stats.InFlight = inFlight.Val()
+	stats.ExpiredLeases = expired.Val()
+	stats.DeadLetters = deadLetters.Val()
+	for name, v := range counters.Val() {
+		stats.Counters[name], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return stats, nil
+}
+
+const markPersistedCmd = `
+	redis.call("ZREM", KEYS[1], ARGV[1])
+	-- a submission judged again keeps its keys until that judgement is persisted
+	if redis.call("EXISTS", KEYS[2] .. ARGV[1]) == 0 then
+		redis.call("PEXPIRE", KEYS[3] .. ARGV[1], ARGV[2])
+		redis.call("PEXPIRE", KEYS[4] .. ARGV[1], ARGV[2])
+	end
+	return "OK"
+`
+
+func (r *RDB) MarkPersisted(ctx context.Context, id string) error {
+	keys := []string{
+		completedKey,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+	}
+	return r.client.Eval(ctx, markPersistedCmd, keys, id, r.retention.Milliseconds()).Err()
+}
+
+const listUnpersistedCmd = payloadCmd + `
+	local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+	local tasks = {}
+	for _, id in ipairs(ids) do
+		local task = redis.call("GET", KEYS[3] .. id)
+		-- a dead-lettered submission keeps its verdict until it is redriven
+		if not task or (redis.call("EXISTS", KEYS[2] .. id) == 1 and (decode_payload(task)["final_verdict"] or 0) == 0) then
+			-- gone or judged again
+			redis.call("ZREM", KEYS[1], id)
+		else
+			table.insert(tasks, {cjson.encode({id = id}), task, redis.call("HGETALL", KEYS[4] .. id)})
+		end
+	end
+	return tasks
+`
+
+func (r *RDB) ListUnpersisted(ctx context.Context, before time.Time, limit int) ([]*base.JudgeSubmissionTask, error) {
+	keys := []string{
+		completedKey,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+	}
+	result, err := r.client.Eval(ctx, listUnpersistedCmd, keys, before.UnixMilli(), limit).Slice()
+	if err != nil {
+		return nil, err
+	}
+	var decodeErr error
+	tasks := make([]*base.JudgeSubmissionTask, 0, len(result))
+	for _, item := range result {
+		t, err := decodeTask(item.([]interface{}))
+		if err != nil {
+			decodeErr = err
+			continue
+		}
+		tasks = append(tasks, t)
 	}
-	return r.client.Eval(context.Background(), extendLeaseCmd, keys, args...).Err()
+	return tasks, decodeErr
 }
@@ -0,0 +1,435 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	luajson "github.com/alicebob/miniredis/v2/gopher-json"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// testRedis is a miniredis server, its clock only moves with advance so the idle time of the
+// stream entries can be aged
+type testRedis struct {
+	*miniredis.Miniredis
+	mu    sync.Mutex
+	clock time.Time
+}
+
+func (r *testRedis) advance(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = r.clock.Add(d)
+	r.SetTime(r.clock)
+}
+
+// newTestRedis returns a miniredis server and a client of it. miniredis has no cmsgpack so the
+// client runs the scripts itself with the same lua interpreter, see luaHook.
+func newTestRedis(t *testing.T) (*testRedis, *redis.Client) {
+	mr := miniredis.RunT(t)
+	r := &testRedis{Miniredis: mr, clock: time.Now()}
+	r.SetTime(r.clock)
+	options := func() *redis.Options {
+		return &redis.Options{Addr: mr.Addr(), Protocol: 2, DisableIndentity: true}
+	}
+	raw := redis.NewClient(options())
+	client := redis.NewClient(options())
+	client.AddHook(&luaHook{raw: raw})
+	t.Cleanup(func() {
+		client.Close()
+		raw.Close()
+	})
+	return r, client
+}
+
+// luaHook runs EVAL in gopher-lua with cjson and cmsgpack, redis.call goes to raw.
+// Scripts are serialized so they stay atomic with respect to each other.
+type luaHook struct {
+	raw *redis.Client
+	mu  sync.Mutex
+}
+
+func (h *luaHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *luaHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (h *luaHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() != "eval" {
+			return next(ctx, cmd)
+		}
+		args := make([]string, 0, len(cmd.Args()))
+		for _, arg := range cmd.Args()[1:] {
+			args = append(args, argString(arg))
+		}
+		val, err := h.eval(ctx, args)
+		c := cmd.(*redis.Cmd)
+		if err != nil {
+			c.SetErr(err)
+			return err
+		}
+		c.SetVal(val)
+		return nil
+	}
+}
+
+// argString formats a command argument like go-redis does
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case time.Duration:
+		return strconv.FormatInt(v.Nanoseconds(), 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// eval runs the script of the arguments of EVAL: script, numkeys, keys and argv
+func (h *luaHook) eval(ctx context.Context, args []string) (interface{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	l := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer l.Close()
+	for name, open := range map[string]lua.LGFunction{
+		lua.LoadLibName:   lua.OpenPackage,
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		l.Push(l.NewFunction(open))
+		l.Push(lua.LString(name))
+		l.Call(1, 0)
+	}
+	luajson.Preload(l)
+	if err := l.DoString(`cjson = require("json")`); err != nil {
+		return nil, err
+	}
+	l.SetGlobal("KEYS", stringTable(l, args[2:2+numKeys]))
+	l.SetGlobal("ARGV", stringTable(l, args[2+numKeys:]))
+	l.SetGlobal("redis", l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"call":  h.call(ctx, false),
+		"pcall": h.call(ctx, true),
+	}))
+	l.SetGlobal("cmsgpack", l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"pack":   luaPack,
+		"unpack": luaUnpack,
+	}))
+
+	fn, err := l.LoadString(args[0])
+	if err != nil {
+		return nil, err
+	}
+	l.Push(fn)
+	if err := l.PCall(0, 1, nil); err != nil {
+		return nil, err
+	}
+	return fromLua(l.Get(-1))
+}
+
+func stringTable(l *lua.LState, values []string) *lua.LTable {
+	t := l.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+func (h *luaHook) call(ctx context.Context, protected bool) lua.LGFunction {
+	return func(l *lua.LState) int {
+		args := make([]interface{}, 0, l.GetTop())
+		for i := 1; i <= l.GetTop(); i++ {
+			switch v := l.Get(i).(type) {
+			case lua.LString:
+				args = append(args, string(v))
+			case lua.LNumber:
+				args = append(args, numberString(v))
+			default:
+				l.RaiseError("Lua redis lib command arguments must be strings or integers")
+			}
+		}
+		reply, err := h.raw.Do(ctx, args...).Result()
+		if err == redis.Nil {
+			l.Push(lua.LFalse)
+			return 1
+		}
+		if err != nil {
+			if !protected {
+				l.RaiseError("%s", err.Error())
+			}
+			t := l.NewTable()
+			t.RawSetString("err", lua.LString(err.Error()))
+			l.Push(t)
+			return 1
+		}
+		l.Push(toLua(l, reply))
+		return 1
+	}
+}
+
+func numberString(n lua.LNumber) string {
+	f := float64(n)
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+// toLua converts a redis reply like redis does for redis.call
+func toLua(l *lua.LState, reply interface{}) lua.LValue {
+	switch v := reply.(type) {
+	case nil:
+		return lua.LFalse
+	case int64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		t := l.CreateTable(len(v), 0)
+		for _, item := range v {
+			t.Append(toLua(l, item))
+		}
+		return t
+	default:
+		l.RaiseError("unexpected reply %T", reply)
+		return lua.LNil
+	}
+}
+
+// fromLua converts the value returned by a script like redis does
+func fromLua(v lua.LValue) (interface{}, error) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return int64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LBool:
+		if v {
+			return int64(1), nil
+		}
+		return nil, redis.Nil
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return nil, errors.New(string(msg))
+		}
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return string(status), nil
+		}
+		arr := make([]interface{}, 0, v.Len())
+		// like redis the array stops at the first nil
+		for i := 1; v.RawGetInt(i) != lua.LNil; i++ {
+			item, err := fromLua(v.RawGetInt(i))
+			if err == redis.Nil {
+				item, err = nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, item)
+		}
+		return arr, nil
+	default:
+		return nil, redis.Nil
+	}
+}
+
+// luaPack is cmsgpack.pack: integral numbers are packed as integers and
+// tables with the keys 1..n, the empty one included, as arrays
+func luaPack(l *lua.LState) int {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	for i := 1; i <= l.GetTop(); i++ {
+		if err := packValue(enc, l.Get(i)); err != nil {
+			l.RaiseError("%s", err.Error())
+		}
+	}
+	l.Push(lua.LString(buf.String()))
+	return 1
+}
+
+func packValue(enc *msgpack.Encoder, v lua.LValue) error {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return enc.EncodeNil()
+	case lua.LBool:
+		return enc.EncodeBool(bool(v))
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return enc.EncodeInt(int64(f))
+		}
+		return enc.EncodeFloat64(f)
+	case lua.LString:
+		return enc.EncodeString(string(v))
+	case *lua.LTable:
+		if n := v.MaxN(); n == v.Len() && countFields(v) == n {
+			if err := enc.EncodeArrayLen(n); err != nil {
+				return err
+			}
+			for i := 1; i <= n; i++ {
+				if err := packValue(enc, v.RawGetInt(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := enc.EncodeMapLen(countFields(v)); err != nil {
+			return err
+		}
+		var err error
+		v.ForEach(func(key, value lua.LValue) {
+			if err == nil {
+				err = packValue(enc, key)
+			}
+			if err == nil {
+				err = packValue(enc, value)
+			}
+		})
+		return err
+	default:
+		return fmt.Errorf("cannot pack %s", v.Type())
+	}
+}
+
+func countFields(t *lua.LTable) int {
+	n := 0
+	t.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	return n
+}
+
+// luaUnpack is cmsgpack.unpack of a single value
+func luaUnpack(l *lua.LState) int {
+	dec := msgpack.NewDecoder(bytes.NewReader([]byte(l.CheckString(1))))
+	v, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		l.RaiseError("%s", err.Error())
+	}
+	l.Push(unpackValue(l, v))
+	return 1
+}
+
+func unpackValue(l *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case int8:
+		return lua.LNumber(v)
+	case int16:
+		return lua.LNumber(v)
+	case int32:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint8:
+		return lua.LNumber(v)
+	case uint16:
+		return lua.LNumber(v)
+	case uint32:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case float32:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(v)
+	case []interface{}:
+		t := l.CreateTable(len(v), 0)
+		for i, item := range v {
+			t.RawSetInt(i+1, unpackValue(l, item))
+		}
+		return t
+	case map[string]interface{}:
+		t := l.CreateTable(0, len(v))
+		for key, item := range v {
+			t.RawSetString(key, unpackValue(l, item))
+		}
+		return t
+	case map[interface{}]interface{}:
+		t := l.CreateTable(0, len(v))
+		for key, item := range v {
+			t.RawSet(unpackValue(l, key), unpackValue(l, item))
+		}
+		return t
+	default:
+		l.RaiseError("cannot unpack %T", v)
+		return lua.LNil
+	}
+}
+
+func TestRDB(t *testing.T) {
+	runBrokerSuite(t, func(t *testing.T) *testBroker {
+		mr, client := newTestRedis(t)
+		return &testBroker{Broker: NewRDB(client), advance: mr.advance}
+	})
+}
+
+func TestStreamRDB(t *testing.T) {
+	runBrokerSuite(t, func(t *testing.T) *testBroker {
+		mr, client := newTestRedis(t)
+		b, err := NewStreamRDB(context.Background(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &testBroker{Broker: b, advance: mr.advance}
+	})
+}
+
+// two stream judgers picking in turn follow one schedule, as RDB judgers do
+func TestStreamRDBSharedPasses(t *testing.T) {
+	_, client := newTestRedis(t)
+	var judgers []Broker
+	for i := 0; i < 2; i++ {
+		b, err := NewStreamRDB(context.Background(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SetSchedulePolicy(SchedulePolicy{ContestWeight: 3, PracticeWeight: 1})
+		judgers = append(judgers, b)
+	}
+	for i := 0; i < 6; i++ {
+		enqueue(t, judgers[0], newTestTask(fmt.Sprintf("c%d", i), "c1", "alice", 1), newTestTask(fmt.Sprintf("p%d", i), "", "bob", 1))
+	}
+	var order strings.Builder
+	for i := 0; i < 8; i++ {
+		order.WriteByte(strings.ToUpper(pick(t, judgers[i%2]).Id)[0])
+	}
+	if order.String() != "CCCPCCCP" {
+		t.Fatalf("picked %s, want CCCPCCCP", order.String())
+	}
+}
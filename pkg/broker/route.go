@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"sort"
+
+	"github.com/khoakmp/judgo/pkg/base"
+)
+
+// The pending queues, streams and signal lists are split by route, a judger only picks from
+// the routes it is set to. The keys of base.DefaultRoute have no suffix so they are the ones
+// used before routing, pendingOfCmd computes the same suffix in lua.
+const routeKeyInfix = ":r:"
+
+// DefaultRoutes are the routes of a broker whose routes are not set
+var DefaultRoutes = []string{base.DefaultRoute}
+
+func routeSuffix(route string) string {
+	if route == base.DefaultRoute {
+		return ""
+	}
+	return routeKeyInfix + route
+}
+
+func signalKeys(routes []string) []string {
+	keys := make([]string, 0, len(routes))
+	for _, route := range routes {
+		keys = append(keys, pendingSignalKey+routeSuffix(route))
+	}
+	return keys
+}
+
+// withDefaultRoute returns the sorted routes with base.DefaultRoute added if missing
+func withDefaultRoute(routes []string) []string {
+	all := append([]string{base.DefaultRoute}, routes...)
+	sort.Strings(all)
+	unique := all[:0]
+	for i, route := range all {
+		if i == 0 || route != all[i-1] {
+			unique = append(unique, route)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	queueContest  = 0
+	queuePractice = 1
+)
+
+// SchedulePolicy decides how judge capacity is shared between the contest and the practice queue
+// when both have pending submissions.
+type SchedulePolicy struct {
+	// relative number of picks of each queue, a zero weight gives strict priority to the other queue
+	ContestWeight  int
+	PracticeWeight int
+	// lower bound of the practice share of picks, from 0 to 1
+	MinPracticeShare float64
+	// a practice submission pending longer than this is picked before contest ones, 0 disables aging
+	PracticeAging time.Duration
+}
+
+var DefaultSchedulePolicy = SchedulePolicy{
+	ContestWeight:    4,
+	PracticeWeight:   1,
+	MinPracticeShare: 0.1,
+	PracticeAging:    time.Minute * 10,
+}
+
+// shares returns the fraction of picks given to each queue
+func (p SchedulePolicy) shares() (contest float64, practice float64) {
+	total := p.ContestWeight + p.PracticeWeight
+	if total <= 0 {
+		contest, practice = 1, 0
+	} else {
+		contest = float64(p.ContestWeight) / float64(total)
+		practice = 1 - contest
+	}
+	if practice < p.MinPracticeShare {
+		practice = p.MinPracticeShare
+		contest = 1 - practice
+	}
+	return
+}
+
+// steps returns how much the pass of each queue grows per pick, -1 when the queue has no share
+func (p SchedulePolicy) steps() [2]float64 {
+	contest, practice := p.shares()
+	steps := [2]float64{-1, -1}
+	if contest > 0 {
+		steps[queueContest] = 1 / contest
+	}
+	if practice > 0 {
+		steps[queuePractice] = 1 / practice
+	}
+	return steps
+}
+
+// scheduler is a stride scheduler between the two pending queues: the queue with
+// the lowest pass is picked and its pass grows by the inverse of its share.
+// pickSubmissionsCmd of RDB keeps the same logic in lua.
+type scheduler struct {
+	mu     sync.Mutex
+	policy SchedulePolicy
+	passes [2]float64
+}
+
+func newScheduler(policy SchedulePolicy) *scheduler {
+	return &scheduler{
+		policy: policy,
+	}
+}
+
+func (s *scheduler) setPolicy(policy SchedulePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+}
+
+// order returns the queues in the order they should be tried
+func (s *scheduler) order(contestPending, practicePending bool, practiceWait time.Duration) [2]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.orderLocked(contestPending, practicePending, practiceWait)
+}
+
+func (s *scheduler) orderLocked(contestPending, practicePending bool, practiceWait time.Duration) [2]int {
+	contestFirst := [2]int{queueContest, queuePractice}
+	practiceFirst := [2]int{queuePractice, queueContest}
+	if !practicePending {
+		return contestFirst
+	}
+	if !contestPending {
+		return practiceFirst
+	}
+	if s.policy.PracticeAging > 0 && practiceWait >= s.policy.PracticeAging {
+		return practiceFirst
+	}
+	steps := s.policy.steps()
+	if steps[queuePractice] < 0 {
+		return contestFirst
+	}
+	if steps[queueContest] < 0 {
+		return practiceFirst
+	}
+	if s.passes[queuePractice]+steps[queuePractice] < s.passes[queueContest]+steps[queueContest] {
+		return practiceFirst
+	}
+	return contestFirst
+}
+
+// served records a pick from queue q, when the other queue is empty its pass catches up
+// so it does not get a burst of picks once it has pending submissions again
+func (s *scheduler) served(q int, otherPending bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servedLocked(q, otherPending)
+}
+
+func (s *scheduler) servedLocked(q int, otherPending bool) {
+	if step := s.policy.steps()[q]; step > 0 {
+		s.passes[q] += step
+	}
+	other := 1 - q
+	if !otherPending && s.passes[other] < s.passes[q] {
+		s.passes[other] = s.passes[q]
+	}
+}
+
+// plan splits n picks between the queues as if both had enough pending submissions
+// and records them as served, aging only promotes the first pick
+func (s *scheduler) plan(n int, practiceWait time.Duration) [2]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var quota [2]int
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			practiceWait = 0
+		}
+		q := s.orderLocked(true, true, practiceWait)[0]
+		s.servedLocked(q, true)
+		quota[q]++
+	}
+	return quota
+}
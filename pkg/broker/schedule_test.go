@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulePolicyShares(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   SchedulePolicy
+		contest  float64
+		practice float64
+	}{
+		{"weights", SchedulePolicy{ContestWeight: 4, PracticeWeight: 1}, 0.8, 0.2},
+		{"equal weights", SchedulePolicy{ContestWeight: 1, PracticeWeight: 1}, 0.5, 0.5},
+		{"min practice share raises practice", SchedulePolicy{ContestWeight: 9, PracticeWeight: 1, MinPracticeShare: 0.25}, 0.75, 0.25},
+		{"min practice share below weights", SchedulePolicy{ContestWeight: 1, PracticeWeight: 1, MinPracticeShare: 0.1}, 0.5, 0.5},
+		{"contest only", SchedulePolicy{ContestWeight: 1}, 1, 0},
+		{"practice only", SchedulePolicy{PracticeWeight: 1}, 0, 1},
+		{"no weights", SchedulePolicy{}, 1, 0},
+		{"no weights with min practice share", SchedulePolicy{MinPracticeShare: 0.5}, 0.5, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contest, practice := tt.policy.shares()
+			if math.Abs(contest-tt.contest) > 1e-9 || math.Abs(practice-tt.practice) > 1e-9 {
+				t.Fatalf("shares %v %v, want %v %v", contest, practice, tt.contest, tt.practice)
+			}
+		})
+	}
+}
+
+// picks returns the queues a scheduler picks from when both always have pending submissions,
+// C for contest and P for practice
+func picks(s *scheduler, n int, practiceWait time.Duration) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		q := s.order(true, true, practiceWait)[0]
+		s.served(q, true)
+		b.WriteByte("CP"[q])
+	}
+	return b.String()
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SchedulePolicy
+		want   string
+	}{
+		{"weights 3:1", SchedulePolicy{ContestWeight: 3, PracticeWeight: 1}, "CCCPCCCP"},
+		{"weights 4:1", SchedulePolicy{ContestWeight: 4, PracticeWeight: 1}, "CCCCPCCCCP"},
+		{"equal weights", SchedulePolicy{ContestWeight: 1, PracticeWeight: 1}, "CPCPCP"},
+		{"min practice share", SchedulePolicy{ContestWeight: 1, MinPracticeShare: 0.25}, "CCCPCCCP"},
+		{"strict contest priority", SchedulePolicy{ContestWeight: 1}, "CCCCCC"},
+		{"strict practice priority", SchedulePolicy{PracticeWeight: 1}, "PPPPPP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := picks(newScheduler(tt.policy), len(tt.want), 0); got != tt.want {
+				t.Fatalf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerAging(t *testing.T) {
+	policy := SchedulePolicy{ContestWeight: 1, PracticeAging: time.Minute}
+	tests := []struct {
+		name string
+		wait time.Duration
+		want string
+	}{
+		{"fresh practice", time.Second, "CCC"},
+		{"aged practice", time.Minute, "PPP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := picks(newScheduler(policy), len(tt.want), tt.wait); got != tt.want {
+				t.Fatalf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	disabled := SchedulePolicy{ContestWeight: 1}
+	if got := picks(newScheduler(disabled), 3, time.Hour); got != "CCC" {
+		t.Fatalf("picked %s with aging disabled", got)
+	}
+}
+
+func TestSchedulerOneQueuePending(t *testing.T) {
+	s := newScheduler(SchedulePolicy{ContestWeight: 1, PracticeWeight: 1})
+	if q := s.order(false, true, 0)[0]; q != queuePractice {
+		t.Fatal("contest picked while empty")
+	}
+	if q := s.order(true, false, 0)[0]; q != queueContest {
+		t.Fatal("practice picked while empty")
+	}
+
+	// a queue left empty catches up, it gets no burst of picks once it has pending submissions again
+	for i := 0; i < 10; i++ {
+		s.served(queueContest, false)
+	}
+	if got := picks(s, 4, 0); got != "PCPC" && got != "CPCP" {
+		t.Fatalf("picked %s after practice was empty", got)
+	}
+}
+
+func TestSchedulerPlan(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SchedulePolicy
+		n      int
+		wait   time.Duration
+		want   [2]int
+	}{
+		{"weights 4:1", SchedulePolicy{ContestWeight: 4, PracticeWeight: 1}, 10, 0, [2]int{8, 2}},
+		{"min practice share", SchedulePolicy{ContestWeight: 1, MinPracticeShare: 0.5}, 6, 0, [2]int{3, 3}},
+		{"aging promotes the first pick only", SchedulePolicy{ContestWeight: 1, PracticeAging: time.Minute}, 3, time.Hour, [2]int{2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newScheduler(tt.policy).plan(tt.n, tt.wait); got != tt.want {
+				t.Fatalf("plan %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,966 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	contestPendingStreamKey  = appPrefix + "contest:pending:stream"
+	practicePendingStreamKey = appPrefix + "practice:pending:stream"
+	rejudgePendingStreamKey  = appPrefix + "rejudge:pending:stream"
+	streamEntriesKey         = appPrefix + "stream:entries" // hash: submission id -> stream entry id
+	streamGroup              = "judgers"
+)
+
+// StreamRDB is a Broker on redis streams. The pending entries list of the consumer group
+// replaces the lease queue: a lease is an entry delivered but not acked, extending it
+// resets the idle time, an expired lease is an entry idle longer than DefaultLeaseDuration
+// which is taken over by the next PickOneSubmission through XAUTOCLAIM, and the delivery
+// count of the entry is the number of retries.
+// Submission, task, result and schedule keys are shared with RDB. Each stream is FIFO, the fair
+// queuing per contest and per user of RDB and Memory is not available, and neither is sharding.
+type StreamRDB struct {
+	*RDB
+	consumer string
+	mu       sync.Mutex
+	entries  map[string]streamEntry // submission id -> delivered entry
+}
+
+type streamEntry struct {
+	stream  string
+	entryId string
+	token   int64 // fencing token of the delivery
+}
+
+// entryOf returns the delivered entry of t, a judger whose lease was granted again to another
+// pick of this process has none
+func (r *StreamRDB) entryOf(t *base.JudgeSubmissionTask) (streamEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[t.Id]
+	return entry, ok && entry.token == t.Lease.Token()
+}
+
+// forget drops the delivered entry of a submission unless it was delivered again since token
+func (r *StreamRDB) forget(id string, token int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.entries[id]; ok && entry.token == token {
+		delete(r.entries, id)
+	}
+}
+
+var _ Broker = (*StreamRDB)(nil)
+
+func NewStreamRDB(ctx context.Context, client *redis.Client) (*StreamRDB, error) {
+	if err := createGroups(ctx, client, routeStreams(base.DefaultRoute)); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &StreamRDB{
+		RDB:      NewRDB(client),
+		consumer: fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.New().String()[:8]),
+		entries:  make(map[string]streamEntry),
+	}, nil
+}
+
+func createGroups(ctx context.Context, client *redis.Client, streams []string) error {
+	for _, stream := range streams {
+		err := client.XGroupCreateMkStream(ctx, stream, streamGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeStreams returns the contest, practice and rejudge streams of a route
+func routeStreams(route string) []string {
+	suffix := routeSuffix(route)
+	return []string{
+		contestPendingStreamKey + suffix,
+		practicePendingStreamKey + suffix,
+		rejudgePendingStreamKey + suffix,
+	}
+}
+
+// registerRoute creates the consumer group on the streams of route before adding it to the routes set,
+// so recovery and Stats never meet a stream without the group
+func (r *StreamRDB) registerRoute(ctx context.Context, route string) error {
+	r.routesMu.Lock()
+	registered := r.registered[route]
+	r.routesMu.Unlock()
+	if registered {
+		return nil
+	}
+	if err := createGroups(ctx, r.client, routeStreams(route)); err != nil {
+		return err
+	}
+	return r.RDB.registerRoute(ctx, route)
+}
+
+type pendingStream struct {
+	queue  string
+	stream string
+}
+
+// allStreams returns the pending streams of every route with the name of their queue
+func (r *StreamRDB) allStreams(ctx context.Context) ([]pendingStream, error) {
+	routes, err := r.allRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{queueNameContest, queueNamePractice, queueNameRejudge}
+	streams := make([]pendingStream, 0, len(routes)*len(names))
+	for _, route := range routes {
+		for i, stream := range routeStreams(route) {
+			streams = append(streams, pendingStream{queue: names[i], stream: stream})
+		}
+	}
+	return streams, nil
+}
+
+func pendingStreamKey(s *base.SubmissionDescription) string {
+	suffix := routeSuffix(s.Route())
+	if s.RejudgeId != "" {
+		return rejudgePendingStreamKey + suffix
+	}
+	if s.InContest {
+		return contestPendingStreamKey + suffix
+	}
+	return practicePendingStreamKey + suffix
+}
+
+const streamEnqueueCmd = signalPendingCmd + `
+	if redis.call("EXISTS", KEYS[1] .. ARGV[1]) == 1 then
+		return 0
+	end
+	redis.call("SET", KEYS[1] .. ARGV[1], ARGV[2])
+	redis.call("SET", KEYS[2] .. ARGV[1], ARGV[3])
+	local entry = redis.call("XADD", KEYS[4], "*", "id", ARGV[1])
+	redis.call("HSET", KEYS[5], ARGV[1], entry)
+
+	-- a rejudge starts from empty results
+	redis.call("DEL", KEYS[3] .. ARGV[1])
+	for i=4,#ARGV,2 do
+		redis.call("HSET", KEYS[3] .. ARGV[1], ARGV[i], ARGV[i+1])
+	end
+	signal_pending(KEYS[#KEYS])
+	return 1
+`
+
+func (r *StreamRDB) Enqueue(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	if err := r.registerRoute(ctx, t.Route()); err != nil {
+		return err
+	}
+	keys := []string{
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+		pendingStreamKey(t.SubmissionDescription),
+		streamEntriesKey,
+		pendingSignalKey + routeSuffix(t.Route()),
+	}
+	return r.enqueued(ctx, r.client.Eval(ctx, streamEnqueueCmd, keys, enqueueArgs(t)...))
+}
+
+const loadTaskCmd = grantTokenCmd + `
+	local submission = redis.call("GET", KEYS[1] .. ARGV[1])
+	local task = redis.call("GET", KEYS[2] .. ARGV[1])
+	if not submission or not task then
+		return nil
+	end
+	return {submission, task, redis.call("HGETALL", KEYS[3] .. ARGV[1]), grant_token(ARGV[1])}
+`
+
+func (r *StreamRDB) PickOneSubmission() (*base.JudgeSubmissionTask, *time.Time, error) {
+	tasks, err := r.PickSubmissions(context.Background(), 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, nil, ErrQueueEmpty
+	}
+	leaseDeadline := tasks[0].Lease.Deadline()
+	return tasks[0], &leaseDeadline, nil
+}
+
+// PickSubmissions leases up to n submissions from the routes of this judger, in each route
+// split between the streams by the schedule policy, the rejudge stream only fills what
+// both others could not.
+// The tasks already leased are returned together with the error if a later read fails.
+func (r *StreamRDB) PickSubmissions(ctx context.Context, n int) ([]*base.JudgeSubmissionTask, error) {
+	tasks := make([]*base.JudgeSubmissionTask, 0, n)
+	var err error
+	first := int(r.nextRoute.Add(1))
+	for i := range r.routes {
+		if len(tasks) == n {
+			break
+		}
+		var picked []*base.JudgeSubmissionTask
+		picked, err = r.pickRoute(ctx, r.routes[(first+i)%len(r.routes)], n-len(tasks))
+		tasks = append(tasks, picked...)
+		if err != nil {
+			break
+		}
+	}
+	r.count(ctx, counterPicked, len(tasks))
+	return tasks, err
+}
+
+func (r *StreamRDB) pickRoute(ctx context.Context, route string, n int) ([]*base.JudgeSubmissionTask, error) {
+	// the groups of a route no submission was enqueued on yet
+	if err := r.registerRoute(ctx, route); err != nil {
+		return nil, err
+	}
+	streams := routeStreams(route)
+	practiceWait, err := r.practiceWait(ctx, streams[queuePractice])
+	if err != nil {
+		return nil, err
+	}
+	quota, err := r.plan(ctx, n, practiceWait)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]*base.JudgeSubmissionTask, 0, n)
+	for _, q := range [2]int{queueContest, queuePractice} {
+		picked, err := r.pickFrom(ctx, streams[q], quota[q])
+		tasks = append(tasks, picked...)
+		if err != nil {
+			return tasks, err
+		}
+	}
+	// one stream had less than its quota, fill up from the other one
+	for _, q := range [2]int{queueContest, queuePractice} {
+		if len(tasks) == n {
+			break
+		}
+		picked, err := r.pickFrom(ctx, streams[q], n-len(tasks))
+		tasks = append(tasks, picked...)
+		if err != nil {
+			return tasks, err
+		}
+		if err := r.served(ctx, q, len(picked)); err != nil {
+			return tasks, err
+		}
+	}
+	if len(tasks) < n {
+		picked, err := r.pickFrom(ctx, streams[2], n-len(tasks))
+		tasks = append(tasks, picked...)
+		if err != nil {
+			return tasks, err
+		}
+	}
+	return tasks, nil
+}
+
+// same logic as scheduler.plan on the passes RDB keeps at KEYS[1], ARGV[4] is 1 when the
+// oldest practice entry waited longer than the aging of the policy
+const streamPlanCmd = `
+	local names = {"contest", "practice"}
+	local steps = {tonumber(ARGV[2]), tonumber(ARGV[3])}
+	local quota = {0, 0}
+	for i=1,tonumber(ARGV[1]) do
+		local q = 1
+		if i == 1 and ARGV[4] == "1" then
+			q = 2
+		elseif steps[2] < 0 then
+			q = 1
+		elseif steps[1] < 0 then
+			q = 2
+		else
+			local cpass = tonumber(redis.call("HGET", KEYS[1], names[1]) or "0")
+			local ppass = tonumber(redis.call("HGET", KEYS[1], names[2]) or "0")
+			if ppass + steps[2] < cpass + steps[1] then
+				q = 2
+			end
+		end
+		if steps[q] > 0 then
+			redis.call("HINCRBYFLOAT", KEYS[1], names[q], steps[q])
+		end
+		quota[q] = quota[q] + 1
+	end
+	return quota
+`
+
+// plan splits n picks between the contest and practice streams and records them as served
+func (r *StreamRDB) plan(ctx context.Context, n int, practiceWait time.Duration) ([2]int, error) {
+	var quota [2]int
+	steps := r.policy.steps()
+	aged := 0
+	if r.policy.PracticeAging > 0 && practiceWait >= r.policy.PracticeAging {
+		aged = 1
+	}
+	result, err := r.client.Eval(ctx, streamPlanCmd, []string{scheduleKey}, n, steps[queueContest], steps[queuePractice], aged).Int64Slice()
+	if err != nil {
+		return quota, err
+	}
+	quota[queueContest], quota[queuePractice] = int(result[0]), int(result[1])
+	return quota, nil
+}
+
+// same logic as scheduler.served for picks from queue ARGV[1] while the other one was empty
+const streamServedCmd = `
+	local names = {"contest", "practice"}
+	local q = tonumber(ARGV[1])
+	local step = tonumber(ARGV[3])
+	if step > 0 then
+		redis.call("HINCRBYFLOAT", KEYS[1], names[q], step * tonumber(ARGV[2]))
+	end
+	local pass = tonumber(redis.call("HGET", KEYS[1], names[q]) or "0")
+	local other_pass = tonumber(redis.call("HGET", KEYS[1], names[3 - q]) or "0")
+	if other_pass < pass then
+		redis.call("HSET", KEYS[1], names[3 - q], pass)
+	end
+	return 0
+`
+
+// served records n picks from queue q which filled up what the other queue could not
+func (r *StreamRDB) served(ctx context.Context, q, n int) error {
+	if n == 0 {
+		return nil
+	}
+	return r.client.Eval(ctx, streamServedCmd, []string{scheduleKey}, q+1, n, r.policy.steps()[q]).Err()
+}
+
+func (r *StreamRDB) pickFrom(ctx context.Context, stream string, n int) ([]*base.JudgeSubmissionTask, error) {
+	tasks := make([]*base.JudgeSubmissionTask, 0, n)
+	for len(tasks) < n {
+		msgs, retried, err := r.readEntries(ctx, stream, n-len(tasks))
+		if err != nil {
+			return tasks, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		for i := range msgs {
+			t, err := r.deliver(ctx, stream, &msgs[i], retried[msgs[i].ID])
+			if err != nil {
+				return tasks, err
+			}
+			if t != nil {
+				tasks = append(tasks, t)
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// practiceWait returns how long the oldest undelivered entry of a practice stream has been pending
+func (r *StreamRDB) practiceWait(ctx context.Context, stream string) (time.Duration, error) {
+	if r.RDB.policy.PracticeAging <= 0 {
+		return 0, nil
+	}
+	group, err := r.groupInfo(ctx, stream)
+	if err != nil {
+		return 0, err
+	}
+	return r.oldestUndelivered(ctx, stream, group.LastDeliveredID)
+}
+
+func (r *StreamRDB) groupInfo(ctx context.Context, stream string) (redis.XInfoGroup, error) {
+	groups, err := r.client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return redis.XInfoGroup{}, err
+	}
+	for _, g := range groups {
+		if g.Name == streamGroup {
+			return g, nil
+		}
+	}
+	return redis.XInfoGroup{LastDeliveredID: "0-0"}, nil
+}
+
+// oldestUndelivered returns the age of the first entry after lastDeliveredId, 0 if there is none.
+// The entry id starts with the unix ms it was added at
+func (r *StreamRDB) oldestUndelivered(ctx context.Context, stream, lastDeliveredId string) (time.Duration, error) {
+	msgs, err := r.client.XRangeN(ctx, stream, "("+lastDeliveredId, "+", 1).Result()
+	if err != nil || len(msgs) == 0 {
+		return 0, err
+	}
+	ms, err := strconv.ParseInt(strings.SplitN(msgs[0].ID, "-", 2)[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(time.UnixMilli(ms)), nil
+}
+
+// BlockingPickOneSubmission waits up to timeout for a submission. Entries whose lease
+// expired do not signal, they are taken over by the next pick after the wait.
+func (r *StreamRDB) BlockingPickOneSubmission(ctx context.Context, timeout time.Duration) (*base.JudgeSubmissionTask, *time.Time, error) {
+	return blockingPick(ctx, r.client, signalKeys(r.routes), timeout, r.PickOneSubmission)
+}
+
+// readEntries first takes over entries whose lease expired, then reads new ones.
+// It also returns the retried count of the taken over entries by entry id.
+func (r *StreamRDB) readEntries(ctx context.Context, stream string, n int) ([]redis.XMessage, map[string]int, error) {
+	retried := make(map[string]int)
+	claimed, _, err := r.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   stream,
+		Group:    streamGroup,
+		MinIdle:  base.DefaultLeaseDuration,
+		Start:    "0-0",
+		Count:    int64(n),
+		Consumer: r.consumer,
+	}).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(claimed) > 0 {
+		pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  streamGroup,
+			Start:  claimed[0].ID,
+			End:    claimed[len(claimed)-1].ID,
+			Count:  int64(n),
+		}).Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range pending {
+			retried[p.ID] = int(p.RetryCount) - 1
+		}
+		r.count(ctx, counterRequeued, len(claimed))
+		return claimed, retried, nil
+	}
+
+	streams, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    streamGroup,
+		Consumer: r.consumer,
+		Streams:  []string{stream, ">"},
+		Count:    int64(n),
+		Block:    -1,
+	}).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, retried, nil
+		}
+		return nil, nil, err
+	}
+	if len(streams) == 0 {
+		return nil, retried, nil
+	}
+	return streams[0].Messages, retried, nil
+}
+
+// deliver loads the task of a delivered entry, entries whose task no longer exists are dropped
+func (r *StreamRDB) deliver(ctx context.Context, stream string, msg *redis.XMessage, retried int) (*base.JudgeSubmissionTask, error) {
+	id, _ := msg.Values["id"].(string)
+	keys := []string{
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		submissionResultPrefix,
+		fencingKey,
+		fencingCounterKey,
+	}
+	result, err := r.client.Eval(ctx, loadTaskCmd, keys, id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, r.ack(ctx, stream, msg.ID)
+		}
+		return nil, err
+	}
+	arr := result.([]interface{})
+	t, err := decodeTask(arr)
+	if err != nil {
+		// left pending, it is dead-lettered once it used up its retries
+		return nil, fmt.Errorf("submission %s: %w", id, err)
+	}
+	if retried > t.Retried {
+		t.Retried = retried
+	}
+	t.Lease = base.NewLease(time.Now().Add(base.DefaultLeaseDuration), arr[3].(int64))
+	t.Mutex = &sync.Mutex{}
+
+	r.mu.Lock()
+	r.entries[id] = streamEntry{stream: stream, entryId: msg.ID, token: t.Lease.Token()}
+	r.mu.Unlock()
+	return t, nil
+}
+
+func (r *StreamRDB) ack(ctx context.Context, stream, entryId string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, stream, streamGroup, entryId)
+		pipe.XDel(ctx, stream, entryId)
+		return nil
+	})
+	return err
+}
+
+const streamCompleteJudgeSubmissionTaskCmd = nowMsCmd + `
+	if redis.call("HGET", KEYS[6], ARGV[4]) ~= ARGV[7] then
+		return 0
+	end
+	redis.call("SET", KEYS[1], ARGV[1])
+	redis.call("DEL", KEYS[2])
+	redis.call("XACK", KEYS[3], ARGV[2], ARGV[3])
+	redis.call("XDEL", KEYS[3], ARGV[3])
+	redis.call("HDEL", KEYS[4], ARGV[4])
+	redis.call("SREM", KEYS[5], ARGV[4])
+	redis.call("HDEL", KEYS[6], ARGV[4])
+	redis.call("ZADD", KEYS[7], now_ms(), ARGV[4])
+	redis.call("PUBLISH", ARGV[5], ARGV[6])
+	return 1
+`
+
+func (r *StreamRDB) CompleteJudgeSubmissionTask(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	entry, ok := r.entryOf(t)
+	if !ok {
+		return ErrLeaseLost
+	}
+	keys := []string{
+		fmt.Sprintf("%s%s", judgeTaskKeyPrefix, t.Id),
+		fmt.Sprintf("%s%s", submissionKeyPrefix, t.Id),
+		entry.stream,
+		streamEntriesKey,
+		cancelledSetKey,
+		fencingKey,
+		completedKey,
+	}
+	args := []interface{}{
+		t.JudgeTaskDescription.Encode(),
+		streamGroup,
+		entry.entryId,
+		t.Id,
+		eventChannelPrefix + t.Id,
+		finalEvent(t).Encode(),
+		t.Lease.Token(),
+	}
+	err := fencedResult(r.client.Eval(ctx, streamCompleteJudgeSubmissionTaskCmd, keys, args...))
+	if err != nil && err != ErrLeaseLost {
+		return err
+	}
+	r.forget(t.Id, t.Lease.Token())
+	if err == nil {
+		r.count(ctx, counterCompleted, 1)
+	}
+	return err
+}
+
+// ExtendLease resets the idle time of the delivered entries, the lease always lasts
+// DefaultLeaseDuration from the call since the idle time is measured by redis.
+// Entries claimed by another judger since they were delivered are reported as lost.
+func (r *StreamRDB) ExtendLease(leases map[string]int64, deadline time.Time) ([]string, []string, error) {
+	cancelled := make([]string, 0)
+	lost := make([]string, 0)
+	if len(leases) == 0 {
+		return cancelled, lost, nil
+	}
+	ctx := context.Background()
+	ids := make([]string, 0, len(leases))
+	for id := range leases {
+		ids = append(ids, id)
+	}
+	tokens, err := r.client.HMGet(ctx, fencingKey, ids...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	held := make([]interface{}, 0, len(ids))
+	messages := make(map[string][]string)
+	r.mu.Lock()
+	for i, id := range ids {
+		token, _ := tokens[i].(string)
+		if token != strconv.FormatInt(leases[id], 10) {
+			lost = append(lost, id)
+			if entry, ok := r.entries[id]; ok && entry.token == leases[id] {
+				delete(r.entries, id)
+			}
+			continue
+		}
+		held = append(held, id)
+		if entry, ok := r.entries[id]; ok {
+			messages[entry.stream] = append(messages[entry.stream], entry.entryId)
+		}
+	}
+	r.mu.Unlock()
+
+	for stream, entryIds := range messages {
+		err := r.client.XClaimJustID(ctx, &redis.XClaimArgs{
+			Stream:   stream,
+			Group:    streamGroup,
+			Consumer: r.consumer,
+			MinIdle:  0,
+			Messages: entryIds,
+		}).Err()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(held) == 0 {
+		return cancelled, lost, nil
+	}
+	flags, err := r.client.SMIsMember(ctx, cancelledSetKey, held...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, flag := range flags {
+		if flag {
+			cancelled = append(cancelled, held[i].(string))
+		}
+	}
+	return cancelled, lost, nil
+}
+
+const streamReleaseCmd = signalPendingCmd + `
+	if redis.call("HGET", KEYS[2], ARGV[1]) ~= ARGV[2] then
+		return 0
+	end
+	redis.call("HDEL", KEYS[2], ARGV[1])
+	local pending = redis.call("XPENDING", KEYS[1], ARGV[3], ARGV[4], ARGV[4], 1)
+	if #pending == 0 then
+		return -1
+	end
+	-- idle for a whole lease so the next pick takes it over before reading new entries,
+	-- the delivery count is lowered since the take over increases it again
+	redis.call("XCLAIM", KEYS[1], ARGV[3], pending[1][2], 0, ARGV[4],
+		"IDLE", ARGV[5], "RETRYCOUNT", math.max(pending[1][4] - 1, 0), "JUSTID")
+	signal_pending(KEYS[#KEYS])
+	return 1
+`
+
+// Release makes the delivered entry of t look like an expired lease, so it is taken over
+// by the next pick without counting as a retry.
+func (r *StreamRDB) Release(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	entry, ok := r.entryOf(t)
+	if !ok {
+		return ErrLeaseLost
+	}
+	keys := []string{
+		entry.stream,
+		fencingKey,
+		pendingSignalKey + routeSuffix(t.Route()),
+	}
+	args := []interface{}{
+		t.Id,
+		t.Lease.Token(),
+		streamGroup,
+		entry.entryId,
+		base.DefaultLeaseDuration.Milliseconds(),
+	}
+	released, err := r.client.Eval(ctx, streamReleaseCmd, keys, args...).Int()
+	if err != nil {
+		return err
+	}
+	r.forget(t.Id, t.Lease.Token())
+	switch released {
+	case 0:
+		return ErrLeaseLost
+	case -1:
+		return ErrTaskNotFound
+	}
+	r.count(ctx, counterReleased, 1)
+	return nil
+}
+
+// Shard is not supported with streams, the lease of the parent is its stream entry and
+// the parent could not be leased again once its last shard is merged.
+func (r *StreamRDB) Shard(ctx context.Context, parent *base.JudgeSubmissionTask, shards []*base.JudgeSubmissionTask) error {
+	return ErrShardingUnsupported
+}
+
+func (r *StreamRDB) MergeShard(ctx context.Context, shard *base.JudgeSubmissionTask) (*base.JudgeSubmissionTask, error) {
+	return nil, ErrShardingUnsupported
+}
+
+const streamDeadLetterCmd = payloadCmd + subtestErrorCmd + nowMsCmd + `
+	local pending = redis.call("XPENDING", KEYS[1], ARGV[1], "IDLE", ARGV[2], ARGV[3], ARGV[3], 1)
+	if #pending == 0 then
+		return nil
+	end
+	local entry = redis.call("XRANGE", KEYS[1], ARGV[3], ARGV[3])
+	if #entry == 0 then
+		redis.call("XACK", KEYS[1], ARGV[1], ARGV[3])
+		return nil
+	end
+	local id = entry[1][2][2]
+	local task = redis.call("GET", KEYS[2] .. id)
+	if not task then
+		redis.call("XACK", KEYS[1], ARGV[1], ARGV[3])
+		redis.call("XDEL", KEYS[1], ARGV[3])
+		return nil
+	end
+	local t, header = decode_payload(task)
+	if redis.call("SREM", KEYS[5], id) == 1 then
+		t["final_verdict"] = tonumber(ARGV[4])
+		redis.call("SET", KEYS[2] .. id, encode_payload(t, header))
+		redis.call("DEL", KEYS[6] .. id)
+		redis.call("XACK", KEYS[1], ARGV[1], ARGV[3])
+		redis.call("XDEL", KEYS[1], ARGV[3])
+		redis.call("HDEL", KEYS[4], id)
+		redis.call("HDEL", KEYS[7], id)
+		redis.call("ZADD", KEYS[8], now_ms(), id)
+		return {2, id}
+	end
+	if pending[1][4] <= (t["max_retry"] or 0) then
+		return {0, id}
+	end
+	t["retried"] = pending[1][4]
+	if t["error"] == nil or t["error"] == "" then
+		t["error"] = lease_expired_error(t["retried"], KEYS[9] .. id)
+	end
+	-- persisted by the recoverer, or by the sweeper if that fails
+	t["final_verdict"] = tonumber(ARGV[5])
+	redis.call("ZADD", KEYS[8], now_ms(), id)
+	redis.call("SET", KEYS[2] .. id, encode_payload(t, header))
+	redis.call("XACK", KEYS[1], ARGV[1], ARGV[3])
+	redis.call("XDEL", KEYS[1], ARGV[3])
+	redis.call("HDEL", KEYS[4], id)
+	redis.call("HDEL", KEYS[7], id)
+	redis.call("RPUSH", KEYS[3], id)
+	return {1, id}
+`
+
+// RecoverExpiredLeases only moves entries which exhausted MaxRetry to the dead-letter queue
+// and finalizes cancelled ones, the others stay in the pending entries list until a judger
+// claims them. The idle time is measured by redis, so now is not used.
+func (r *StreamRDB) RecoverExpiredLeases(ctx context.Context, now time.Time) (*RecoverResult, error) {
+	recovered := &RecoverResult{
+		Requeued:     make([]string, 0),
+		DeadLettered: make([]string, 0),
+		Cancelled:    make([]string, 0),
+	}
+	// requeued entries are only taken over later, they are not counted as requeued again on every call
+	defer func() {
+		r.count(ctx, counterDeadLettered, len(recovered.DeadLettered))
+		r.count(ctx, counterCancelled, len(recovered.Cancelled))
+	}()
+	streams, err := r.allStreams(ctx)
+	if err != nil {
+		return recovered, err
+	}
+	for _, s := range streams {
+		stream := s.stream
+		start := "-"
+		for {
+			pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  streamGroup,
+				Idle:   base.DefaultLeaseDuration,
+				Start:  start,
+				End:    "+",
+				Count:  recoverBatchSize,
+			}).Result()
+			if err != nil {
+				return recovered, err
+			}
+			for _, p := range pending {
+				keys := []string{
+					stream,
+					judgeTaskKeyPrefix,
+					deadLetterQueueKey,
+					streamEntriesKey,
+					cancelledSetKey,
+					submissionKeyPrefix,
+					fencingKey,
+					completedKey,
+					submissionResultPrefix,
+				}
+				args := []interface{}{
+					streamGroup,
+					base.DefaultLeaseDuration.Milliseconds(),
+					p.ID,
+					base.VerdictCancelled,
+					base.VerdictInternalError,
+				}
+				result, err := r.client.Eval(ctx, streamDeadLetterCmd, keys, args...).Slice()
+				if err != nil {
+					if err == redis.Nil {
+						continue
+					}
+					return recovered, err
+				}
+				id := result[1].(string)
+				switch result[0].(int64) {
+				case 0:
+					recovered.Requeued = append(recovered.Requeued, id)
+				case 1:
+					recovered.DeadLettered = append(recovered.DeadLettered, id)
+				case 2:
+					recovered.Cancelled = append(recovered.Cancelled, id)
+				}
+			}
+			if len(pending) < recoverBatchSize {
+				break
+			}
+			start = "(" + pending[len(pending)-1].ID
+		}
+	}
+	return recovered, nil
+}
+
+const streamRedriveDeadLetterCmd = payloadCmd + pendingOfCmd + signalPendingCmd + `
+	if redis.call("LREM", KEYS[1], 0, ARGV[1]) == 0 then
+		return nil
+	end
+	local submission = redis.call("GET", KEYS[2] .. ARGV[1])
+	local task = redis.call("GET", KEYS[3] .. ARGV[1])
+	if not submission or not task then
+		return nil
+	end
+	local t, header = decode_payload(task)
+	t["retried"] = 0
+	t["error"] = ""
+	t["final_verdict"] = 0
+	redis.call("SET", KEYS[3] .. ARGV[1], encode_payload(t, header))
+	redis.call("ZREM", KEYS[8], ARGV[1])
+	local stream, route = pending_of(submission, KEYS[4], KEYS[5], KEYS[7])
+	local entry = redis.call("XADD", stream, "*", "id", ARGV[1])
+	redis.call("HSET", KEYS[6], ARGV[1], entry)
+	signal_pending(KEYS[#KEYS] .. route)
+	return "OK"
+`
+
+func (r *StreamRDB) RedriveDeadLetter(ctx context.Context, id string) error {
+	keys := []string{
+		deadLetterQueueKey,
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		contestPendingStreamKey,
+		practicePendingStreamKey,
+		streamEntriesKey,
+		rejudgePendingStreamKey,
+		completedKey,
+		pendingSignalKey,
+	}
+	err := r.client.Eval(ctx, streamRedriveDeadLetterCmd, keys, id).Err()
+	if err == redis.Nil {
+		return ErrTaskNotFound
+	}
+	if err == nil {
+		r.count(ctx, counterRedriven, 1)
+	}
+	return err
+}
+
+const streamCancelCmd = payloadCmd + nowMsCmd + pendingOfCmd + `
+	local submission = redis.call("GET", KEYS[1] .. ARGV[1])
+	local task = redis.call("GET", KEYS[2] .. ARGV[1])
+	if not submission or not task then
+		return nil
+	end
+	local stream = pending_of(submission, KEYS[3], KEYS[4], KEYS[8])
+	local entry = redis.call("HGET", KEYS[5], ARGV[1])
+	if entry then
+		if #redis.call("XPENDING", stream, ARGV[2], entry, entry, 1) > 0 then
+			redis.call("SADD", KEYS[7], ARGV[1])
+			return "leased"
+		end
+		redis.call("XDEL", stream, entry)
+		redis.call("HDEL", KEYS[5], ARGV[1])
+	elseif redis.call("LREM", KEYS[6], 0, ARGV[1]) == 0 then
+		return nil
+	end
+	local t, header = decode_payload(task)
+	t["final_verdict"] = tonumber(ARGV[3])
+	task = encode_payload(t, header)
+	redis.call("SET", KEYS[2] .. ARGV[1], task)
+	redis.call("DEL", KEYS[1] .. ARGV[1])
+	redis.call("ZADD", KEYS[9], now_ms(), ARGV[1])
+	return {"pending", task}
+`
+
+func (r *StreamRDB) Cancel(ctx context.Context, id string) (bool, error) {
+	keys := []string{
+		submissionKeyPrefix,
+		judgeTaskKeyPrefix,
+		contestPendingStreamKey,
+		practicePendingStreamKey,
+		streamEntriesKey,
+		deadLetterQueueKey,
+		cancelledSetKey,
+		rejudgePendingStreamKey,
+		completedKey,
+	}
+	reply, err := r.client.Eval(ctx, streamCancelCmd, keys, id, streamGroup, base.VerdictCancelled).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, ErrTaskNotFound
+		}
+		return false, err
+	}
+	return r.cancelled(ctx, id, reply), nil
+}
+
+// Stats of the streams of every route: acked entries are deleted, so the depth of a stream
+// is its length minus the entries delivered but not acked, which are the in-flight leases.
+func (r *StreamRDB) Stats(ctx context.Context) (*Stats, error) {
+	stats := newStats()
+	streams, err := r.allStreams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range streams {
+		name, stream := s.queue, s.stream
+		group, err := r.groupInfo(ctx, stream)
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.client.XLen(ctx, stream).Result()
+		if err != nil {
+			return nil, err
+		}
+		age, err := r.oldestUndelivered(ctx, stream, group.LastDeliveredID)
+		if err != nil {
+			return nil, err
+		}
+		stats.Queues[name].Depth += length - group.Pending
+		if age.Milliseconds() > stats.Queues[name].OldestAgeMs {
+			stats.Queues[name].OldestAgeMs = age.Milliseconds()
+		}
+		stats.InFlight += group.Pending
+
+		expired, err := r.countExpired(ctx, stream)
+		if err != nil {
+			return nil, err
+		}
+		stats.ExpiredLeases += expired
+	}
+	deadLetters, err := r.client.LLen(ctx, deadLetterQueueKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	stats.DeadLetters = deadLetters
+	counters, err := r.client.HGetAll(ctx, statsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range counters {
+		stats.Counters[name], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return stats, nil
+}
+
+// countExpired counts the entries idle longer than DefaultLeaseDuration
+func (r *StreamRDB) countExpired(ctx context.Context, stream string) (int64, error) {
+	var expired int64
+	start := "-"
+	for {
+		pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  streamGroup,
+			Idle:   base.DefaultLeaseDuration,
+			Start:  start,
+			End:    "+",
+			Count:  recoverBatchSize,
+		}).Result()
+		if err != nil {
+			return expired, err
+		}
+		expired += int64(len(pending))
+		if len(pending) < recoverBatchSize {
+			return expired, nil
+		}
+		start = "(" + pending[len(pending)-1].ID
+	}
+}
@@ -1,12 +1,18 @@
 package logic
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"time"
 
 	"github.com/gammazero/workerpool"
 	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/sandbox"
 )
 
 type Complier struct {
@@ -18,22 +24,129 @@ type Complier struct {
 const srcDirPath = "../src/"
 const binDirPath = "../bin/"
 
-func compileCommand(binfileName, srcfile string) []string {
-	return []string{"g++", "-o", binfileName, srcfile}
+type language struct {
+	compiler string
+	compile  func(binfile, srcfile string) []string
+	run      func(binfile string) []string
+	syscalls []string // seccomp profile of the run
 }
 
+// languages this worker can judge once their compiler is installed, the keys are base.Languages
+var languages = map[string]language{
+	"c": {
+		compiler: "gcc",
+		compile: func(binfile, srcfile string) []string {
+			return []string{"gcc", "-O2", "-o", binfile, srcfile}
+		},
+		run:      func(binfile string) []string { return []string{binfile} },
+		syscalls: sandbox.ProfileStrict,
+	},
+	"cpp": {
+		compiler: "g++",
+		compile: func(binfile, srcfile string) []string {
+			return []string{"g++", "-O2", "-std=c++17", "-o", binfile, srcfile}
+		},
+		run:      func(binfile string) []string { return []string{binfile} },
+		syscalls: sandbox.ProfileStrict,
+	},
+	"py": {
+		compiler: "python3",
+		// only checks the syntax, the bytecode is what is run and shipped to shards
+		compile: func(binfile, srcfile string) []string {
+			return []string{"python3", "-c",
+				"import py_compile,sys; py_compile.compile(sys.argv[1], cfile=sys.argv[2], doraise=True)",
+				srcfile, binfile}
+		},
+		run:      func(binfile string) []string { return []string{"python3", binfile} },
+		syscalls: sandbox.ProfileRuntime,
+	},
+}
+
+// AvailableLanguages returns the languages whose compiler is found in PATH
+func AvailableLanguages() []string {
+	available := make([]string, 0, len(languages))
+	for _, name := range base.Languages {
+		if _, err := exec.LookPath(languages[name].compiler); err == nil {
+			available = append(available, name)
+		}
+	}
+	return available
+}
+
+func runCommand(lang, binfile string) []string {
+	return languages[lang].run(binfile)
+}
+
+// runSyscalls is the seccomp profile of lang adjusted by the problem
+func runSyscalls(lang string, task *base.JudgeTaskDescription) []string {
+	return sandbox.WithSyscalls(languages[lang].syscalls, task.SyscallAllow, task.SyscallDeny)
+}
+
+// where the source and the output directory of a compilation are bound inside the sandbox
+const (
+	sandboxSrcfile = "/box/main"
+	sandboxOutDir  = "/box/out"
+)
+
+// compileLimits bound every compilation, the compilers run a few processes of their own
+var compileLimits = sandbox.Limits{
+	CPUTime:      10 * time.Second,
+	WallTime:     20 * time.Second,
+	Memory:       1 << 30,
+	AddressSpace: 2 << 30,
+	FileSize:     64 << 20,
+	OpenFiles:    256,
+	Processes:    32,
+	Output:       64 << 10,
+}
+
+// doCompile compiles s in the sandbox of the judger, an error wrapping sandbox.ErrSetup is not
+// the fault of the submission
 func (c *Complier) doCompile(s *base.SubmissionDescription) (binfileName string, err error) {
+	lang, ok := languages[s.Language]
+	if !ok {
+		err = fmt.Errorf("unsupported language %q", s.Language)
+		return
+	}
 	srcFilename := fmt.Sprintf("%s%s.%s", srcDirPath, s.Id, s.Language)
-	_, err = os.Create(srcFilename)
+	err = os.WriteFile(srcFilename, []byte(s.SourceCode), 0644)
 	if err != nil {
 		return
 	}
-	binfilename := fmt.Sprintf("%s%s", binDirPath, s.Id)
-	cmdArr := compileCommand(binfilename, srcFilename)
-	cmd := exec.Command(cmdArr[0], cmdArr[1:]...)
-	err = cmd.Run()
+	// the compiler runs as an unprivileged uid, it gets a directory of its own to write to
+	outDir, err := os.MkdirTemp(binDirPath, s.Id+"-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(outDir)
+	if err = os.Chmod(outDir, 0777); err != nil {
+		return
+	}
+	srcfile := sandboxSrcfile + "." + s.Language
+	stderr := bytes.NewBuffer(nil)
+	cmd := &sandbox.Cmd{
+		Args: lang.compile(sandboxOutDir+"/main", srcfile),
+		Binds: []sandbox.Bind{
+			{Source: srcFilename, Target: srcfile},
+			{Source: outDir, Target: sandboxOutDir, Writable: true},
+		},
+		Limits: compileLimits,
+		Stderr: stderr,
+	}
+	usage, err := c.judger.sandbox.Run(context.Background(), cmd)
 	if err != nil {
+		if usage != nil && !errors.Is(err, sandbox.ErrSetup) {
+			if usage.Termination != sandbox.TerminationExited {
+				err = fmt.Errorf("compiler killed: %s", usage.Termination)
+			}
+			err = errors.New(runtimeErrMsg(err, stderr.Bytes()))
+		}
+		return
+	}
+	binfilename := fmt.Sprintf("%s%s", binDirPath, s.Id)
+	if err = os.Rename(filepath.Join(outDir, "main"), binfilename); err != nil {
 		return
 	}
+	binfileName = binfilename
 	return
 }
@@ -0,0 +1,77 @@
+package logic
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/sandbox"
+)
+
+// the compilations below re-execute the test binary as their sandbox init
+func TestMain(m *testing.M) {
+	sandbox.Init()
+	os.Exit(m.Run())
+}
+
+// inCompileDirs runs the test from a directory next to the src and bin directories doCompile uses
+func inCompileDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"src", "bin", "work"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(dir, "work")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestCompile(t *testing.T) {
+	if _, err := exec.LookPath("g++"); err != nil {
+		t.Skip("no g++")
+	}
+	inCompileDirs(t)
+	for _, runner := range []sandbox.Runner{sandbox.NewNamespaces(), sandbox.Unconfined{}} {
+		c := &Complier{judger: &Judger{sandbox: runner}}
+		binfile, err := c.doCompile(&base.SubmissionDescription{Id: "s1", Language: "cpp",
+			SourceCode: "#include <cstdio>\n#include <utility>\nint main() { auto [a, b] = std::pair{1, 2}; printf(\"%d\", a + b); }"})
+		if errors.Is(err, sandbox.ErrSetup) {
+			t.Log("skip", runner, err)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(binfile).Output()
+		if err != nil || string(out) != "3" {
+			t.Fatalf("binary printed %q, err %v", out, err)
+		}
+		os.Remove(binfile)
+
+		_, err = c.doCompile(&base.SubmissionDescription{Id: "s2", Language: "cpp", SourceCode: "int main() { return x; }"})
+		if err == nil || errors.Is(err, sandbox.ErrSetup) || !strings.Contains(err.Error(), "not declared") {
+			t.Fatal("compile error:", err)
+		}
+
+		binfile, err = c.doCompile(&base.SubmissionDescription{Id: "s3", Language: "py", SourceCode: "print(1 + 2)"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command("python3", binfile).Output(); err != nil || string(out) != "3\n" {
+			t.Fatalf("bytecode printed %q, err %v", out, err)
+		}
+		if _, err := c.doCompile(&base.SubmissionDescription{Id: "s4", Language: "py", SourceCode: "print(("}); err == nil || !strings.Contains(err.Error(), "SyntaxError") {
+			t.Fatal("syntax error:", err)
+		}
+	}
+}
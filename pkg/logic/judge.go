@@ -3,15 +3,15 @@ package logic
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"os/exec"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/gammazero/workerpool"
 	"github.com/khoakmp/judgo/pkg/base"
 	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/sandbox"
 	"github.com/khoakmp/judgo/pkg/testcase"
 )
 
@@ -19,6 +19,118 @@ type Judger struct {
 	wp       *workerpool.WorkerPool
 	testcase testcase.TestcaseManager
 	broker   broker.Broker
+	sandbox  sandbox.Runner
+	seccomp  bool
+}
+
+// where the compiled binary is bound inside the sandbox
+const sandboxBinfile = "/box/main"
+
+// limits of a run besides the time and memory limits of the problem
+const (
+	sandboxFileSize  = 16 << 20
+	sandboxOpenFiles = 64
+	sandboxProcesses = 16
+)
+
+// sandboxLimits enforce the time limits, and the memory limit when the sandbox has cgroups.
+// The others are backstops and the verdict comes from the measured usage. The address space
+// is twice the memory limit since it counts reserved but unused memory.
+func sandboxLimits(task *base.JudgeTaskDescription) sandbox.Limits {
+	return sandbox.Limits{
+		CPUTime:      time.Duration(task.TimeLimit) * time.Millisecond,
+		WallTime:     time.Duration(task.WallLimit()) * time.Millisecond,
+		Memory:       task.MemoryLimitBytes(),
+		AddressSpace: task.MemoryLimitBytes() * 2,
+		FileSize:     sandboxFileSize,
+		OpenFiles:    sandboxOpenFiles,
+		Processes:    sandboxProcesses,
+		Output:       int64(task.MaxOutput()) * 1024,
+	}
+}
+
+// at most this much of the stderr of a crashed program is kept in its error message
+const stderrInErrMsg = 1024
+
+// runtimeErrMsg is err followed by the beginning of what the program wrote to stderr
+func runtimeErrMsg(err error, stderr []byte) string {
+	stderr = bytes.TrimSpace(stderr)
+	if len(stderr) == 0 {
+		return err.Error()
+	}
+	if len(stderr) > stderrInErrMsg {
+		stderr = stderr[:stderrInErrMsg]
+	}
+	return err.Error() + ": " + string(stderr)
+}
+
+func resourceUsage(u *sandbox.Usage) *base.ResourceUsage {
+	return &base.ResourceUsage{
+		CPUTimeMs:    u.CPUTime().Milliseconds(),
+		UserTimeMs:   u.UserTime.Milliseconds(),
+		SysTimeMs:    u.SysTime.Milliseconds(),
+		WallTimeMs:   u.WallTime.Milliseconds(),
+		MaxRSSKb:     u.MaxRSS,
+		MemoryPeakKb: u.MemoryPeak / 1024,
+		OOMKilled:    u.OOMKilled,
+		ExitCode:     u.ExitCode,
+		Signal:       int(u.Signal),
+	}
+}
+
+// memoryUsed is the peak memory of a run in KB, the rss is only used without cgroups
+func memoryUsed(u *sandbox.Usage) int64 {
+	if u.MemoryPeak > 0 {
+		return u.MemoryPeak / 1024
+	}
+	return u.MaxRSS
+}
+
+// subtestResult maps the outcome of a run to the result of its subtest
+func subtestResult(task *base.JudgeTaskDescription, usage *sandbox.Usage, err error, stdout, stderr, answer []byte) *base.SubtestResult {
+	var result base.SubtestResult
+	if usage != nil {
+		result.Usage = resourceUsage(usage)
+		result.Termination = usage.Termination
+	}
+	if usage == nil || errors.Is(err, sandbox.ErrSetup) {
+		// the program never ran, keep the subtest unjudged so it is retried
+		result.VerdictCode = base.VerdictUnjudge
+		result.ErrMsg = err.Error()
+	} else if usage.SeccompViolation {
+		result.VerdictCode = base.VerdictSecurityViolation
+		result.Syscall = &usage.Syscall
+	} else if usage.Termination == sandbox.TerminationOutputLimit {
+		result.VerdictCode = base.VerdictOutputLimitExceed
+	} else if usage.OOMKilled {
+		result.VerdictCode = base.VerdictMemoryLimitExceed
+	} else if usage.Termination == sandbox.TerminationCPUTimeLimit ||
+		usage.Termination == sandbox.TerminationWallTimeLimit {
+		result.VerdictCode = base.VerdictTimeLimitExceed
+	} else if err != nil {
+		result.VerdictCode = base.VerdictRunTimeError
+		result.ErrMsg = runtimeErrMsg(err, stderr)
+	} else if !checkOutput(stdout, answer) {
+		result.VerdictCode = base.VerdictWrongAnwser
+	} else if usage.CPUTime().Milliseconds() > int64(task.TimeLimit) {
+		// the cpu time is only checked every few ms while the program runs
+		result.VerdictCode = base.VerdictTimeLimitExceed
+	} else if memoryUsed(usage)*1024 > task.MemoryLimitBytes() {
+		result.VerdictCode = base.VerdictMemoryLimitExceed
+	} else {
+		result.VerdictCode = base.VerdictAccepted
+		result.ExecTime = int(usage.CPUTime().Milliseconds())
+		result.MemoryUsage = int(memoryUsed(usage))
+	}
+	return &result
+}
+
+// syscalls is the seccomp profile of the runs of t, nil when seccomp is off
+func (j *Judger) syscalls(t *base.JudgeSubmissionTask) []string {
+	if !j.seccomp {
+		return nil
+	}
+	return runSyscalls(t.Language, t.JudgeTaskDescription)
 }
 
 type judgeTask struct {
@@ -44,51 +156,51 @@ func (j *Judger) submit(t *judgeTask) {
 func (j *Judger) judge(t *judgeTask) {
 	inpBuf, answerBuf, err := j.testcase.GetTestcase(t.task.ProblemId, t.subtestId)
 	if err != nil {
-		t.task.Results[t.subtestId].ErrMsg = err.Error()
+		// keep the subtest unjudged so it is retried, the error is kept for the dead-letter queue
+		t.task.UpdateSubtestResult(t.subtestId, &base.SubtestResult{
+			VerdictCode: base.VerdictUnjudge,
+			ErrMsg:      err.Error(),
+		})
+		if err := j.broker.UpdatePartialResult(t.task, t.subtestId); err != nil {
+			fmt.Println("failed to update partial result, cause by:", err)
+		}
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(t.task.TimeLimit+1)*time.Millisecond)
+	// the sandbox enforces the time limits, ctx only stops a run whose lease was lost
+	ctx, cancel := context.WithCancel(context.Background())
 
-	resultCh := make(chan *base.SubtestResult)
+	// buffered so the run does not block forever once the subtest is aborted
+	resultCh := make(chan *base.SubtestResult, 1)
 
+	// both are bounded by the output limit of the sandbox
 	outBuf := bytes.NewBuffer(nil)
-
-	cmd := exec.CommandContext(ctx, t.binfileName)
-	cmd.Stdin = bytes.NewReader(inpBuf)
-	cmd.Stdout = outBuf
+	errBuf := bytes.NewBuffer(nil)
+
+	cmd := &sandbox.Cmd{
+		Args:     runCommand(t.task.Language, sandboxBinfile),
+		Binds:    []sandbox.Bind{{Source: t.binfileName, Target: sandboxBinfile}},
+		Limits:   sandboxLimits(t.task.JudgeTaskDescription),
+		Syscalls: j.syscalls(t.task),
+		Stdin:    bytes.NewReader(inpBuf),
+		Stdout:   outBuf,
+		Stderr:   errBuf,
+	}
 
 	go func() {
-		err := cmd.Run()
-		var result base.SubtestResult
-		if err != nil {
-			result.VerdictCode = base.VerdictRunTimeError
-			result.ErrMsg = err.Error()
-		} else {
-			ok := checkOutput(outBuf.Bytes(), answerBuf)
-			if ok {
-				if cmd.ProcessState.UserTime().Milliseconds() > int64(t.task.TimeLimit) {
-					result.VerdictCode = base.VerdictTimeLimitExceed
-				} else if cmd.ProcessState.SysUsage().(*syscall.Rusage).Maxrss > int64(t.task.MemoryLimit) {
-					result.VerdictCode = base.VerdictMemoryLimitExceed
-				} else {
-					result.VerdictCode = base.VerdictAccepted
-					result.ExecTime = int(cmd.ProcessState.UserTime())
-					result.MemoryUsage = int(cmd.ProcessState.SysUsage().(*syscall.Rusage).Maxrss)
-				}
-			} else {
-				result.VerdictCode = base.VerdictWrongAnwser
-			}
-		}
-		resultCh <- &result
+		usage, err := j.sandbox.Run(ctx, cmd)
+		resultCh <- subtestResult(t.task.JudgeTaskDescription, usage, err, outBuf.Bytes(), errBuf.Bytes(), answerBuf)
 	}()
 
 	select {
 	case result := <-resultCh:
 		t.task.UpdateSubtestResult(t.subtestId, result)
 		err := j.broker.UpdatePartialResult(t.task, t.subtestId)
-		if err != nil {
-
+		if err == broker.ErrLeaseLost {
+			fmt.Println("lease lost, abort submission", t.task.Id)
+			t.task.Lease.NotifyExpried()
+		} else if err != nil {
+			fmt.Println("failed to update partial result, cause by:", err)
 		}
 	case <-t.task.Lease.Done():
 		fmt.Println("lease expried, abort subtest", t.subtestId)
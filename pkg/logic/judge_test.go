@@ -0,0 +1,65 @@
+package logic
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/sandbox"
+)
+
+func TestSandboxLimits(t *testing.T) {
+	limits := sandboxLimits(&base.JudgeTaskDescription{TimeLimit: 1000, MemoryLimit: 256})
+	if limits.Memory != 256<<20 || limits.AddressSpace != 512<<20 {
+		t.Fatalf("memory %d, address space %d", limits.Memory, limits.AddressSpace)
+	}
+	if limits.CPUTime != time.Second || limits.WallTime != 3*time.Second {
+		t.Fatalf("cpu time %v, wall time %v", limits.CPUTime, limits.WallTime)
+	}
+}
+
+func TestSubtestResult(t *testing.T) {
+	task := &base.JudgeTaskDescription{TimeLimit: 1000, MemoryLimit: 256}
+	exited := func(cpu time.Duration, maxRSS, memoryPeak int64) *sandbox.Usage {
+		return &sandbox.Usage{UserTime: cpu, MaxRSS: maxRSS, MemoryPeak: memoryPeak, Termination: sandbox.TerminationExited}
+	}
+	for _, tc := range []struct {
+		name    string
+		usage   *sandbox.Usage
+		err     error
+		stdout  string
+		verdict int
+		memory  int
+	}{
+		{"accepted", exited(500*time.Millisecond, 0, 100<<20), nil, "1 2\n", base.VerdictAccepted, 100 << 10},
+		{"accepted without cgroup", exited(500*time.Millisecond, 100<<10, 0), nil, "1 2", base.VerdictAccepted, 100 << 10},
+		{"at the memory limit", exited(500*time.Millisecond, 0, 256<<20), nil, "1 2", base.VerdictAccepted, 256 << 10},
+		{"above the memory limit", exited(500*time.Millisecond, 0, 256<<20+1024), nil, "1 2", base.VerdictMemoryLimitExceed, 0},
+		{"rss above the memory limit", exited(500*time.Millisecond, 257<<10, 0), nil, "1 2", base.VerdictMemoryLimitExceed, 0},
+		{"oom killed", &sandbox.Usage{OOMKilled: true, Termination: sandbox.TerminationSignaled}, errors.New("killed"), "", base.VerdictMemoryLimitExceed, 0},
+		{"cpu time above the limit", exited(1001*time.Millisecond, 0, 1<<20), nil, "1 2", base.VerdictTimeLimitExceed, 0},
+		{"cpu time limit", &sandbox.Usage{Termination: sandbox.TerminationCPUTimeLimit}, errors.New("killed"), "", base.VerdictTimeLimitExceed, 0},
+		{"wall time limit", &sandbox.Usage{Termination: sandbox.TerminationWallTimeLimit}, errors.New("killed"), "", base.VerdictTimeLimitExceed, 0},
+		{"output limit", &sandbox.Usage{Termination: sandbox.TerminationOutputLimit}, errors.New("killed"), "", base.VerdictOutputLimitExceed, 0},
+		{"security violation", &sandbox.Usage{SeccompViolation: true, Syscall: 59}, errors.New("killed"), "", base.VerdictSecurityViolation, 0},
+		{"runtime error", exited(10*time.Millisecond, 1024, 0), errors.New("exit status 1"), "", base.VerdictRunTimeError, 0},
+		{"wrong answer", exited(10*time.Millisecond, 1024, 0), nil, "1 3", base.VerdictWrongAnwser, 0},
+		{"wrong answer above the time limit", exited(2*time.Second, 1024, 0), nil, "1 3", base.VerdictWrongAnwser, 0},
+		{"setup failure", &sandbox.Usage{}, sandbox.ErrSetup, "", base.VerdictUnjudge, 0},
+		{"not run", nil, errors.New("no binary"), "", base.VerdictUnjudge, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := subtestResult(task, tc.usage, tc.err, []byte(tc.stdout), nil, []byte("1 2\n"))
+			if result.VerdictCode != tc.verdict {
+				t.Fatalf("verdict %d, want %d", result.VerdictCode, tc.verdict)
+			}
+			if result.MemoryUsage != tc.memory {
+				t.Fatalf("memory %d KB, want %d", result.MemoryUsage, tc.memory)
+			}
+			if tc.verdict == base.VerdictSecurityViolation && (result.Syscall == nil || *result.Syscall != 59) {
+				t.Fatal("syscall", result.Syscall)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package logic
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"sort"
 	"time"
 
 	"github.com/khoakmp/judgo/pkg/base"
@@ -16,9 +19,12 @@ type Monitor struct {
 	broker     broker.Broker
 	syncReqch  chan *syncRequest
 	doneCh     chan string
+	worker     *base.WorkerInfo
 }
 
 func (m *Monitor) Start() {
+	m.worker.StartedAt = time.Now()
+	m.heartbeat(nil)
 	timer := time.NewTimer(m.interval)
 LOOP:
 	for {
@@ -30,19 +36,49 @@ LOOP:
 		case id := <-m.doneCh:
 			delete(m.taskMap, id)
 		case <-timer.C:
-			ids := make([]string, 0)
+			leases := make(map[string]int64)
 			for id, task := range m.taskMap {
 				if !task.Lease.IsValid() {
 					task.Lease.NotifyExpried()
 				} else {
-					ids = append(ids, id)
+					leases[id] = task.Lease.Token()
 				}
 			}
 			deadline := time.Now().Add(base.DefaultLeaseDuration)
-			if err := m.broker.ExtendLease(ids, deadline); err != nil {
+			cancelled, lost, err := m.broker.ExtendLease(leases, deadline)
+			if err != nil {
 				fmt.Println("failed to extend lease,cause by:", err)
 			}
+			for _, id := range cancelled {
+				fmt.Println("submission cancelled, abort", id)
+				m.taskMap[id].Lease.Cancel()
+			}
+			for _, id := range lost {
+				fmt.Println("lease taken over by another judger, abort", id)
+				m.taskMap[id].Lease.NotifyExpried()
+			}
+			m.heartbeat(lost)
 			timer.Reset(m.interval)
 		}
 	}
+	if err := m.broker.DeregisterWorker(context.Background(), m.worker.Id); err != nil {
+		fmt.Println("failed to deregister worker, cause by:", err)
+	}
+}
+
+// heartbeat reports the submissions this worker holds a lease on, lost ones excluded
+func (m *Monitor) heartbeat(lost []string) {
+	submissions := make([]string, 0, len(m.taskMap))
+	for id := range m.taskMap {
+		if !slices.Contains(lost, id) {
+			submissions = append(submissions, id)
+		}
+	}
+	sort.Strings(submissions)
+	m.worker.Submissions = submissions
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	defer cancel()
+	if err := m.broker.Heartbeat(ctx, m.worker); err != nil {
+		fmt.Println("failed to send heartbeat, cause by:", err)
+	}
 }
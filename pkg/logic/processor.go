@@ -2,13 +2,19 @@ package logic
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"runtime"
 	"sync"
 	"time"
 
 	"github.com/gammazero/workerpool"
+	"github.com/google/uuid"
+	"github.com/khoakmp/judgo/pkg/artifact"
 	"github.com/khoakmp/judgo/pkg/base"
 	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/sandbox"
 	"github.com/khoakmp/judgo/pkg/storage"
 	"github.com/khoakmp/judgo/pkg/testcase"
 )
@@ -24,8 +30,124 @@ type Processor struct {
 	taskInfoCh chan *base.JudgeSubmissionTask
 	doneCh     chan string
 	syncReqCh  chan *syncRequest
+	mergedCh   chan *base.JudgeSubmissionTask // parents returned by merges the syncer retried
 	store      storage.Store
 	testcase   testcase.TestcaseManager
+	monitor    *Monitor
+	syncer     *Syncer
+	ctx        context.Context
+	cancel     context.CancelFunc
+	pickCtx    context.Context
+	stopPick   context.CancelFunc
+	exited     chan struct{} // closed when Start returns
+	stopOnce   sync.Once
+	closeOnce  sync.Once
+	mu         sync.Mutex
+	inflight   map[string]*base.JudgeSubmissionTask
+	inflightWg sync.WaitGroup
+	artifacts  artifact.Store
+	shardSize  int
+}
+
+// how long exec waits for a submission before checking quitCh again
+const pickTimeout = time.Second * 5
+
+// how long Drain waits for the broker to take back one submission
+const releaseTimeout = time.Second * 5
+
+func NewProcessor(b broker.Broker, store storage.Store, tm testcase.TestcaseManager, slots int) *Processor {
+	taskInfoCh := make(chan *base.JudgeSubmissionTask)
+	doneCh := make(chan string, slots)
+	syncReqCh := make(chan *syncRequest, slots)
+	ctx, cancel := context.WithCancel(context.Background())
+	pickCtx, stopPick := context.WithCancel(ctx)
+	judger := &Judger{
+		wp:       workerpool.New(runtime.NumCPU()),
+		testcase: tm,
+		broker:   b,
+		sandbox:  sandbox.NewNamespaces(),
+		seccomp:  true,
+	}
+	return &Processor{
+		stopCh:     make(chan struct{}),
+		compiler:   &Complier{judger: judger},
+		wp:         workerpool.New(slots),
+		judger:     judger,
+		broker:     b,
+		slotCh:     make(chan struct{}, slots),
+		quitCh:     make(chan struct{}),
+		taskInfoCh: taskInfoCh,
+		doneCh:     doneCh,
+		syncReqCh:  syncReqCh,
+		mergedCh:   make(chan *base.JudgeSubmissionTask, slots),
+		store:      store,
+		testcase:   tm,
+		monitor: &Monitor{
+			taskMap:    make(map[string]*base.JudgeSubmissionTask),
+			taskInfoCh: taskInfoCh,
+			stopCh:     make(chan struct{}),
+			interval:   base.DefaultLeaseDuration / 3,
+			broker:     b,
+			syncReqch:  syncReqCh,
+			doneCh:     doneCh,
+			worker:     newWorkerInfo(slots),
+		},
+		syncer: &Syncer{
+			stopCh:    make(chan struct{}),
+			syncReqCh: syncReqCh,
+			interval:  time.Second,
+		},
+		ctx:      ctx,
+		cancel:   cancel,
+		pickCtx:  pickCtx,
+		stopPick: stopPick,
+		exited:   make(chan struct{}),
+		inflight: make(map[string]*base.JudgeSubmissionTask),
+	}
+}
+
+// SetSharding sets the store the compiled binaries of sharded submissions go through. Submissions
+// with more than shardSize unjudged subtests are split into shards of shardSize subtests judged by
+// any worker, 0 disables it for this worker which still judges the shards of other ones.
+func (p *Processor) SetSharding(store artifact.Store, shardSize int) {
+	p.artifacts = store
+	p.shardSize = shardSize
+}
+
+// SetSandbox sets the runner of the submitted programs, namespaces by default
+func (p *Processor) SetSandbox(runner sandbox.Runner) {
+	p.judger.sandbox = runner
+}
+
+// SetSeccomp sets whether the submitted programs run under the seccomp profile of their
+// language, on by default
+func (p *Processor) SetSeccomp(enabled bool) {
+	p.judger.seccomp = enabled
+}
+
+// SetCapabilities sets the languages and resource classes reported with the heartbeats,
+// they should match the routes the broker picks from
+func (p *Processor) SetCapabilities(languages, classes []string) {
+	p.monitor.worker.Languages = languages
+	p.monitor.worker.ResourceClasses = classes
+}
+
+func newWorkerInfo(slots int) *base.WorkerInfo {
+	hostname, _ := os.Hostname()
+	return &base.WorkerInfo{
+		Id:              fmt.Sprintf("%s-%s", hostname, uuid.New().String()[:8]),
+		Hostname:        hostname,
+		Slots:           slots,
+		Languages:       AvailableLanguages(),
+		ResourceClasses: []string{base.DefaultResourceClass},
+		Version:         base.Version,
+		Submissions:     make([]string, 0),
+	}
+}
+
+// WorkerId is the id this processor is registered with in the broker
+func (p *Processor) WorkerId() string {
+	return p.monitor.worker.Id
 }
 
 type compileResult struct {
@@ -35,6 +157,9 @@ type compileResult struct {
 }
 
 func (p *Processor) Start() {
+	defer close(p.exited)
+	go p.monitor.Start()
+	go p.syncer.Start()
 LOOP:
 	for {
 		select {
@@ -47,28 +172,142 @@ LOOP:
 	}
 }
 
+func (p *Processor) Stop() {
+	p.stopPicking()
+	p.close()
+}
+
+// Drain stops picking submissions and gives the in-flight ones up to grace to finish,
+// the unfinished ones are then released to the broker with their partial results
+// rather than left until their lease expires. The processor is stopped afterwards.
+func (p *Processor) Drain(grace time.Duration) {
+	p.stopPicking()
+	<-p.exited
+
+	done := make(chan struct{})
+	go func() {
+		p.inflightWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		p.releaseInflight()
+	}
+	p.close()
+}
+
+func (p *Processor) stopPicking() {
+	p.stopOnce.Do(func() {
+		p.stopPick()
+		close(p.quitCh)
+		close(p.stopCh)
+	})
+}
+
+func (p *Processor) close() {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		close(p.monitor.stopCh)
+		close(p.syncer.stopCh)
+	})
+}
+
+// releaseInflight hands the unfinished submissions back to the broker. Released leases are
+// no longer valid so their judging stops without completing, a submission completed meanwhile
+// is rejected by the broker with ErrLeaseLost.
+func (p *Processor) releaseInflight() {
+	p.mu.Lock()
+	tasks := make([]*base.JudgeSubmissionTask, 0, len(p.inflight))
+	for _, t := range p.inflight {
+		tasks = append(tasks, t)
+	}
+	p.mu.Unlock()
+
+	for _, t := range tasks {
+		if t.Lease.IsCancelled() {
+			// its subtests are aborted already, it completes as cancelled on its own
+			continue
+		}
+		t.Lease.Release()
+		ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		err := p.broker.Release(ctx, t)
+		cancel()
+		switch err {
+		case nil:
+			fmt.Println("released submission", t.Id)
+		case broker.ErrLeaseLost, broker.ErrTaskNotFound:
+			fmt.Println("submission", t.Id, "already completed or taken over")
+		default:
+			// the recoverer requeues it once the lease expires
+			fmt.Println("failed to release submission", t.Id, "cause by:", err)
+		}
+	}
+}
+
 func (p *Processor) exec() {
 	select {
 	case <-p.quitCh:
 		return
+	case parent := <-p.mergedCh:
+		p.wp.Submit(func() {
+			p.finishMerged(parent)
+		})
+		return
 	case p.slotCh <- struct{}{}:
-		task, _, err := p.broker.PickOneSubmission()
-		if err != nil {
-			if err == broker.ErrQueueEmpty {
-				time.Sleep(time.Second)
-			}
+	}
+	n := 1
+FILL:
+	for {
+		select {
+		case p.slotCh <- struct{}{}:
+			n++
+		default:
+			break FILL
 		}
-		var verdicted int
-		for _, r := range task.Results {
-			if r.VerdictCode != base.VerdictUnjudge {
-				verdicted++
-			}
+	}
+
+	tasks, err := p.broker.PickSubmissions(p.pickCtx, n)
+	if err != nil && p.pickCtx.Err() == nil {
+		fmt.Println("failed to pick submissions, cause by:", err)
+	}
+	if len(tasks) == 0 && err == nil {
+		var task *base.JudgeSubmissionTask
+		task, _, err = p.broker.BlockingPickOneSubmission(p.pickCtx, pickTimeout)
+		if err == nil {
+			tasks = append(tasks, task)
+		} else if err != broker.ErrQueueEmpty && p.pickCtx.Err() == nil {
+			fmt.Println("failed to pick submission, cause by:", err)
 		}
-		task.Verdicted = verdicted
+	}
+	for i := len(tasks); i < n; i++ {
+		<-p.slotCh
+	}
+	if len(tasks) == 0 && err != nil && err != broker.ErrQueueEmpty && p.pickCtx.Err() == nil {
+		time.Sleep(time.Second)
+	}
+
+	for _, task := range tasks {
+		p.start(task)
+	}
+}
 
-		p.taskInfoCh <- task
-		p.process(task)
+func (p *Processor) start(task *base.JudgeSubmissionTask) {
+	var verdicted int
+	for _, r := range task.Results {
+		if r.VerdictCode != base.VerdictUnjudge {
+			verdicted++
+		}
 	}
+	task.Verdicted = verdicted
+
+	p.mu.Lock()
+	p.inflight[task.Id] = task
+	p.mu.Unlock()
+	p.inflightWg.Add(1)
+
+	p.taskInfoCh <- task
+	p.process(task)
 }
 
 func (p *Processor) process(t *base.JudgeSubmissionTask) {
@@ -76,75 +315,44 @@ func (p *Processor) process(t *base.JudgeSubmissionTask) {
 		defer func() {
 			<-p.slotCh
 			p.doneCh <- t.Id
+			p.mu.Lock()
+			delete(p.inflight, t.Id)
+			p.mu.Unlock()
+			p.inflightWg.Done()
 		}()
 
+		if t.ParentId != "" {
+			p.processShard(t)
+			return
+		}
+
 		binfile, err := p.compiler.doCompile(t.SubmissionDescription)
+		if errors.Is(err, sandbox.ErrSetup) {
+			// like an unjudged subtest, the lease expires and the submission is retried
+			fmt.Println("failed to compile submission", t.Id, "cause by:", err)
+			return
+		}
+		p.publishCompiled(t, err)
 		if err != nil {
 			t.FinalVerdict = base.VerdictCompileError
 			t.Error = err.Error()
-			err := p.complete(t)
-			if err != nil {
-				p.syncReqCh <- &syncRequest{
-					fn: func() error {
-						return p.complete(t)
-					},
-					deadline: t.Lease.Deadline(),
-					cancel:   nil,
-				}
-			}
+			p.complete(t)
 			return
 		}
-
-		var wg sync.WaitGroup
-		// 1. no co the co dang acm || oi dung?
-
-		for subtestId, result := range t.Results {
-			if result.VerdictCode == base.VerdictUnjudge {
-				fmt.Println("judge:", subtestId)
-				wg.Add(1)
-				p.judger.submit(&judgeTask{
-					binfileName: binfile,
-					subtestId:   subtestId,
-					task:        t,
-					wg:          &wg,
-				})
-			}
+		if p.shard(t, binfile) {
+			return
 		}
 
-		wg.Wait()
+		p.judgeSubtests(t, binfile)
 		if !t.Lease.IsValid() {
 			return
 		}
-		if t.Type == base.TypeProblemACM {
-			for _, result := range t.Results {
-				if result.VerdictCode != base.VerdictAccepted {
-					t.FinalVerdict = result.VerdictCode
-					break
-				}
-				if t.ExecTime < result.ExecTime {
-					t.ExecTime = result.ExecTime
-				}
-				if t.Memory < result.MemoryUsage {
-					t.Memory = result.MemoryUsage
-				}
-			}
-		}
-		var points []int
-		if t.Type == base.TypeProblemOI {
-			points = p.testcase.GetTestcasePoints(t.ProblemId)
-		}
-		t.CalculateFinalResult(points)
-
-		err = p.complete(t)
-		if err != nil {
-			p.syncReqCh <- &syncRequest{
-				fn: func() error {
-					return p.complete(t)
-				},
-				deadline: t.Lease.Deadline(),
-			}
+		if t.Lease.IsCancelled() {
+			t.FinalVerdict = base.VerdictCancelled
+			p.complete(t)
+			return
 		}
-
+		p.finish(t)
 	})
 	// base on redis 100% cung duoc co the dung cai gi do dung
 	// scale tam 20 judger + 3 for other service la ok dung?
@@ -157,29 +365,106 @@ func (p *Processor) process(t *base.JudgeSubmissionTask) {
 
 }
 
-func (p *Processor) complete(t *base.JudgeSubmissionTask) error {
+// judgeSubtests judges the unjudged subtests of t and waits for all of them
+func (p *Processor) judgeSubtests(t *base.JudgeSubmissionTask, binfile string) {
+	var wg sync.WaitGroup
+	// 1. no co the co dang acm || oi dung?
+
+	for subtestId, result := range t.Results {
+		if result.VerdictCode == base.VerdictUnjudge {
+			wg.Add(1)
+			p.judger.submit(&judgeTask{
+				binfileName: binfile,
+				subtestId:   subtestId,
+				task:        t,
+				wg:          &wg,
+			})
+		}
+	}
+
+	wg.Wait()
+}
+
+// finish computes the final result of t once every subtest is judged and completes it
+func (p *Processor) finish(t *base.JudgeSubmissionTask) {
+	if hasUnjudged(t) {
+		// infrastructure failure, let the lease expire so the task is retried
+		// or dead-lettered by the recoverer once MaxRetry is exhausted. The broker
+		// keeps the subtest error in the results for the dead-letter record.
+		t.Error = t.SubtestError()
+		fmt.Println("submission", t.Id, "left unjudged, cause by:", t.Error)
+		return
+	}
+	var points []int
+	if t.Type == base.TypeProblemOI {
+		points = p.testcase.GetTestcasePoints(t.ProblemId)
+	}
+	t.CalculateFinalResult(points)
+
+	p.complete(t)
+}
+
+func hasUnjudged(t *base.JudgeSubmissionTask) bool {
+	for _, result := range t.Results {
+		if result.VerdictCode == base.VerdictUnjudge {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Processor) publishCompiled(t *base.JudgeSubmissionTask, compileErr error) {
+	e := &base.ResultEvent{
+		Type:         base.EventCompiled,
+		SubmissionId: t.Id,
+	}
+	if compileErr != nil {
+		e.Error = compileErr.Error()
+	}
+	if err := p.broker.PublishEvent(p.ctx, e); err != nil {
+		fmt.Println("failed to publish compile event, cause by:", err)
+	}
+}
+
+// complete completes t in the broker and persists its result, on failure the rest is
+// retried by the sync loop until the lease deadline
+func (p *Processor) complete(t *base.JudgeSubmissionTask) {
 	if !t.Lease.IsValid() {
-		return nil
+		return
 	}
 
+	// the broker checks the fencing token, so a judger whose lease was taken over
+	// never overwrites the result in the store
 	ctx, cancel := context.WithDeadline(context.Background(), t.Lease.Deadline())
-	err := p.store.UpdateSubmissionResult(ctx, t)
-	if err != nil {
-		cancel()
-		return err
+	completed := false
+	persist := func() error {
+		if !completed {
+			err := p.broker.CompleteJudgeSubmissionTask(ctx, t)
+			if err == broker.ErrLeaseLost {
+				fmt.Println("lease lost, drop result of submission", t.Id)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			completed = true
+		}
+		if err := p.store.UpdateSubmissionResult(ctx, t); err != nil {
+			return err
+		}
+		// on failure the sweeper persists the result again and marks it
+		if err := p.broker.MarkPersisted(ctx, t.Id); err != nil {
+			fmt.Println("failed to mark submission", t.Id, "persisted, cause by:", err)
+		}
+		return nil
 	}
-
-	err = p.broker.CompleteJudgeSubmissionTask(ctx, t)
-	if err != nil {
+	if err := persist(); err != nil {
 		p.syncReqCh <- &syncRequest{
-			fn: func() error {
-				return p.broker.CompleteJudgeSubmissionTask(ctx, t)
-			},
+			fn:       persist,
 			deadline: t.Lease.Deadline(),
 			cancel:   cancel,
 		}
-		return nil
+		return
 	}
 	cancel()
-	return nil
 }
@@ -1 +1,126 @@
 package logic
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/storage"
+)
+
+// Recoverer periodically gives back to the pending queues the submissions
+// whose lease has expired, e.g. because the judge node holding them crashed.
+type Recoverer struct {
+	stopCh   chan struct{}
+	interval time.Duration
+	broker   broker.Broker
+	store    storage.Store
+}
+
+func NewRecoverer(b broker.Broker, store storage.Store, interval time.Duration) *Recoverer {
+	return &Recoverer{
+		stopCh:   make(chan struct{}),
+		interval: interval,
+		broker:   b,
+		store:    store,
+	}
+}
+
+func (r *Recoverer) Start() {
+	timer := time.NewTimer(r.interval)
+LOOP:
+	for {
+		select {
+		case <-r.stopCh:
+			timer.Stop()
+			break LOOP
+		case <-timer.C:
+			r.recover()
+			timer.Reset(r.interval)
+		}
+	}
+}
+
+func (r *Recoverer) Stop() {
+	close(r.stopCh)
+}
+
+func (r *Recoverer) recover() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+	result, err := r.broker.RecoverExpiredLeases(ctx, time.Now())
+	if err != nil {
+		fmt.Println("failed to recover expired leases, cause by:", err)
+	}
+	if result == nil {
+		return
+	}
+	if len(result.Requeued) > 0 {
+		fmt.Println("recovered expired submissions:", result.Requeued)
+	}
+	for _, id := range result.DeadLettered {
+		if err := r.finalizeDeadLetter(ctx, id); err != nil {
+			fmt.Println("failed to finalize dead-lettered submission", id, "cause by:", err)
+		}
+	}
+	for _, id := range result.Cancelled {
+		if err := r.store.UpdateSubmissionResult(ctx, cancelledTask(id)); err != nil {
+			fmt.Println("failed to record cancelled submission", id, "cause by:", err)
+		} else if err := r.broker.MarkPersisted(ctx, id); err != nil {
+			fmt.Println("failed to mark submission", id, "persisted, cause by:", err)
+		}
+	}
+}
+
+// finalizeDeadLetter persists the internal error verdict the broker gave the submission which
+// exhausted its retries, on failure the sweeper persists it later.
+// A shard is merged into its parent with its unjudged subtests instead, if it was the last one
+// the parent is finalized with an internal error as well.
+func (r *Recoverer) finalizeDeadLetter(ctx context.Context, id string) error {
+	t, err := r.broker.GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	if t.ParentId != "" {
+		parent, err := r.broker.MergeShard(ctx, t)
+		if err != nil || parent == nil {
+			return err
+		}
+		parent.FinalVerdict = base.VerdictInternalError
+		parent.Error = t.Error
+		if err := r.broker.CompleteJudgeSubmissionTask(ctx, parent); err != nil {
+			return err
+		}
+		return r.persist(ctx, parent)
+	}
+	final := *t.JudgeTaskDescription
+	if err := r.broker.PublishEvent(ctx, &base.ResultEvent{
+		Type:         base.EventFinal,
+		SubmissionId: id,
+		Task:         &final,
+	}); err != nil {
+		fmt.Println("failed to publish final event of submission", id, "cause by:", err)
+	}
+	return r.persist(ctx, t)
+}
+
+func (r *Recoverer) persist(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	if err := r.store.UpdateSubmissionResult(ctx, t); err != nil {
+		return err
+	}
+	return r.broker.MarkPersisted(ctx, t.Id)
+}
+
+// cancelledTask is the result recorded for a submission cancelled before it was judged
+func cancelledTask(id string) *base.JudgeSubmissionTask {
+	return &base.JudgeSubmissionTask{
+		SubmissionDescription: &base.SubmissionDescription{
+			Id: id,
+		},
+		JudgeTaskDescription: &base.JudgeTaskDescription{
+			FinalVerdict: base.VerdictCancelled,
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/storage"
+)
+
+// downStore fails every write like a database which is briefly unreachable
+type downStore struct {
+	*storage.MemoryStore
+}
+
+func (s *downStore) UpdateSubmissionResult(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	return errors.New("connection refused")
+}
+
+// deadLetter enqueues t, picks it and lets its only lease expire
+func deadLetter(t *testing.T, b *broker.Memory, task *base.JudgeSubmissionTask) {
+	t.Helper()
+	ctx := context.Background()
+	if err := b.Enqueue(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.PickOneSubmission(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.RecoverExpiredLeases(ctx, time.Now().Add(base.DefaultLeaseDuration+time.Second))
+	if err != nil || len(result.DeadLettered) != 1 {
+		t.Fatal("not dead-lettered:", result, err)
+	}
+}
+
+func testTask(id string, subtests int) *base.JudgeSubmissionTask {
+	results := make(map[int]*base.SubtestResult, subtests)
+	for i := 0; i < subtests; i++ {
+		results[i] = &base.SubtestResult{}
+	}
+	return &base.JudgeSubmissionTask{
+		SubmissionDescription: &base.SubmissionDescription{Id: id, Username: "alice", Language: "cpp"},
+		JudgeTaskDescription:  &base.JudgeTaskDescription{},
+		Results:               results,
+	}
+}
+
+func TestFinalizeDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	b := broker.NewMemory()
+	events, err := b.Subscribe(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetter(t, b, testTask("s1", 1))
+
+	r := NewRecoverer(b, &downStore{storage.NewMemoryStore()}, time.Second)
+	if err := r.finalizeDeadLetter(ctx, "s1"); err == nil {
+		t.Fatal("store failure not reported")
+	}
+	select {
+	case e := <-events:
+		if e.Type != base.EventFinal || e.Task.FinalVerdict != base.VerdictInternalError {
+			t.Fatalf("event %+v", e)
+		}
+	default:
+		t.Fatal("no final event")
+	}
+	// left to the sweeper
+	tasks, err := b.ListUnpersisted(ctx, time.Now().Add(time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].FinalVerdict != base.VerdictInternalError {
+		t.Fatal("unpersisted", tasks)
+	}
+}
+
+func TestFinalizeDeadLetterLastShard(t *testing.T) {
+	ctx := context.Background()
+	b := broker.NewMemory()
+	store := storage.NewMemoryStore()
+	if err := b.Enqueue(ctx, testTask("s1", 2)); err != nil {
+		t.Fatal(err)
+	}
+	parent, _, err := b.PickOneSubmission()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Shard(ctx, parent, []*base.JudgeSubmissionTask{newShard(parent, 0, []int{0, 1}, "digest")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.PickOneSubmission(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.RecoverExpiredLeases(ctx, time.Now().Add(base.DefaultLeaseDuration+time.Second))
+	if err != nil || len(result.DeadLettered) != 1 {
+		t.Fatal("shard not dead-lettered:", result, err)
+	}
+
+	r := NewRecoverer(b, store, time.Second)
+	if err := r.finalizeDeadLetter(ctx, result.DeadLettered[0]); err != nil {
+		t.Fatal(err)
+	}
+	final, err := store.GetSubmissionResult(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.FinalVerdict != base.VerdictInternalError {
+		t.Fatal("final verdict", final.FinalVerdict)
+	}
+	// the parent is not left leased to be judged again
+	result, err = b.RecoverExpiredLeases(ctx, time.Now().Add(2*base.DefaultLeaseDuration))
+	if err != nil || len(result.Requeued)+len(result.DeadLettered) != 0 {
+		t.Fatal("parent still leased:", result, err)
+	}
+}
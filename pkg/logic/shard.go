@@ -0,0 +1,191 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+)
+
+var errNoArtifactStore = errors.New("no artifact store set")
+
+// shard hands the unjudged subtests of the compiled t over to shards when there are more than
+// shardSize of them, it reports whether t is no longer judged by this worker
+func (p *Processor) shard(t *base.JudgeSubmissionTask, binfile string) bool {
+	if p.artifacts == nil || p.shardSize <= 0 {
+		return false
+	}
+	subtests := make([]int, 0, len(t.Results))
+	for id, result := range t.Results {
+		if result.VerdictCode == base.VerdictUnjudge {
+			subtests = append(subtests, id)
+		}
+	}
+	if len(subtests) <= p.shardSize {
+		return false
+	}
+	sort.Ints(subtests)
+
+	binary, err := os.ReadFile(binfile)
+	if err != nil {
+		fmt.Println("failed to read binary of submission", t.Id, "cause by:", err)
+		return false
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), t.Lease.Deadline())
+	defer cancel()
+	digest, err := p.artifacts.Put(ctx, binary)
+	if err != nil {
+		fmt.Println("failed to store binary of submission", t.Id, "cause by:", err)
+		return false
+	}
+	shards := make([]*base.JudgeSubmissionTask, 0, (len(subtests)+p.shardSize-1)/p.shardSize)
+	for k := 0; k*p.shardSize < len(subtests); k++ {
+		end := min((k+1)*p.shardSize, len(subtests))
+		shards = append(shards, newShard(t, k, subtests[k*p.shardSize:end], digest))
+	}
+
+	err = p.broker.Shard(ctx, t, shards)
+	if err == broker.ErrLeaseLost {
+		fmt.Println("lease lost, abort submission", t.Id)
+		t.Lease.NotifyExpried()
+		return true
+	}
+	if err != nil {
+		if err != broker.ErrShardingUnsupported {
+			fmt.Println("failed to shard submission", t.Id, "cause by:", err)
+		}
+		return false
+	}
+	// the parent is not leased anymore, the monitor stops extending it
+	t.Lease.Release()
+	fmt.Println("sharded submission", t.Id, "into", len(shards), "shards")
+	return true
+}
+
+func newShard(parent *base.JudgeSubmissionTask, k int, subtests []int, digest string) *base.JudgeSubmissionTask {
+	submission := *parent.SubmissionDescription
+	submission.Id = base.ShardId(parent.Id, k)
+	submission.SourceCode = ""
+	submission.ParentId = parent.Id
+	submission.Artifact = digest
+	results := make(map[int]*base.SubtestResult, len(subtests))
+	for _, id := range subtests {
+		results[id] = &base.SubtestResult{
+			VerdictCode: base.VerdictUnjudge,
+		}
+	}
+	return &base.JudgeSubmissionTask{
+		SubmissionDescription: &submission,
+		JudgeTaskDescription: &base.JudgeTaskDescription{
+			MaxRetry:      parent.MaxRetry,
+			FinalVerdict:  base.VerdictUnjudge,
+			TimeLimit:     parent.TimeLimit,
+			MemoryLimit:   parent.MemoryLimit,
+			WallTimeLimit: parent.WallTimeLimit,
+			OutputLimit:   parent.OutputLimit,
+			SyscallAllow:  parent.SyscallAllow,
+			SyscallDeny:   parent.SyscallDeny,
+		},
+		Results: results,
+	}
+}
+
+// processShard judges the subtests of a shard with the binary of its parent and merges the
+// results, the worker merging the last shard computes the final result of the parent
+func (p *Processor) processShard(t *base.JudgeSubmissionTask) {
+	binfile, err := p.fetchArtifact(t)
+	if err != nil {
+		// the shard is retried once its lease expires
+		fmt.Println("failed to fetch binary of shard", t.Id, "cause by:", err)
+		return
+	}
+	p.judgeSubtests(t, binfile)
+	if !t.Lease.IsValid() || hasUnjudged(t) {
+		return
+	}
+	p.mergeShard(t)
+}
+
+// mergeShard merges the results of t into its parent, on failure the merge is retried by the
+// syncer. The syncer only merges: the parent it gets back is handed to exec through mergedCh,
+// since finishing it goes through the monitor and the syncer again.
+func (p *Processor) mergeShard(t *base.JudgeSubmissionTask) {
+	parent, err := p.tryMergeShard(t)
+	if err == nil {
+		if parent != nil {
+			p.finishMerged(parent)
+		}
+		return
+	}
+	fmt.Println("failed to merge shard", t.Id, "cause by:", err)
+	p.syncReqCh <- &syncRequest{
+		fn: func() error {
+			parent, err := p.tryMergeShard(t)
+			if err != nil || parent == nil {
+				return err
+			}
+			select {
+			case p.mergedCh <- parent:
+			default:
+				// the recoverer requeues the parent once its lease expires
+				fmt.Println("too many merged submissions, drop", parent.Id)
+			}
+			return nil
+		},
+		deadline: t.Lease.Deadline(),
+	}
+}
+
+func (p *Processor) tryMergeShard(t *base.JudgeSubmissionTask) (*base.JudgeSubmissionTask, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), t.Lease.Deadline())
+	defer cancel()
+	parent, err := p.broker.MergeShard(ctx, t)
+	if err == broker.ErrLeaseLost {
+		fmt.Println("lease lost, drop results of shard", t.Id)
+		return nil, nil
+	}
+	return parent, err
+}
+
+// finishMerged computes the final result of a parent returned by the merge of its last shard,
+// its new lease is extended by the monitor meanwhile
+func (p *Processor) finishMerged(parent *base.JudgeSubmissionTask) {
+	select {
+	case p.taskInfoCh <- parent:
+	case <-p.ctx.Done():
+		return
+	}
+	p.finish(parent)
+	select {
+	case p.doneCh <- parent.Id:
+	case <-p.ctx.Done():
+	}
+}
+
+// fetchArtifact returns the binary of a shard, binaries are cached by digest so the shards
+// of one submission judged on the same node fetch it once
+func (p *Processor) fetchArtifact(t *base.JudgeSubmissionTask) (string, error) {
+	binfile := binDirPath + t.Artifact
+	if _, err := os.Stat(binfile); err == nil {
+		return binfile, nil
+	}
+	if p.artifacts == nil {
+		return "", errNoArtifactStore
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), t.Lease.Deadline())
+	defer cancel()
+	binary, err := p.artifacts.Get(ctx, t.Artifact)
+	if err != nil {
+		return "", err
+	}
+	// written aside then renamed, so a concurrent shard never runs a partial binary
+	tmpfile := fmt.Sprintf("%s.%s", binfile, t.Id)
+	if err := os.WriteFile(tmpfile, binary, 0755); err != nil {
+		return "", err
+	}
+	return binfile, os.Rename(tmpfile, binfile)
+}
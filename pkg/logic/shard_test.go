@@ -0,0 +1,105 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/storage"
+)
+
+// flakyMerge fails the first merge like a broker which is briefly unreachable
+type flakyMerge struct {
+	*broker.Memory
+	failed bool
+}
+
+func (b *flakyMerge) MergeShard(ctx context.Context, shard *base.JudgeSubmissionTask) (*base.JudgeSubmissionTask, error) {
+	if !b.failed {
+		b.failed = true
+		return nil, errors.New("connection refused")
+	}
+	return b.Memory.MergeShard(ctx, shard)
+}
+
+func TestMergeShardRetry(t *testing.T) {
+	ctx := context.Background()
+	b := &flakyMerge{Memory: broker.NewMemory()}
+	store := storage.NewMemoryStore()
+	p := NewProcessor(b, store, nil, 1)
+
+	task := &base.JudgeSubmissionTask{
+		SubmissionDescription: &base.SubmissionDescription{Id: "s1", Username: "alice", Language: "cpp"},
+		JudgeTaskDescription:  &base.JudgeTaskDescription{MaxRetry: 1},
+		Results:               map[int]*base.SubtestResult{0: {}, 1: {}},
+	}
+	if err := b.Enqueue(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	parent, _, err := b.PickOneSubmission()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := newShard(parent, 0, []int{0, 1}, "digest")
+	if err := b.Shard(ctx, parent, []*base.JudgeSubmissionTask{shard}); err != nil {
+		t.Fatal(err)
+	}
+	shard, _, err = b.PickOneSubmission()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := range shard.Results {
+		shard.UpdateSubtestResult(id, &base.SubtestResult{VerdictCode: base.VerdictAccepted})
+		if err := b.UpdatePartialResult(shard, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p.mergeShard(shard)
+	var req *syncRequest
+	select {
+	case req = <-p.syncReqCh:
+	default:
+		t.Fatal("failed merge not retried")
+	}
+	// the retry runs on the syncer, it must not wait for the monitor
+	done := make(chan error, 1)
+	go func() { done <- req.fn() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("retry:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retry blocked")
+	}
+	var merged *base.JudgeSubmissionTask
+	select {
+	case merged = <-p.mergedCh:
+	default:
+		t.Fatal("merged parent not handed back")
+	}
+
+	go func() {
+		for {
+			select {
+			case <-p.taskInfoCh:
+			case <-p.doneCh:
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+	defer p.cancel()
+	p.finishMerged(merged)
+	result, err := store.GetSubmissionResult(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FinalVerdict != base.VerdictAccepted {
+		t.Fatal("final verdict", result.FinalVerdict)
+	}
+}
@@ -0,0 +1,80 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/storage"
+)
+
+// Sweeper persists the results which were completed in the broker but never saved to the
+// store, e.g. because the judge node crashed in between, so their broker keys can expire.
+type Sweeper struct {
+	stopCh   chan struct{}
+	interval time.Duration
+	broker   broker.Broker
+	store    storage.Store
+}
+
+// a judger keeps retrying to persist its result until its lease deadline, the sweeper
+// only takes over once that is surely over
+const sweepGrace = base.DefaultLeaseDuration * 2
+
+const sweepBatchSize = 100
+
+func NewSweeper(b broker.Broker, store storage.Store, interval time.Duration) *Sweeper {
+	return &Sweeper{
+		stopCh:   make(chan struct{}),
+		interval: interval,
+		broker:   b,
+		store:    store,
+	}
+}
+
+func (s *Sweeper) Start() {
+	timer := time.NewTimer(s.interval)
+LOOP:
+	for {
+		select {
+		case <-s.stopCh:
+			timer.Stop()
+			break LOOP
+		case <-timer.C:
+			s.sweep()
+			timer.Reset(s.interval)
+		}
+	}
+}
+
+func (s *Sweeper) Stop() {
+	close(s.stopCh)
+}
+
+func (s *Sweeper) sweep() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+	defer cancel()
+	before := time.Now().Add(-sweepGrace)
+	for {
+		// the tasks which could be loaded are returned together with the error
+		tasks, err := s.broker.ListUnpersisted(ctx, before, sweepBatchSize)
+		if err != nil {
+			fmt.Println("failed to list unpersisted submissions, cause by:", err)
+		}
+		for _, t := range tasks {
+			if err := s.store.UpdateSubmissionResult(ctx, t); err != nil {
+				fmt.Println("failed to persist submission", t.Id, "cause by:", err)
+				return
+			}
+			if err := s.broker.MarkPersisted(ctx, t.Id); err != nil {
+				fmt.Println("failed to mark submission", t.Id, "persisted, cause by:", err)
+				return
+			}
+		}
+		if err != nil || len(tasks) < sweepBatchSize {
+			return
+		}
+	}
+}
@@ -55,6 +55,7 @@ LOOP:
 					}
 				}
 			}
+			reqs = newReqs
 			timer.Reset(s.interval)
 		}
 	}
@@ -0,0 +1,213 @@
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Cgroups puts every run in its own cgroup v2 leaf below root, which limits its memory, pids
+// and cpu bandwidth and accounts for all its threads and children. The parent of root must
+// have the memory, pids and cpu controllers available and no process of its own.
+type Cgroups struct {
+	root string
+	CPUs float64 // cpu.max of a run in CPUs
+	next atomic.Uint64
+}
+
+const cgroup2SuperMagic = 0x63677270
+
+var cgroupControllers = []string{"memory", "pids", "cpu"}
+
+// cpu.max period, the quota is CPUs times it
+const cpuPeriod = 100000
+
+func NewCgroups(root string) (*Cgroups, error) {
+	parent := filepath.Dir(root)
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(parent, &fs); err != nil {
+		return nil, err
+	}
+	if fs.Type != cgroup2SuperMagic {
+		return nil, fmt.Errorf("%s is not on a cgroup v2 filesystem", parent)
+	}
+	available, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	for _, controller := range cgroupControllers {
+		if !containsField(available, controller) {
+			return nil, fmt.Errorf("controller %s is not available in %s", controller, parent)
+		}
+	}
+	if err := enableControllers(parent); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if err := enableControllers(root); err != nil {
+		return nil, err
+	}
+	return &Cgroups{root: root, CPUs: 1}, nil
+}
+
+func enableControllers(dir string) error {
+	enabled, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	var add []string
+	for _, controller := range cgroupControllers {
+		if !containsField(enabled, controller) {
+			add = append(add, "+"+controller)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	if err := writeFile(dir, "cgroup.subtree_control", strings.Join(add, " ")); err != nil {
+		// EBUSY when dir has processes of its own
+		return fmt.Errorf("enable controllers in %s: %w", dir, err)
+	}
+	return nil
+}
+
+func containsField(buf []byte, field string) bool {
+	for _, f := range strings.Fields(string(buf)) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFile writes an existing interface file, cgroupfs refuses O_CREAT with EACCES
+func writeFile(dir, name, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type cgroup struct {
+	path string
+}
+
+// create makes the leaf of one run with its limits set
+func (c *Cgroups) create(limits Limits) (*cgroup, error) {
+	g := &cgroup{path: filepath.Join(c.root, fmt.Sprintf("run-%d-%d", os.Getpid(), c.next.Add(1)))}
+	if err := os.Mkdir(g.path, 0755); err != nil {
+		return nil, err
+	}
+	settings := []struct{ name, value string }{
+		{"memory.max", limitValue(limits.Memory)},
+		// the whole run is killed on oom, not only its biggest process
+		{"memory.oom.group", "1"},
+		{"pids.max", limitValue(limits.Processes)},
+		{"cpu.max", fmt.Sprintf("%d %d", int64(c.CPUs*cpuPeriod), cpuPeriod)},
+	}
+	for _, s := range settings {
+		if err := writeFile(g.path, s.name, s.value); err != nil {
+			g.remove()
+			return nil, fmt.Errorf("set %s: %w", s.name, err)
+		}
+	}
+	// missing when the kernel has no swap accounting
+	if err := writeFile(g.path, "memory.swap.max", "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		g.remove()
+		return nil, fmt.Errorf("set memory.swap.max: %w", err)
+	}
+	return g, nil
+}
+
+func limitValue(v int64) string {
+	if v <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+type cgroupUsage struct {
+	userTime   time.Duration
+	sysTime    time.Duration
+	memoryPeak int64 // bytes, 0 before linux 5.19 which has no memory.peak
+	oomKilled  bool
+}
+
+func (g *cgroup) usage() (*cgroupUsage, error) {
+	u := new(cgroupUsage)
+	cpu, err := readKeyed(g.path, "cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	u.userTime = time.Duration(cpu["user_usec"]) * time.Microsecond
+	u.sysTime = time.Duration(cpu["system_usec"]) * time.Microsecond
+	events, err := readKeyed(g.path, "memory.events")
+	if err != nil {
+		return nil, err
+	}
+	u.oomKilled = events["oom_kill"] > 0
+	peak, err := os.ReadFile(filepath.Join(g.path, "memory.peak"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		u.memoryPeak, _ = strconv.ParseInt(string(bytes.TrimSpace(peak)), 10, 64)
+	}
+	return u, nil
+}
+
+// cpuTime is the user and system time used so far by the run
+func (g *cgroup) cpuTime() time.Duration {
+	cpu, err := readKeyed(g.path, "cpu.stat")
+	if err != nil {
+		return 0
+	}
+	return time.Duration(cpu["usage_usec"]) * time.Microsecond
+}
+
+// readKeyed reads a flat keyed file such as cpu.stat
+func readKeyed(dir, name string) (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			values[fields[0]], _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// remove kills what is left in the leaf and deletes it, the processes of a torn down pid
+// namespace may take a moment to exit
+func (g *cgroup) remove() {
+	writeFile(g.path, "cgroup.kill", "1")
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = os.Remove(g.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	fmt.Println("failed to remove cgroup", g.path, "cause by:", err)
+}
@@ -0,0 +1,501 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Namespaces runs every program as pid 1 of new mount, pid, network, ipc and uts namespaces.
+// Its root is a read-only tmpfs holding read-only binds of RootPaths, the Cmd binds, a few
+// devices and a writable tmpfs on /tmp. All capabilities are dropped and, when the judge
+// runs as root, the program runs as an unprivileged uid of its own so RLIMIT_NPROC is not
+// shared by concurrent runs. Killing the program tears down the whole pid namespace.
+//
+// The judge re-executes itself to set up the sandbox, so main must call Init first.
+type Namespaces struct {
+	RootPaths []string // host directories visible read-only at the same path
+	TmpSize   int64    // bytes of the writable /tmp
+	nextUid   atomic.Uint32
+	cgroups   *Cgroups
+}
+
+var _ Runner = (*Namespaces)(nil)
+
+var DefaultRootPaths = []string{"/bin", "/lib", "/lib32", "/lib64", "/usr", "/etc/alternatives"}
+
+const defaultTmpSize = 16 << 20
+
+// programs run as uids from this range, one per run in turn
+const (
+	uidBase  = 200000
+	uidCount = 4096
+)
+
+// initArg0 is the argv[0] the judge is re-executed with to become the sandbox init
+const initArg0 = "judgo-sandbox-init"
+
+// errFd is a close-on-exec pipe init writes its setup error to, exec closing it means success
+const errFd = 3
+
+var devices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+func NewNamespaces() *Namespaces {
+	return &Namespaces{
+		RootPaths: DefaultRootPaths,
+		TmpSize:   defaultTmpSize,
+	}
+}
+
+// SetCgroups runs every program in a cgroup of c, without them memory is only judged afterwards
+func (n *Namespaces) SetCgroups(c *Cgroups) {
+	n.cgroups = c
+}
+
+// initConfig is passed to init as its only argument
+type initConfig struct {
+	Root      string   `json:"root"`
+	RootPaths []string `json:"root_paths"`
+	Binds     []Bind   `json:"binds"`
+	TmpSize   int64    `json:"tmp_size"`
+	Limits    Limits   `json:"limits"`
+	Args      []string `json:"args"`
+	Uid       int      `json:"uid"`    // 0 keeps the uid, in a user namespace
+	Cgroup    string   `json:"cgroup"` // joined right before dropping privileges
+	Seccomp   bool     `json:"seccomp"`
+	Syscalls  []string `json:"syscalls"`
+}
+
+func (n *Namespaces) Run(ctx context.Context, c *Cmd) (*Usage, error) {
+	root, err := os.MkdirTemp("", "judgo-sandbox-")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSetup, err)
+	}
+	defer os.RemoveAll(root)
+
+	cfg := &initConfig{
+		Root:      root,
+		RootPaths: n.RootPaths,
+		TmpSize:   n.TmpSize,
+		Limits:    c.Limits,
+		Args:      c.Args,
+		Seccomp:   c.Syscalls != nil,
+		Syscalls:  c.Syscalls,
+	}
+	for _, b := range c.Binds {
+		source, err := filepath.Abs(b.Source)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSetup, err)
+		}
+		cfg.Binds = append(cfg.Binds, Bind{Source: source, Target: b.Target, Writable: b.Writable})
+	}
+	attr := &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if os.Geteuid() == 0 {
+		cfg.Uid = uidBase + int(n.nextUid.Add(1)%uidCount)
+	} else {
+		// unprivileged judges get root of a user namespace to set up the mounts
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+	}
+	var g *cgroup
+	if n.cgroups != nil {
+		if g, err = n.cgroups.create(c.Limits); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSetup, err)
+		}
+		defer g.remove()
+		cfg.Cgroup = g.path
+	}
+	arg, _ := json.Marshal(cfg)
+
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSetup, err)
+	}
+	defer errR.Close()
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = []string{initArg0, string(arg)}
+	// no preemption signal may hit init between installing the filter and execve
+	cmd.Env = []string{"GODEBUG=asyncpreemptoff=1"}
+	// the output is only copied once the process started
+	s := newSupervisor(func() { cmd.Process.Kill() })
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = s.limitOutput(c.Stdout, c.Limits.Output)
+	cmd.Stderr = s.limitOutput(c.Stderr, c.Limits.Output)
+	cmd.ExtraFiles = []*os.File{errW}
+	cmd.SysProcAttr = attr
+	notifySock := -1
+	if cfg.Seccomp {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			errW.Close()
+			return nil, fmt.Errorf("%w: %v", ErrSetup, err)
+		}
+		notifySock = fds[0]
+		cmd.ExtraFiles = append(cmd.ExtraFiles, os.NewFile(uintptr(fds[1]), "notify"))
+	}
+
+	start := time.Now()
+	err = cmd.Start()
+	// only init keeps its ends, reading ours then sees it exec or exit
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	if err != nil {
+		if notifySock >= 0 {
+			syscall.Close(notifySock)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrSetup, err)
+	}
+	cpuTime := func() time.Duration { return procCPUTime(cmd.Process.Pid) }
+	if g != nil {
+		cpuTime = g.cpuTime
+	}
+	s.watch(ctx, c.Limits, cpuTime)
+	var notify *notifier
+	if notifySock >= 0 {
+		notify = newNotifier(notifySock, cmd.Process.Pid, func() { s.terminate(TerminationSecurityViolation) })
+	}
+	setupErr, _ := io.ReadAll(errR)
+	err = cmd.Wait()
+	blockedNr, blocked := 0, false
+	if notify != nil {
+		blockedNr, blocked = notify.wait()
+	}
+	killed := s.stop()
+	if len(setupErr) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSetup, setupErr)
+	}
+	usage := usageOf(cmd.ProcessState.SysUsage().(*syscall.Rusage),
+		cmd.ProcessState.Sys().(syscall.WaitStatus), time.Since(start))
+	if g != nil {
+		cu, cgErr := g.usage()
+		if cgErr != nil {
+			return nil, fmt.Errorf("%w: read cgroup usage: %v", ErrSetup, cgErr)
+		}
+		usage.UserTime = cu.userTime
+		usage.SysTime = cu.sysTime
+		usage.MemoryPeak = cu.memoryPeak
+		usage.OOMKilled = cu.oomKilled
+	}
+	usage.SeccompViolation, usage.Syscall = blocked, blockedNr
+	usage.Termination = killed
+	if killed == "" {
+		usage.Termination = terminationOf(usage, c.Limits)
+	}
+	return usage, err
+}
+
+// Init turns the process into the sandbox init when it was started by Namespaces.Run, it then
+// never returns. Otherwise it returns right away.
+func Init() {
+	if len(os.Args) != 2 || os.Args[0] != initArg0 {
+		return
+	}
+	// the seccomp filter is installed on this thread, execve must come from it
+	runtime.LockOSThread()
+	syscall.CloseOnExec(errFd)
+	syscall.CloseOnExec(notifyFd)
+	cfg := new(initConfig)
+	err := json.Unmarshal([]byte(os.Args[1]), cfg)
+	if err == nil {
+		err = cfg.enter()
+	}
+	// enter only returns on failure
+	fmt.Fprint(os.NewFile(errFd, "err"), err)
+	os.Exit(127)
+}
+
+func (cfg *initConfig) enter() error {
+	// opened before the host filesystem goes away with the pivot
+	var procs *os.File
+	if cfg.Cgroup != "" {
+		var err error
+		if procs, err = os.OpenFile(filepath.Join(cfg.Cgroup, "cgroup.procs"), os.O_WRONLY, 0); err != nil {
+			return err
+		}
+	}
+	if err := cfg.mountRoot(); err != nil {
+		return err
+	}
+	if err := syscall.Sethostname([]byte("sandbox")); err != nil {
+		return fmt.Errorf("sethostname: %w", err)
+	}
+	env := []string{"PATH=/usr/local/bin:/usr/bin:/bin", "HOME=/tmp", "LANG=C.UTF-8"}
+	os.Setenv("PATH", "/usr/local/bin:/usr/bin:/bin")
+	path, err := exec.LookPath(cfg.Args[0])
+	if err != nil {
+		return err
+	}
+	// joining this late leaves the memory of the setup charged to the judge, so memory.peak
+	// is close to what the program itself uses
+	if procs != nil {
+		if _, err := procs.WriteString("0"); err != nil {
+			return fmt.Errorf("join cgroup: %w", err)
+		}
+		procs.Close()
+	}
+	if err := dropPrivileges(cfg.Uid); err != nil {
+		return err
+	}
+	// RLIMIT_NPROC counts every process of the uid on the host, pids.max only the run
+	if cfg.Cgroup != "" {
+		cfg.Limits.Processes = 0
+	}
+	if !cfg.Seccomp {
+		if err := cfg.Limits.apply(); err != nil {
+			return err
+		}
+		return syscall.Exec(path, cfg.Args, env)
+	}
+	e, err := prepareFilteredExec(path, cfg.Args, env, cfg.Syscalls)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Limits.apply(); err != nil {
+		return err
+	}
+	return e.exec()
+}
+
+// mountRoot builds the root of the sandbox on cfg.Root and pivots into it
+func (cfg *initConfig) mountRoot() error {
+	// keep the mounts below from propagating to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make / private: %w", err)
+	}
+	root := cfg.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID, "size=1m,mode=755"); err != nil {
+		return fmt.Errorf("mount root: %w", err)
+	}
+	for _, path := range cfg.RootPaths {
+		if err := bindHostPath(root, path); err != nil {
+			return err
+		}
+	}
+	for _, path := range devices {
+		if err := bind(path, filepath.Join(root, path), syscall.MS_RDONLY); err != nil {
+			return err
+		}
+	}
+	for _, b := range cfg.Binds {
+		flags := uintptr(syscall.MS_NODEV | syscall.MS_RDONLY)
+		if b.Writable {
+			flags = syscall.MS_NODEV
+		}
+		if err := bind(b.Source, filepath.Join(root, b.Target), flags); err != nil {
+			return err
+		}
+	}
+	tmp := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	opts := fmt.Sprintf("size=%d,mode=1777", cfg.TmpSize)
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, opts); err != nil {
+		return fmt.Errorf("mount /tmp: %w", err)
+	}
+	proc := filepath.Join(root, "proc")
+	if err := os.MkdirAll(proc, 0755); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("proc", proc, "proc", flags, ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+
+	// pivot_root(".", ".") stacks the old root on the new one, it is then detached
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detach old root: %w", err)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID, ""); err != nil {
+		return fmt.Errorf("remount root read-only: %w", err)
+	}
+	return os.Chdir("/tmp")
+}
+
+// bindHostPath makes the host path visible at the same place, symlinks such as /bin -> usr/bin
+// are copied as they are
+func bindHostPath(root, path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(root, path)
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	return bind(path, target, syscall.MS_NODEV|syscall.MS_RDONLY)
+}
+
+// bind mounts source on target with the mount flags, creating target as a file or directory like source
+func bind(source, target string, flags uintptr) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else {
+		var f *os.File
+		f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", source, err)
+	}
+	// the flags are only applied by a remount of the bind
+	flags |= syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_NOSUID
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s: %w", source, err)
+	}
+	return nil
+}
+
+const (
+	prCapbsetDrop     = 24
+	prSetNoNewPrivs   = 38
+	prCapAmbient      = 47
+	prCapAmbientClear = 4
+	linuxCapVersion3  = 0x20080522
+	rlimitNproc       = 6
+)
+
+// dropPrivileges empties the capability sets and switches to uid when it is not 0
+func dropPrivileges(uid int) error {
+	for c := 0; ; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(c), 0); errno != 0 {
+			// EINVAL past the last capability of the kernel
+			if errno != syscall.EINVAL || c == 0 {
+				return fmt.Errorf("drop bounding capability %d: %w", c, errno)
+			}
+			break
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClear, 0); errno != 0 {
+		return fmt.Errorf("clear ambient capabilities: %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("set no_new_privs: %w", errno)
+	}
+	if uid != 0 {
+		if err := syscall.Setgroups(nil); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(uid); err != nil {
+			return fmt.Errorf("setgid: %w", err)
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %w", err)
+		}
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data)), 0); errno != 0 {
+		return fmt.Errorf("capset: %w", errno)
+	}
+	return nil
+}
+
+// cpuRlimit is CPUTime rounded up to a second plus one, the supervisor kills first
+func cpuRlimit(cpuTime time.Duration) int64 {
+	if cpuTime <= 0 {
+		return 0
+	}
+	return int64((cpuTime+time.Second-1)/time.Second) + 1
+}
+
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat
+const clockTicks = 100
+
+// procCPUTime reads the user and system time of a live process and its reaped children,
+// 0 once it is gone
+func procCPUTime(pid int) time.Duration {
+	buf, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// the command name may contain spaces, the fields after it do not
+	i := bytes.LastIndexByte(buf, ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(buf[i+1:]))
+	// utime, stime, cutime and cstime are the fields 14 to 17, the state is field 3
+	if len(fields) < 15 {
+		return 0
+	}
+	var ticks int64
+	for _, f := range fields[11:15] {
+		v, _ := strconv.ParseInt(f, 10, 64)
+		ticks += v
+	}
+	return time.Duration(ticks) * time.Second / clockTicks
+}
+
+func (l *Limits) apply() error {
+	limits := []struct {
+		resource int
+		value    int64
+	}{
+		{syscall.RLIMIT_CPU, cpuRlimit(l.CPUTime)},
+		{syscall.RLIMIT_AS, l.AddressSpace},
+		{syscall.RLIMIT_FSIZE, l.FileSize},
+		{syscall.RLIMIT_NOFILE, l.OpenFiles},
+		{rlimitNproc, l.Processes},
+		{syscall.RLIMIT_CORE, 0},
+	}
+	for _, limit := range limits {
+		if limit.value <= 0 && limit.resource != syscall.RLIMIT_CORE {
+			continue
+		}
+		rlimit := &syscall.Rlimit{Cur: uint64(limit.value), Max: uint64(limit.value)}
+		if err := syscall.Setrlimit(limit.resource, rlimit); err != nil {
+			return fmt.Errorf("setrlimit %d: %w", limit.resource, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// the runs below re-execute the test binary as their init
+func TestMain(m *testing.M) {
+	Init()
+	os.Exit(m.Run())
+}
+
+// run runs sh -c script in a Namespaces sandbox, it skips the test where no sandbox can be set up
+func run(t *testing.T, n *Namespaces, script string, limits Limits, syscalls []string) (*Usage, []byte, error) {
+	t.Helper()
+	var stdout bytes.Buffer
+	usage, err := n.Run(context.Background(), &Cmd{
+		Args:     []string{"sh", "-c", script},
+		Limits:   limits,
+		Syscalls: syscalls,
+		Stdout:   &stdout,
+	})
+	if errors.Is(err, ErrSetup) {
+		t.Skip(err)
+	}
+	return usage, stdout.Bytes(), err
+}
+
+func testLimits() Limits {
+	return Limits{CPUTime: time.Second, WallTime: 3 * time.Second, Output: 1 << 20}
+}
+
+func TestNamespacesExitCode(t *testing.T) {
+	usage, stdout, err := run(t, NewNamespaces(), "echo hello; exit 3", testLimits(), nil)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatal("err", err)
+	}
+	if usage.ExitCode != 3 || usage.Termination != TerminationExited {
+		t.Fatalf("exit code %d, termination %s", usage.ExitCode, usage.Termination)
+	}
+	if string(stdout) != "hello\n" {
+		t.Fatalf("stdout %q", stdout)
+	}
+}
+
+func TestNamespacesTimeLimit(t *testing.T) {
+	limits := testLimits()
+	limits.CPUTime = 200 * time.Millisecond
+	usage, _, err := run(t, NewNamespaces(), "while :; do :; done", limits, nil)
+	if err == nil || usage.Termination != TerminationCPUTimeLimit {
+		t.Fatalf("termination %s, err %v", usage.Termination, err)
+	}
+	if usage.CPUTime() < limits.CPUTime || usage.WallTime >= limits.WallTime {
+		t.Fatalf("cpu time %v, wall time %v", usage.CPUTime(), usage.WallTime)
+	}
+
+	usage, _, err = run(t, NewNamespaces(), "sleep 10", Limits{CPUTime: time.Second, WallTime: 200 * time.Millisecond}, nil)
+	if err == nil || usage.Termination != TerminationWallTimeLimit {
+		t.Fatalf("termination %s, err %v", usage.Termination, err)
+	}
+}
+
+// the shell keeps the whole output of the substitution in memory
+const memoryHog = "x=$(head -c 200000000 /dev/zero | tr '\\0' a); echo ${#x}"
+
+func TestNamespacesAddressSpaceLimit(t *testing.T) {
+	limits := testLimits()
+	limits.AddressSpace = 128 << 20
+	usage, stdout, err := run(t, NewNamespaces(), memoryHog, limits, nil)
+	if err == nil || len(stdout) > 0 {
+		t.Fatalf("allocated past the address space limit: %q, err %v", stdout, err)
+	}
+	if usage.MaxRSS<<10 > limits.AddressSpace {
+		t.Fatalf("max rss %d KB", usage.MaxRSS)
+	}
+}
+
+func TestNamespacesMemoryLimit(t *testing.T) {
+	c, err := NewCgroups("/sys/fs/cgroup/judgo-test")
+	if err != nil {
+		t.Skip("no cgroup v2:", err)
+	}
+	t.Cleanup(func() { os.Remove("/sys/fs/cgroup/judgo-test") })
+	n := NewNamespaces()
+	n.SetCgroups(c)
+	limits := testLimits()
+	limits.Memory = 64 << 20
+	usage, _, err := run(t, n, memoryHog, limits, nil)
+	if err == nil || !usage.OOMKilled || usage.MemoryPeak < limits.Memory-(1<<20) {
+		t.Fatalf("oom killed %v, memory peak %d, err %v", usage.OOMKilled, usage.MemoryPeak, err)
+	}
+}
+
+func TestNamespacesOutputLimit(t *testing.T) {
+	limits := testLimits()
+	limits.Output = 1024
+	usage, stdout, err := run(t, NewNamespaces(), "yes", limits, nil)
+	if err == nil || usage.Termination != TerminationOutputLimit {
+		t.Fatalf("termination %s, err %v", usage.Termination, err)
+	}
+	if int64(len(stdout)) > limits.Output {
+		t.Fatalf("%d bytes of output kept", len(stdout))
+	}
+}
+
+func TestNamespacesSeccomp(t *testing.T) {
+	if !SeccompSupported() {
+		t.Skip(errSeccompUnsupported)
+	}
+	// the shell needs more than the strict profile allows, it is killed at the first other syscall
+	usage, stdout, err := run(t, NewNamespaces(), "ls /; echo unreachable", testLimits(), ProfileStrict)
+	if err == nil || !usage.SeccompViolation || usage.Termination != TerminationSecurityViolation {
+		t.Fatalf("violation %v, termination %s, err %v", usage.SeccompViolation, usage.Termination, err)
+	}
+	if usage.Syscall == 0 || len(stdout) > 0 {
+		t.Fatalf("killed at syscall %d, stdout %q", usage.Syscall, stdout)
+	}
+
+	usage, stdout, err = run(t, NewNamespaces(), "echo hello", testLimits(), ProfileRuntime)
+	if err != nil || usage.SeccompViolation || string(stdout) != "hello\n" {
+		t.Fatalf("violation %v, stdout %q, err %v", usage.SeccompViolation, stdout, err)
+	}
+}
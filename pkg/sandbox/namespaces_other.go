@@ -0,0 +1,40 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// Namespaces needs linux, elsewhere every run fails with ErrSetup
+type Namespaces struct{}
+
+var _ Runner = (*Namespaces)(nil)
+
+func NewNamespaces() *Namespaces {
+	return &Namespaces{}
+}
+
+func (n *Namespaces) Run(ctx context.Context, c *Cmd) (*Usage, error) {
+	return nil, fmt.Errorf("%w: namespaces are not supported on %s", ErrSetup, runtime.GOOS)
+}
+
+func Init() {}
+
+// Cgroups needs linux
+type Cgroups struct {
+	CPUs float64
+}
+
+func NewCgroups(root string) (*Cgroups, error) {
+	return nil, fmt.Errorf("cgroups are not supported on %s", runtime.GOOS)
+}
+
+func (n *Namespaces) SetCgroups(c *Cgroups) {}
+
+// seccomp needs linux
+func SeccompSupported() bool {
+	return false
+}
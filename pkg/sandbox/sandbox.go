@@ -0,0 +1,275 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Runner runs one untrusted program to completion
+type Runner interface {
+	// Run returns the usage of the program whenever it was started, err is set when it did not
+	// exit with status 0. A sandbox which could not be set up returns an error wrapping ErrSetup.
+	Run(ctx context.Context, cmd *Cmd) (*Usage, error)
+}
+
+var ErrSetup = errors.New("sandbox setup failed")
+
+// Cmd is a program to run, Args[0] is looked up in PATH inside the sandbox if it has no slash
+type Cmd struct {
+	Args   []string
+	Binds  []Bind // host files made visible inside the sandbox
+	Limits Limits
+	// syscalls allowed by a seccomp filter, nil runs without filter. Not applied by Unconfined
+	Syscalls []string
+	Stdin    io.Reader
+	Stdout   io.Writer
+	Stderr   io.Writer
+}
+
+type Bind struct {
+	Source   string // host path
+	Target   string // absolute path inside the sandbox
+	Writable bool   // read-only unless set, e.g. for the directory a compiler writes to
+}
+
+// Limits are applied with setrlimit, zero leaves a limit unset. Memory is only enforced
+// in a cgroup, Processes is then its pids.max instead of RLIMIT_NPROC. The run is killed as soon as it used up
+// CPUTime or WallTime, the cpu rlimit only backs it up a second later. Output caps what is
+// written to Stdout and to Stderr each, the run is killed once it prints more.
+type Limits struct {
+	CPUTime      time.Duration // user and system time
+	WallTime     time.Duration
+	Memory       int64 // bytes
+	AddressSpace int64 // bytes
+	FileSize     int64 // bytes
+	OpenFiles    int64
+	Processes    int64 // threads count too
+	Output       int64 // bytes
+}
+
+// Usage of a run, in a cgroup the cpu times cover all threads and children
+type Usage struct {
+	UserTime   time.Duration
+	SysTime    time.Duration
+	WallTime   time.Duration
+	MaxRSS     int64 // KB
+	MemoryPeak int64 // bytes, 0 when not run in a cgroup
+	OOMKilled  bool
+	ExitCode   int // -1 when killed by a signal
+	Signal     syscall.Signal
+	// the program was killed at syscall number Syscall, which its filter does not allow
+	SeccompViolation bool
+	Syscall          int
+	Termination      string // how the run ended, one of the Termination constants
+}
+
+// CPUTime is the user and system time of the run
+func (u *Usage) CPUTime() time.Duration {
+	return u.UserTime + u.SysTime
+}
+
+const (
+	TerminationExited       = "exited"
+	TerminationSignaled     = "signaled"
+	TerminationCPUTimeLimit = "cpu_time_limit"
+	// the wall time ran out before the cpu time, the program was sleeping or blocked
+	TerminationWallTimeLimit     = "wall_time_limit"
+	TerminationMemoryLimit       = "memory_limit"
+	TerminationSecurityViolation = "security_violation"
+	TerminationOutputLimit       = "output_limit"
+	TerminationCancelled         = "cancelled"
+)
+
+// how often the cpu time of a run is checked against its limit
+const cpuCheckInterval = time.Millisecond * 10
+
+// supervisor kills a started run at the first limit it exceeds, or when ctx is done, and
+// remembers why
+type supervisor struct {
+	once   sync.Once
+	kill   func()
+	reason string
+	done   chan struct{}
+	exited chan struct{}
+}
+
+func newSupervisor(kill func()) *supervisor {
+	return &supervisor{
+		kill:   kill,
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+}
+
+// watch starts watching the started run, cpuTime reads how much cpu the run used so far and
+// may be nil when it cannot be read while the run is alive
+func (s *supervisor) watch(ctx context.Context, limits Limits, cpuTime func() time.Duration) {
+	go func() {
+		defer close(s.done)
+		var wall <-chan time.Time
+		if limits.WallTime > 0 {
+			timer := time.NewTimer(limits.WallTime)
+			defer timer.Stop()
+			wall = timer.C
+		}
+		var cpu <-chan time.Time
+		if limits.CPUTime > 0 && cpuTime != nil {
+			ticker := time.NewTicker(cpuCheckInterval)
+			defer ticker.Stop()
+			cpu = ticker.C
+		}
+		for {
+			select {
+			case <-s.exited:
+				return
+			case <-ctx.Done():
+				s.terminate(TerminationCancelled)
+				return
+			case <-wall:
+				if cpuTime != nil && limits.CPUTime > 0 && cpuTime() >= limits.CPUTime {
+					s.terminate(TerminationCPUTimeLimit)
+				} else {
+					s.terminate(TerminationWallTimeLimit)
+				}
+				return
+			case <-cpu:
+				if cpuTime() >= limits.CPUTime {
+					s.terminate(TerminationCPUTimeLimit)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// limitOutput caps w at limit bytes, the run is killed at the first byte beyond it. The
+// rest is discarded so the run does not block on a full pipe until it is gone.
+func (s *supervisor) limitOutput(w io.Writer, limit int64) io.Writer {
+	if w == nil || limit <= 0 {
+		return w
+	}
+	return &limitedWriter{w: w, remaining: limit, exceeded: func() { s.terminate(TerminationOutputLimit) }}
+}
+
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+	exceeded  func()
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		if len(p) > 0 {
+			l.exceeded()
+		}
+		return len(p), nil
+	}
+	n := len(p)
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	written, err := l.w.Write(p)
+	l.remaining -= int64(written)
+	if err != nil {
+		return written, err
+	}
+	if written < n {
+		l.exceeded()
+	}
+	return n, nil
+}
+
+// terminate kills the run for reason unless it was already killed
+func (s *supervisor) terminate(reason string) {
+	s.once.Do(func() {
+		s.reason = reason
+		s.kill()
+	})
+}
+
+// stop is called once the run exited, it returns why the run was killed if it was
+func (s *supervisor) stop() string {
+	close(s.exited)
+	<-s.done
+	// waits for a terminate in progress and keeps later ones from killing a reused pid
+	s.once.Do(func() {})
+	return s.reason
+}
+
+// terminationOf tells how a run which was not killed by its supervisor ended
+func terminationOf(u *Usage, limits Limits) string {
+	switch {
+	case u.SeccompViolation:
+		return TerminationSecurityViolation
+	case u.OOMKilled:
+		return TerminationMemoryLimit
+	case u.Signal == 0:
+		return TerminationExited
+	// the cpu rlimit kills with SIGKILL, SIGXCPU is only sent below a higher hard limit
+	case (u.Signal == syscall.SIGKILL || u.Signal == syscall.SIGXCPU) &&
+		limits.CPUTime > 0 && u.CPUTime() >= limits.CPUTime:
+		return TerminationCPUTimeLimit
+	}
+	return TerminationSignaled
+}
+
+func usageOf(state *syscall.Rusage, status syscall.WaitStatus, wall time.Duration) *Usage {
+	u := &Usage{
+		UserTime: time.Duration(state.Utime.Nano()),
+		SysTime:  time.Duration(state.Stime.Nano()),
+		WallTime: wall,
+		MaxRSS:   state.Maxrss,
+		ExitCode: status.ExitStatus(),
+	}
+	if status.Signaled() {
+		u.Signal = status.Signal()
+	}
+	return u
+}
+
+// Unconfined runs programs as a plain child process of the judge, only for development
+// on machines where the namespaces cannot be created
+type Unconfined struct{}
+
+var _ Runner = Unconfined{}
+
+func (Unconfined) Run(ctx context.Context, c *Cmd) (*Usage, error) {
+	// the args naming a bind target or a path below it are given the host path instead
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		for _, b := range c.Binds {
+			if arg == b.Target || strings.HasPrefix(arg, b.Target+"/") {
+				arg = b.Source + strings.TrimPrefix(arg, b.Target)
+				break
+			}
+		}
+		args[i] = arg
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	// the output is only copied once the process started
+	s := newSupervisor(func() { cmd.Process.Kill() })
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = s.limitOutput(c.Stdout, c.Limits.Output)
+	cmd.Stderr = s.limitOutput(c.Stderr, c.Limits.Output)
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// only the wall time is watched, the cpu time is known once the program exited
+	s.watch(ctx, c.Limits, nil)
+	err := cmd.Wait()
+	killed := s.stop()
+	usage := usageOf(cmd.ProcessState.SysUsage().(*syscall.Rusage),
+		cmd.ProcessState.Sys().(syscall.WaitStatus), time.Since(start))
+	usage.Termination = killed
+	if killed == "" {
+		usage.Termination = terminationOf(usage, c.Limits)
+	}
+	return usage, err
+}
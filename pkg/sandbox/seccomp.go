@@ -0,0 +1,52 @@
+package sandbox
+
+// Seccomp profiles are allowlists of syscall names, whatever else a program calls stops it
+// with a security violation. Cmd.Syscalls usually is one of them with the allow and deny
+// lists of the problem applied by WithSyscalls.
+
+// ProfileStrict is for natively compiled programs such as C or C++, which only compute
+// and do I/O on the descriptors they were given
+var ProfileStrict = []string{
+	"read", "write", "readv", "writev", "pread64", "pwrite64", "lseek", "close",
+	"fstat", "newfstatat", "statx", "ioctl", "fcntl",
+	"brk", "mmap", "munmap", "mprotect", "mremap", "madvise",
+	"arch_prctl", "set_tid_address", "set_robust_list", "rseq", "prlimit64", "getrandom",
+	"openat", "access", "faccessat", "faccessat2", "readlink", "readlinkat",
+	"rt_sigaction", "rt_sigprocmask", "rt_sigreturn", "sigaltstack",
+	"futex", "sched_yield", "nanosleep", "clock_nanosleep", "clock_gettime", "clock_getres",
+	"gettimeofday", "time", "getrusage", "times", "sysinfo", "uname",
+	"getpid", "gettid", "tgkill", "getuid", "geteuid", "getgid", "getegid",
+	"exit", "exit_group",
+}
+
+// ProfileRuntime is for interpreters and virtual machines such as python or a JVM, which
+// also read their libraries, start threads and look around the process
+var ProfileRuntime = append(append([]string(nil), ProfileStrict...),
+	"open", "stat", "lstat", "getdents64", "getcwd", "chdir", "dup", "dup2", "dup3",
+	"pipe", "pipe2", "poll", "ppoll", "select", "pselect6",
+	"epoll_create1", "epoll_ctl", "epoll_wait", "epoll_pwait", "eventfd2",
+	"clone", "clone3", "wait4", "kill", "tkill", "rt_sigsuspend", "rt_sigtimedwait",
+	"sched_getaffinity", "sched_setaffinity", "sched_getparam", "sched_getscheduler",
+	"getppid", "getpgrp", "getresuid", "getresgid", "getpriority", "getxattr", "lgetxattr",
+	"mincore", "membarrier", "prctl", "ftruncate", "fsync", "fdatasync",
+	"mkdir", "rmdir", "unlink", "unlinkat", "rename", "umask",
+)
+
+// WithSyscalls returns profile with allow added and deny removed
+func WithSyscalls(profile, allow, deny []string) []string {
+	denied := make(map[string]bool, len(deny))
+	for _, name := range deny {
+		denied[name] = true
+	}
+	syscalls := make([]string, 0, len(profile)+len(allow))
+	seen := make(map[string]bool, len(profile)+len(allow))
+	for _, list := range [][]string{profile, allow} {
+		for _, name := range list {
+			if !denied[name] && !seen[name] {
+				seen[name] = true
+				syscalls = append(syscalls, name)
+			}
+		}
+	}
+	return syscalls
+}
@@ -0,0 +1,295 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// A syscall outside the filter is not failed but handed to the judge through a seccomp user
+// notification listener, so the judge learns its number before it kills the program. Init
+// installs the filter on its own thread right before execve and writes the number of the
+// listener to the notifyFd socket, the judge takes the listener out of init with pidfd_getfd.
+// execve and execveat are never allowed by the filter: the notifier lets the first execve,
+// the one of init, continue and stops the program at any later one.
+
+// notifyFd is the socket init writes the number of the seccomp listener to
+const notifyFd = 4
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFlagNewListener = 1 << 3
+	seccompRetKillProcess  = 0x80000000
+	seccompRetUserNotif    = 0x7fc00000
+	seccompRetAllow        = 0x7fff0000
+	seccompIoctlNotifRecv  = 0xc0502100 // SECCOMP_IOCTL_NOTIF_RECV
+	seccompIoctlNotifSend  = 0xc0182101 // SECCOMP_IOCTL_NOTIF_SEND
+	seccompNotifContinue   = 1          // SECCOMP_USER_NOTIF_FLAG_CONTINUE
+
+	// the same number on every architecture
+	sysPidfdOpen  = 434
+	sysPidfdGetfd = 438
+
+	bpfLdAbsW = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK   = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK   = 0x06 // BPF_RET | BPF_K
+
+	// offsets in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// syscalls of the x32 abi have this bit set on amd64
+	x32SyscallBit = 0x40000000
+)
+
+var errSeccompUnsupported = errors.New("seccomp is not supported on " + runtime.GOARCH)
+
+var errNoWrite = errors.New("a seccomp filter must allow write")
+
+// SeccompSupported reports whether Cmd.Syscalls can be enforced on this architecture
+func SeccompSupported() bool {
+	return auditArch != 0
+}
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// seccompNotif is struct seccomp_notif
+type seccompNotif struct {
+	id    uint64
+	pid   uint32
+	flags uint32
+	nr    int32
+	arch  uint32
+	ip    uint64
+	args  [6]uint64
+}
+
+// seccompNotifResp is struct seccomp_notif_resp
+type seccompNotifResp struct {
+	id    uint64
+	val   int64
+	error int32
+	flags uint32
+}
+
+func stmt(code uint16, k uint32) sockFilter {
+	return sockFilter{code: code, k: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) sockFilter {
+	return sockFilter{code: code, jt: jt, jf: jf, k: k}
+}
+
+// compileFilter allows syscalls except execve and execveat, the others go to the notifier.
+// syscalls must contain write, which init uses to send the listener once the filter is installed.
+func compileFilter(syscalls []string) ([]sockFilter, error) {
+	if auditArch == 0 {
+		return nil, errSeccompUnsupported
+	}
+	if !slices.Contains(syscalls, "write") {
+		return nil, errNoWrite
+	}
+	filter := []sockFilter{
+		stmt(bpfLdAbsW, seccompDataArch),
+		jump(bpfJeqK, auditArch, 1, 0),
+		stmt(bpfRetK, seccompRetKillProcess),
+		stmt(bpfLdAbsW, seccompDataNr),
+		jump(bpfJgeK, x32SyscallBit, 0, 1),
+		stmt(bpfRetK, seccompRetKillProcess),
+	}
+	for _, name := range syscalls {
+		nr, ok := syscallNumbers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown syscall %q", name)
+		}
+		if name == "execve" || name == "execveat" {
+			continue
+		}
+		filter = append(filter,
+			jump(bpfJeqK, uint32(nr), 0, 1),
+			stmt(bpfRetK, seccompRetAllow),
+		)
+	}
+	return append(filter, stmt(bpfRetK, seccompRetUserNotif)), nil
+}
+
+// filteredExec is everything execFiltered needs prepared, nothing may be allocated once the
+// rlimits are applied
+type filteredExec struct {
+	path     *byte
+	argv     []*byte
+	envv     []*byte
+	filter   []sockFilter
+	prog     sockFprog
+	listener [4]byte
+}
+
+func prepareFilteredExec(path string, args, env, syscalls []string) (*filteredExec, error) {
+	e := new(filteredExec)
+	var err error
+	if e.path, err = syscall.BytePtrFromString(path); err != nil {
+		return nil, err
+	}
+	if e.argv, err = syscall.SlicePtrFromStrings(args); err != nil {
+		return nil, err
+	}
+	if e.envv, err = syscall.SlicePtrFromStrings(env); err != nil {
+		return nil, err
+	}
+	if e.filter, err = compileFilter(syscalls); err != nil {
+		return nil, err
+	}
+	e.prog = sockFprog{len: uint16(len(e.filter)), filter: &e.filter[0]}
+	return e, nil
+}
+
+// exec installs the filter on the calling thread, which the caller locked, sends the number of
+// the listener and replaces the process. execve waits for the notifier to let it continue.
+// It only returns on failure.
+func (e *filteredExec) exec() error {
+	listener, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFlagNewListener,
+		uintptr(unsafe.Pointer(&e.prog)))
+	if errno != 0 {
+		return fmt.Errorf("install seccomp filter: %w", errno)
+	}
+	*(*int32)(unsafe.Pointer(&e.listener[0])) = int32(listener)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_WRITE, notifyFd, uintptr(unsafe.Pointer(&e.listener[0])),
+		uintptr(len(e.listener))); errno != 0 {
+		return fmt.Errorf("send seccomp listener: %w", errno)
+	}
+	_, _, errno = syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(e.path)),
+		uintptr(unsafe.Pointer(&e.argv[0])), uintptr(unsafe.Pointer(&e.envv[0])))
+	return errno
+}
+
+// notifier waits for the seccomp listener of a run, lets the execve of init continue and kills
+// the run at its next syscall outside the filter
+type notifier struct {
+	sock    int
+	pid     int
+	kill    func()
+	stop    chan struct{}
+	done    chan struct{}
+	blocked bool
+	nr      int
+}
+
+func newNotifier(sock, pid int, kill func()) *notifier {
+	n := &notifier{
+		sock: sock,
+		pid:  pid,
+		kill: kill,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// how often the listener is checked for the end of the run
+const notifierPollInterval = time.Millisecond * 50
+
+func (n *notifier) run() {
+	defer close(n.done)
+	listener, err := receiveListener(n.sock, n.pid)
+	syscall.Close(n.sock)
+	if err != nil {
+		// init exited or failed before installing the filter
+		return
+	}
+	defer syscall.Close(listener)
+	timeout := syscall.NsecToTimespec(int64(notifierPollInterval))
+	execed := false
+	for {
+		select {
+		case <-n.stop:
+			return
+		default:
+		}
+		fds := []struct {
+			fd      int32
+			events  int16
+			revents int16
+		}{{fd: int32(listener), events: pollIn}}
+		_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 1,
+			uintptr(unsafe.Pointer(&timeout)), 0, 0, 0)
+		if errno != 0 && errno != syscall.EINTR {
+			return
+		}
+		if fds[0].revents&pollIn != 0 {
+			var notif seccompNotif
+			_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(listener), seccompIoctlNotifRecv,
+				uintptr(unsafe.Pointer(&notif)))
+			if errno == 0 && !execed && int(notif.nr) == syscallNumbers["execve"] {
+				// init is the only task under the filter until its execve succeeds
+				execed = true
+				resp := seccompNotifResp{id: notif.id, flags: seccompNotifContinue}
+				syscall.Syscall(syscall.SYS_IOCTL, uintptr(listener), seccompIoctlNotifSend,
+					uintptr(unsafe.Pointer(&resp)))
+				continue
+			}
+			if errno == 0 {
+				n.blocked = true
+				n.nr = int(notif.nr)
+				n.kill()
+				return
+			}
+		}
+		// no task uses the filter anymore
+		if fds[0].revents&pollHup != 0 {
+			return
+		}
+	}
+}
+
+const (
+	pollIn  = 0x1
+	pollHup = 0x10
+)
+
+// wait stops the notifier once the run exited and returns the syscall it was stopped at
+func (n *notifier) wait() (int, bool) {
+	close(n.stop)
+	<-n.done
+	return n.nr, n.blocked
+}
+
+// receiveListener reads the number of the listener init writes to sock and duplicates it from
+// init, which waits in its execve meanwhile
+func receiveListener(sock, pid int) (int, error) {
+	var buf [4]byte
+	n, err := syscall.Read(sock, buf[:])
+	if err != nil {
+		return -1, err
+	}
+	if n != len(buf) {
+		return -1, errors.New("no seccomp listener received")
+	}
+	fd := *(*int32)(unsafe.Pointer(&buf[0]))
+	pidfd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("pidfd_open: %w", errno)
+	}
+	defer syscall.Close(int(pidfd))
+	listener, _, errno := syscall.Syscall(sysPidfdGetfd, pidfd, uintptr(fd), 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("pidfd_getfd: %w", errno)
+	}
+	// close-on-exec like every descriptor pidfd_getfd returns
+	return int(listener), nil
+}
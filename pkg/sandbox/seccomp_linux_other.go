@@ -0,0 +1,11 @@
+//go:build linux && !amd64
+
+package sandbox
+
+// seccomp filters are only built for amd64, elsewhere SeccompSupported is false and a Cmd
+// with Syscalls fails with ErrSetup
+const auditArch = 0
+
+const sysSeccomp = 0
+
+var syscallNumbers = map[string]int{}
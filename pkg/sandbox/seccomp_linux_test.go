@@ -0,0 +1,145 @@
+package sandbox
+
+import (
+	"strings"
+	"testing"
+)
+
+// runFilter interprets the few classic BPF instructions compileFilter emits on the
+// struct seccomp_data of syscall nr
+func runFilter(t *testing.T, filter []sockFilter, arch uint32, nr int) uint32 {
+	t.Helper()
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.code {
+		case bpfLdAbsW:
+			switch ins.k {
+			case seccompDataNr:
+				acc = uint32(nr)
+			case seccompDataArch:
+				acc = arch
+			default:
+				t.Fatalf("load of offset %d at %d", ins.k, pc)
+			}
+		case bpfJeqK, bpfJgeK:
+			taken := acc == ins.k
+			if ins.code == bpfJgeK {
+				taken = acc >= ins.k
+			}
+			if taken {
+				pc += int(ins.jt)
+			} else {
+				pc += int(ins.jf)
+			}
+		case bpfRetK:
+			return ins.k
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", ins.code, pc)
+		}
+	}
+	t.Fatal("filter ran past its end")
+	return 0
+}
+
+func compile(t *testing.T, syscalls []string) []sockFilter {
+	t.Helper()
+	if auditArch == 0 {
+		t.Skip(errSeccompUnsupported)
+	}
+	filter, err := compileFilter(syscalls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func TestFilterJumps(t *testing.T) {
+	for _, profile := range [][]string{ProfileStrict, ProfileRuntime} {
+		filter := compile(t, profile)
+		if len(filter) > 0xffff {
+			t.Fatalf("%d instructions", len(filter))
+		}
+		for pc, ins := range filter {
+			if ins.code == bpfJeqK || ins.code == bpfJgeK {
+				for _, off := range []uint8{ins.jt, ins.jf} {
+					if target := pc + 1 + int(off); target >= len(filter) {
+						t.Fatalf("jump at %d to %d, past the end", pc, target)
+					}
+				}
+			}
+		}
+		if last := filter[len(filter)-1]; last.code != bpfRetK {
+			t.Fatal("filter does not end with a return")
+		}
+	}
+}
+
+func TestFilterDecisions(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		syscalls []string
+		allowed  []string
+		notified []string
+	}{
+		{"strict", ProfileStrict,
+			[]string{"read", "write", "mmap", "exit_group", "openat"},
+			[]string{"execve", "execveat", "sendmsg", "socket", "clone", "fork", "vfork", "ptrace", "open"}},
+		{"runtime", ProfileRuntime,
+			[]string{"read", "write", "clone", "clone3", "getdents64", "open"},
+			[]string{"execve", "execveat", "sendmsg", "socket", "fork", "ptrace", "mount"}},
+		{"allow and deny", WithSyscalls(ProfileStrict, []string{"socket", "execve", "execveat"}, []string{"mmap"}),
+			[]string{"read", "socket"},
+			[]string{"mmap", "execve", "execveat", "sendmsg"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := compile(t, tc.syscalls)
+			for _, name := range tc.allowed {
+				if ret := runFilter(t, filter, auditArch, syscallNumbers[name]); ret != seccompRetAllow {
+					t.Errorf("%s: got %#x, want allow", name, ret)
+				}
+			}
+			for _, name := range tc.notified {
+				if ret := runFilter(t, filter, auditArch, syscallNumbers[name]); ret != seccompRetUserNotif {
+					t.Errorf("%s: got %#x, want user notif", name, ret)
+				}
+			}
+			if ret := runFilter(t, filter, auditArch, syscallNumbers["read"]|x32SyscallBit); ret != seccompRetKillProcess {
+				t.Errorf("x32 read: got %#x, want kill", ret)
+			}
+			if ret := runFilter(t, filter, auditArch+1, syscallNumbers["read"]); ret != seccompRetKillProcess {
+				t.Errorf("read of another arch: got %#x, want kill", ret)
+			}
+		})
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	if auditArch == 0 {
+		if _, err := compileFilter(ProfileStrict); err != errSeccompUnsupported {
+			t.Fatal("unsupported arch:", err)
+		}
+		return
+	}
+	if _, err := compileFilter(WithSyscalls(ProfileStrict, nil, []string{"write"})); err != errNoWrite {
+		t.Fatal("filter without write:", err)
+	}
+	if _, err := compileFilter(append([]string{"nosuchcall"}, ProfileStrict...)); err == nil || !strings.Contains(err.Error(), "nosuchcall") {
+		t.Fatal("unknown syscall:", err)
+	}
+}
+
+func TestWithSyscalls(t *testing.T) {
+	got := WithSyscalls([]string{"read", "write", "mmap"}, []string{"socket", "read", "mmap"}, []string{"mmap", "nosuchcall"})
+	if strings.Join(got, ",") != "read,write,socket" {
+		t.Fatal("got", got)
+	}
+	for _, name := range append(ProfileRuntime, ProfileStrict...) {
+		if _, ok := syscallNumbers[name]; auditArch != 0 && !ok {
+			t.Error("no number for", name)
+		}
+	}
+	if len(WithSyscalls(ProfileStrict, nil, nil)) != len(ProfileStrict) {
+		t.Fatal("profile changed without allow and deny")
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+type deadLetterResponse struct {
+	Submission *base.SubmissionDescription `json:"submission"`
+	Task       *base.JudgeTaskDescription  `json:"task"`
+	Results    map[int]*base.SubtestResult `json:"results"`
+}
+
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	offset, limit := 0, defaultListLimit
+	var err error
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	ids, err := s.broker.ListDeadLetters(r.Context(), offset, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, ids)
+}
+
+func (s *Server) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	t, err := s.broker.GetDeadLetter(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		if err == broker.ErrTaskNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &deadLetterResponse{
+		Submission: t.SubmissionDescription,
+		Task:       t.JudgeTaskDescription,
+		Results:    t.Results,
+	})
+}
+
+func (s *Server) handleRedriveDeadLetter(w http.ResponseWriter, r *http.Request) {
+	err := s.broker.RedriveDeadLetter(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		if err == broker.ErrTaskNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/storage"
+)
+
+// handleSubmissionEvents streams the progress of a submission as server-sent events
+// until its final verdict is published or the client goes away. It starts with a snapshot
+// of the subtests judged so far, and of the final verdict which ends the stream if the
+// submission is already finished.
+func (s *Server) handleSubmissionEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	// subscribed before the snapshot is taken so no event is missed in between,
+	// a subtest judged meanwhile may be sent twice
+	events, err := s.broker.Subscribe(r.Context(), id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	snapshot, err := s.snapshotEvents(r.Context(), id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for _, e := range snapshot {
+		writeEvent(w, e)
+		if e.Type == base.EventFinal {
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	for e := range events {
+		writeEvent(w, e)
+		flusher.Flush()
+		if e.Type == base.EventFinal {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e *base.ResultEvent) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, e.Encode())
+}
+
+// snapshotEvents returns the events of the current state of a submission: one per judged subtest
+// and the final one if it is finished. The broker holds the latest state, the store is only used
+// once the broker dropped it.
+func (s *Server) snapshotEvents(ctx context.Context, id string) ([]*base.ResultEvent, error) {
+	t, err := s.broker.GetSubmission(ctx, id)
+	if err == broker.ErrTaskNotFound {
+		result, err := s.store.GetSubmissionResult(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if result.FinalVerdict == base.VerdictUnjudge {
+			return nil, nil
+		}
+		return []*base.ResultEvent{{Type: base.EventFinal, SubmissionId: id, Task: result}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	subtestIds := make([]int, 0, len(t.Results))
+	for subtestId, result := range t.Results {
+		if result.VerdictCode != base.VerdictUnjudge {
+			subtestIds = append(subtestIds, subtestId)
+		}
+	}
+	sort.Ints(subtestIds)
+	events := make([]*base.ResultEvent, 0, len(subtestIds)+1)
+	for _, subtestId := range subtestIds {
+		events = append(events, &base.ResultEvent{
+			Type:         base.EventSubtest,
+			SubmissionId: id,
+			SubtestId:    subtestId,
+			Subtest:      t.Results[subtestId],
+		})
+	}
+	if t.FinalVerdict != base.VerdictUnjudge {
+		events = append(events, &base.ResultEvent{Type: base.EventFinal, SubmissionId: id, Task: t.JudgeTaskDescription})
+	}
+	return events, nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/storage"
+	"github.com/khoakmp/judgo/pkg/testcase"
+)
+
+type rejudgeRequest struct {
+	ProblemId     string   `json:"problem_id"`
+	ContestId     string   `json:"contest_id"`
+	SubmissionIds []string `json:"submission_ids"`
+}
+
+type rejudgeResponse struct {
+	Id      string   `json:"id"`
+	Queued  int      `json:"queued"`
+	Skipped []string `json:"skipped"` // submissions still queued, being judged or cancelled
+}
+
+type rejudgeReport struct {
+	Id        string                           `json:"id"`
+	CreatedAt time.Time                        `json:"created_at"`
+	Total     int                              `json:"total"`
+	Done      int                              `json:"done"`
+	Changed   map[string]*storage.RejudgeEntry `json:"changed"`
+}
+
+// handleRejudge judges again the finished submissions of a problem, a contest or a list,
+// the tasks go to the rejudge queue which is only picked from when no new submission is pending
+func (s *Server) handleRejudge(w http.ResponseWriter, r *http.Request) {
+	req := new(rejudgeRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.ProblemId == "" && req.ContestId == "" && len(req.SubmissionIds) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	submissions, err := s.store.ListSubmissions(r.Context(), storage.SubmissionFilter{
+		ProblemId: req.ProblemId,
+		ContestId: req.ContestId,
+		Ids:       req.SubmissionIds,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rejudge := &storage.Rejudge{
+		Id:        uuid.New().String(),
+		CreatedAt: time.Now(),
+		Entries:   make(map[string]*storage.RejudgeEntry),
+	}
+	resp := &rejudgeResponse{
+		Id:      rejudge.Id,
+		Skipped: make([]string, 0),
+	}
+	metas := make(map[string]testcase.TestcaseMetadata)
+	tasks := make([]*base.JudgeSubmissionTask, 0, len(submissions))
+	for _, submission := range submissions {
+		result, err := s.store.GetSubmissionResult(r.Context(), submission.Id)
+		if err != nil && err != storage.ErrNotFound {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if result == nil || result.FinalVerdict == base.VerdictUnjudge || result.FinalVerdict == base.VerdictCancelled {
+			resp.Skipped = append(resp.Skipped, submission.Id)
+			continue
+		}
+		meta, ok := metas[submission.ProblemId]
+		if !ok {
+			meta, err = s.testcase.GetTestcaseMetadata(submission.ProblemId)
+			if err != nil {
+				if err == testcase.ErrTestcaseNotFound {
+					resp.Skipped = append(resp.Skipped, submission.Id)
+					continue
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			metas[submission.ProblemId] = meta
+		}
+		submission.RejudgeId = rejudge.Id
+		tasks = append(tasks, newJudgeSubmissionTask(submission, meta))
+		rejudge.Entries[submission.Id] = &storage.RejudgeEntry{
+			OldVerdict: result.FinalVerdict,
+			OldPoint:   result.TotalPoint,
+		}
+	}
+
+	// the rejudge is recorded first so results of fast judgers are not missed
+	if err := s.store.CreateRejudge(r.Context(), rejudge); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// a submission queued meanwhile, e.g. by another rejudge, is left to that run
+	queued := make([]string, 0)
+	for _, t := range tasks {
+		err := s.broker.Enqueue(r.Context(), t)
+		if err == broker.ErrAlreadyQueued {
+			queued = append(queued, t.Id)
+			continue
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp.Queued++
+	}
+	if len(queued) > 0 {
+		if err := s.store.DeleteRejudgeEntries(r.Context(), rejudge.Id, queued); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp.Skipped = append(resp.Skipped, queued...)
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleGetRejudge(w http.ResponseWriter, r *http.Request) {
+	rejudge, err := s.store.GetRejudge(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		if err == storage.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	report := &rejudgeReport{
+		Id:        rejudge.Id,
+		CreatedAt: rejudge.CreatedAt,
+		Total:     len(rejudge.Entries),
+		Changed:   make(map[string]*storage.RejudgeEntry),
+	}
+	for id, e := range rejudge.Entries {
+		if e.Done {
+			report.Done++
+		}
+		if e.Changed() {
+			report.Changed[id] = e
+		}
+	}
+	writeJSON(w, report)
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/storage"
 	"github.com/khoakmp/judgo/pkg/testcase"
 )
 
@@ -12,12 +13,16 @@ type Server struct {
 	router   *mux.Router
 	testcase testcase.TestcaseManager
 	broker   broker.Broker
+	store    storage.Store
 }
 
-func NewServer() *Server {
+func NewServer(b broker.Broker, tm testcase.TestcaseManager, store storage.Store) *Server {
 	r := mux.NewRouter()
 	s := &Server{
-		router: r,
+		router:   r,
+		testcase: tm,
+		broker:   b,
+		store:    store,
 	}
 	privateRouter := r.PathPrefix("/private").Subrouter()
 
@@ -27,6 +32,21 @@ func NewServer() *Server {
 		})
 	})
 	privateRouter.HandleFunc("/submission", s.handleCreateSubmission).Methods(http.MethodPost)
+	privateRouter.HandleFunc("/submission/{id}", s.handleCancelSubmission).Methods(http.MethodDelete)
+	privateRouter.HandleFunc("/submission/{id}/events", s.handleSubmissionEvents).Methods(http.MethodGet)
+
+	adminRouter := r.PathPrefix("/admin").Subrouter()
+	adminRouter.HandleFunc("/deadletter", s.handleListDeadLetters).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/deadletter/{id}", s.handleGetDeadLetter).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/deadletter/{id}/redrive", s.handleRedriveDeadLetter).Methods(http.MethodPost)
+	adminRouter.HandleFunc("/workers", s.handleListWorkers).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/stats", s.handleStats).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/rejudge", s.handleRejudge).Methods(http.MethodPost)
+	adminRouter.HandleFunc("/rejudge/{id}", s.handleGetRejudge).Methods(http.MethodGet)
 
 	return s
 }
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
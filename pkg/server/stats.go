@@ -0,0 +1,14 @@
+package server
+
+import (
+	"net/http"
+)
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.broker.Stats(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
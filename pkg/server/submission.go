@@ -4,9 +4,13 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/khoakmp/judgo/pkg/base"
+	"github.com/khoakmp/judgo/pkg/broker"
+	"github.com/khoakmp/judgo/pkg/storage"
 	"github.com/khoakmp/judgo/pkg/testcase"
 )
 
@@ -17,6 +21,13 @@ func (s *Server) handleCreateSubmission(w http.ResponseWriter, r *http.Request)
 	json.Unmarshal(reqBody, submission)
 	submission.Username = "kmp"
 	submission.Id = uuid.New().String()
+	// only set by the judgers on the shards they create
+	submission.ParentId = ""
+	submission.Artifact = ""
+	if !isLanguage(submission.Language) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	meta, err := s.testcase.GetTestcaseMetadata(submission.ProblemId)
 
 	if err != nil {
@@ -28,12 +39,101 @@ func (s *Server) handleCreateSubmission(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key != "" {
+		// keys are per user so clients cannot collide with each other
+		key = submission.Username + ":" + key
+		id, err := s.broker.ClaimIdempotencyKey(r.Context(), key, submission.Id, idempotencyWindow)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if id != submission.Id {
+			s.writeReplayedSubmission(w, r, id)
+			return
+		}
+	}
+
+	t := newJudgeSubmissionTask(submission, meta)
+	err = s.store.SaveSubmission(r.Context(), submission)
+	if err == nil {
+		err = s.broker.Enqueue(r.Context(), t)
+	}
+	if err != nil {
+		if key != "" {
+			s.broker.ReleaseIdempotencyKey(r.Context(), key, submission.Id)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &submissionResponse{
+		Id:     submission.Id,
+		Status: statusPending,
+	})
+}
+
+func isLanguage(language string) bool {
+	for _, l := range base.Languages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// a retry with the same Idempotency-Key within the window returns the original submission
+	idempotencyWindow = time.Hour * 24
+)
+
+const (
+	statusPending  = "pending"
+	statusFinished = "finished"
+)
+
+type submissionResponse struct {
+	Id         string `json:"id"`
+	Status     string `json:"status"`
+	Verdict    *int   `json:"verdict,omitempty"`
+	TotalPoint *int   `json:"total_point,omitempty"`
+}
+
+// writeReplayedSubmission answers a repeated create with the original submission,
+// which is pending until the store has its final result
+func (s *Server) writeReplayedSubmission(w http.ResponseWriter, r *http.Request, id string) {
+	resp := &submissionResponse{
+		Id:     id,
+		Status: statusPending,
+	}
+	result, err := s.store.GetSubmissionResult(r.Context(), id)
+	if err != nil && err != storage.ErrNotFound {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if result != nil && result.FinalVerdict != base.VerdictUnjudge {
+		resp.Status = statusFinished
+		resp.Verdict = &result.FinalVerdict
+		resp.TotalPoint = &result.TotalPoint
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	writeJSON(w, resp)
+}
+
+// newJudgeSubmissionTask builds the task judging submission against the current testcases of its problem
+func newJudgeSubmissionTask(submission *base.SubmissionDescription, meta testcase.TestcaseMetadata) *base.JudgeSubmissionTask {
 	task := &base.JudgeTaskDescription{
-		MaxRetry:     3,
-		FinalVerdict: base.VerdictUnjudge,
-		TimeLimit:    meta.TimeLimit,
-		Memory:       meta.MemoryLimit,
+		MaxRetry:      3,
+		FinalVerdict:  base.VerdictUnjudge,
+		TimeLimit:     meta.TimeLimit,
+		MemoryLimit:   meta.MemoryLimit,
+		WallTimeLimit: meta.WallTimeLimit,
+		OutputLimit:   meta.OutputLimit,
+		SyscallAllow:  meta.SyscallAllow,
+		SyscallDeny:   meta.SyscallDeny,
 	}
+	submission.Type = meta.Type
+	submission.ResourceClass = meta.ResourceClass
 	results := make(map[int]*base.SubtestResult)
 
 	for i := 0; i < meta.Quantity; i++ {
@@ -42,16 +142,44 @@ func (s *Server) handleCreateSubmission(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	t := &base.JudgeSubmissionTask{
+	return &base.JudgeSubmissionTask{
 		SubmissionDescription: submission,
 		JudgeTaskDescription:  task,
 		Results:               results,
 	}
+}
 
-	err = s.broker.Enqueue(t)
+// handleCancelSubmission withdraws a pending submission right away, a submission being judged
+// is aborted by its judger which then records the cancellation.
+func (s *Server) handleCancelSubmission(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	leased, err := s.broker.Cancel(r.Context(), id)
 	if err != nil {
+		if err == broker.ErrTaskNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if leased {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
 
+	t := &base.JudgeSubmissionTask{
+		SubmissionDescription: &base.SubmissionDescription{
+			Id: id,
+		},
+		JudgeTaskDescription: &base.JudgeTaskDescription{
+			FinalVerdict: base.VerdictCancelled,
+		},
+	}
+	if err := s.store.UpdateSubmissionResult(r.Context(), t); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// the sweeper retries on failure
+	s.broker.MarkPersisted(r.Context(), id)
+	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,14 @@
+package server
+
+import (
+	"net/http"
+)
+
+func (s *Server) handleListWorkers(w http.ResponseWriter, r *http.Request) {
+	workers, err := s.broker.ListWorkers(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, workers)
+}
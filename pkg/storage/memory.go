@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/khoakmp/judgo/pkg/base"
+)
+
+// MemoryStore keeps the submissions and final results in process, used when running without a database
+type MemoryStore struct {
+	mu          sync.Mutex
+	results     map[string]*base.JudgeTaskDescription
+	submissions map[string]*base.SubmissionDescription
+	order       []string // submission ids in creation order
+	rejudges    map[string]*Rejudge
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		results:     make(map[string]*base.JudgeTaskDescription),
+		submissions: make(map[string]*base.SubmissionDescription),
+		order:       make([]string, 0),
+		rejudges:    make(map[string]*Rejudge),
+	}
+}
+
+func (s *MemoryStore) UpdateSubmissionResult(ctx context.Context, t *base.JudgeSubmissionTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := *t.JudgeTaskDescription
+	s.results[t.Id] = &result
+	if t.SubmissionDescription == nil || t.RejudgeId == "" {
+		return nil
+	}
+	if r, ok := s.rejudges[t.RejudgeId]; ok {
+		if e, ok := r.Entries[t.Id]; ok {
+			e.NewVerdict = result.FinalVerdict
+			e.NewPoint = result.TotalPoint
+			e.Done = true
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveSubmission(ctx context.Context, submission *base.SubmissionDescription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.submissions[submission.Id]; !ok {
+		s.order = append(s.order, submission.Id)
+	}
+	copied := *submission
+	s.submissions[submission.Id] = &copied
+	return nil
+}
+
+func (s *MemoryStore) ListSubmissions(ctx context.Context, filter SubmissionFilter) ([]*base.SubmissionDescription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := s.order
+	if filter.Ids != nil {
+		ids = filter.Ids
+	}
+	submissions := make([]*base.SubmissionDescription, 0)
+	for _, id := range ids {
+		submission, ok := s.submissions[id]
+		if !ok {
+			continue
+		}
+		if filter.ProblemId != "" && submission.ProblemId != filter.ProblemId {
+			continue
+		}
+		if filter.ContestId != "" && submission.ContestId != filter.ContestId {
+			continue
+		}
+		copied := *submission
+		submissions = append(submissions, &copied)
+	}
+	return submissions, nil
+}
+
+func (s *MemoryStore) GetSubmissionResult(ctx context.Context, id string) (*base.JudgeTaskDescription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *result
+	return &copied, nil
+}
+
+func (s *MemoryStore) CreateRejudge(ctx context.Context, r *Rejudge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejudges[r.Id] = copyRejudge(r)
+	return nil
+}
+
+func (s *MemoryStore) GetRejudge(ctx context.Context, id string) (*Rejudge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rejudges[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyRejudge(r), nil
+}
+
+func (s *MemoryStore) DeleteRejudgeEntries(ctx context.Context, id string, submissionIds []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rejudges[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, submissionId := range submissionIds {
+		delete(r.Entries, submissionId)
+	}
+	return nil
+}
+
+func copyRejudge(r *Rejudge) *Rejudge {
+	copied := *r
+	copied.Entries = make(map[string]*RejudgeEntry, len(r.Entries))
+	for id, e := range r.Entries {
+		entry := *e
+		copied.Entries[id] = &entry
+	}
+	return &copied
+}
@@ -2,10 +2,50 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/khoakmp/judgo/pkg/base"
 )
 
 type Store interface {
 	UpdateSubmissionResult(ctx context.Context, t *base.JudgeSubmissionTask) error
+	SaveSubmission(ctx context.Context, s *base.SubmissionDescription) error
+	// ListSubmissions returns the stored submissions matching the filter in creation order
+	ListSubmissions(ctx context.Context, filter SubmissionFilter) ([]*base.SubmissionDescription, error)
+	GetSubmissionResult(ctx context.Context, id string) (*base.JudgeTaskDescription, error)
+	CreateRejudge(ctx context.Context, r *Rejudge) error
+	GetRejudge(ctx context.Context, id string) (*Rejudge, error)
+	// DeleteRejudgeEntries removes the entries of submissions which were not rejudged after all
+	DeleteRejudgeEntries(ctx context.Context, id string, submissionIds []string) error
+}
+
+var ErrNotFound = errors.New("not found")
+
+// SubmissionFilter matches by submission ids when Ids is set, otherwise by problem and contest,
+// an empty field matches everything
+type SubmissionFilter struct {
+	ProblemId string
+	ContestId string
+	Ids       []string
+}
+
+// Rejudge records the verdicts of the rejudged submissions before and after,
+// UpdateSubmissionResult fills the new verdict of a task carrying the rejudge id
+type Rejudge struct {
+	Id        string                   `json:"id"`
+	CreatedAt time.Time                `json:"created_at"`
+	Entries   map[string]*RejudgeEntry `json:"entries"` // submission id -> entry
+}
+
+type RejudgeEntry struct {
+	OldVerdict int  `json:"old_verdict"`
+	OldPoint   int  `json:"old_point"`
+	NewVerdict int  `json:"new_verdict"`
+	NewPoint   int  `json:"new_point"`
+	Done       bool `json:"done"`
+}
+
+func (e *RejudgeEntry) Changed() bool {
+	return e.Done && (e.OldVerdict != e.NewVerdict || e.OldPoint != e.NewPoint)
 }
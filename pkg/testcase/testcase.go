@@ -1,14 +1,29 @@
 package testcase
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
 
 // type: acm || oi
 type TestcaseMetadata struct {
 	TimeLimit   int   `json:"time_limit"`
-	MemoryLimit int   `json:"mem_limit"`
+	MemoryLimit int   `json:"mem_limit"` // MB
 	Quantity    int   `json:"quantity"`
 	Points      []int `json:"points"`
 	Type        int   `json:"type"`
+	// ms, 0 is a multiple of TimeLimit
+	WallTimeLimit int `json:"wall_time_limit,omitempty"`
+	// KB a program may print to stdout and to stderr each, 0 is base.DefaultOutputLimit
+	OutputLimit int `json:"output_limit,omitempty"`
+	// only workers of this resource class judge the problem, empty is base.DefaultResourceClass
+	ResourceClass string `json:"resource_class,omitempty"`
+	// syscalls added to and removed from the seccomp profile of every language
+	SyscallAllow []string `json:"syscall_allow,omitempty"`
+	SyscallDeny  []string `json:"syscall_deny,omitempty"`
 }
 
 type TestcaseManager interface {
@@ -17,11 +32,59 @@ type TestcaseManager interface {
 	GetTestcasePoints(problemID string) []int
 }
 
+// TestcaseStore reads testcases from a local directory with layout:
+// <dir>/<problem id>/meta.json, <dir>/<problem id>/<subtest id>.in, <dir>/<problem id>/<subtest id>.out
 type TestcaseStore struct {
+	dir string
 }
 
+var _ TestcaseManager = (*TestcaseStore)(nil)
+
 var ErrTestcaseNotFound = errors.New("testcase not found")
 
+func NewTestcaseStore(dir string) *TestcaseStore {
+	return &TestcaseStore{
+		dir: dir,
+	}
+}
+
+func (tm *TestcaseStore) readFile(problemID string, name string) ([]byte, error) {
+	buf, err := os.ReadFile(filepath.Join(tm.dir, filepath.Base(problemID), name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrTestcaseNotFound
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
 func (tm *TestcaseStore) GetTestcase(problemID string, subtestID int) ([]byte, []byte, error) {
-	return nil, nil, ErrTestcaseNotFound
+	inp, err := tm.readFile(problemID, fmt.Sprintf("%d.in", subtestID))
+	if err != nil {
+		return nil, nil, err
+	}
+	ans, err := tm.readFile(problemID, fmt.Sprintf("%d.out", subtestID))
+	if err != nil {
+		return nil, nil, err
+	}
+	return inp, ans, nil
+}
+
+func (tm *TestcaseStore) GetTestcaseMetadata(problemID string) (TestcaseMetadata, error) {
+	var meta TestcaseMetadata
+	buf, err := tm.readFile(problemID, "meta.json")
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(buf, &meta)
+	return meta, err
+}
+
+func (tm *TestcaseStore) GetTestcasePoints(problemID string) []int {
+	meta, err := tm.GetTestcaseMetadata(problemID)
+	if err != nil {
+		return nil
+	}
+	return meta.Points
 }